@@ -112,10 +112,7 @@ func runCommand(args []string) error {
 			case <-done:
 				log.Infof("Command is done:")
 				log.Info(wrk.StatusAsText())
-				if wrk.Error() != nil {
-					os.Exit(1)
-				}
-				os.Exit(0)
+				os.Exit(worker.ExitCode(wrk))
 			case <-timer:
 				log.Info(wrk.StatusAsText())
 			}
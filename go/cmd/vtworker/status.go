@@ -11,6 +11,7 @@ import (
 
 	"github.com/youtube/vitess/go/acl"
 	"github.com/youtube/vitess/go/vt/servenv"
+	"github.com/youtube/vitess/go/vt/worker"
 )
 
 const workerStatusPartHTML = servenv.JQueryIncludes + `
@@ -124,6 +125,18 @@ func initStatusHandling() {
 		}
 	})
 
+	// last SQLDiffWorker results, for Prometheus
+	http.HandleFunc("/sqldiff_metrics", func(w http.ResponseWriter, r *http.Request) {
+		if err := acl.CheckAccessHTTP(r, acl.MONITORING); err != nil {
+			acl.SendError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := worker.WritePrometheus(w); err != nil {
+			httpError(w, "cannot write metrics: %v", err)
+		}
+	})
+
 	// cancel handler
 	http.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
 		if err := acl.CheckAccessHTTP(r, acl.ADMIN); err != nil {
@@ -7,7 +7,8 @@ vtworker is the main program to run a worker job.
 
 It has two modes: single command or interactive.
 - in single command, it will start the job passed in from the command line,
-  and exit.
+  and exit: with 0 if it succeeded, 2 if it found differences, and 1 if it
+  failed otherwise.
 - in interactive mode, use a web browser to start an action.
 */
 package main
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -282,6 +284,107 @@ func (tl *TeeLogger) Printf(format string, v ...interface{}) {
 	tl.Two.Printf(format, v...)
 }
 
+// PrefixLogger is a Logger that adds a prefix to all the messages it
+// sends to an underlying logger
+type PrefixLogger struct {
+	Prefix string
+	Logger Logger
+}
+
+// NewPrefixLogger returns a PrefixLogger that prefixes the messages
+// sent to logger with prefix
+func NewPrefixLogger(prefix string, logger Logger) *PrefixLogger {
+	return &PrefixLogger{
+		Prefix: prefix,
+		Logger: logger,
+	}
+}
+
+func (pl *PrefixLogger) Infof(format string, v ...interface{}) {
+	pl.Logger.Infof(pl.Prefix+format, v...)
+}
+
+func (pl *PrefixLogger) Warningf(format string, v ...interface{}) {
+	pl.Logger.Warningf(pl.Prefix+format, v...)
+}
+
+func (pl *PrefixLogger) Errorf(format string, v ...interface{}) {
+	pl.Logger.Errorf(pl.Prefix+format, v...)
+}
+
+func (pl *PrefixLogger) Printf(format string, v ...interface{}) {
+	pl.Logger.Printf(pl.Prefix+format, v...)
+}
+
+// Fields are key/value pairs attached to log messages, so they can be
+// extracted and indexed by log aggregation systems.
+type Fields map[string]interface{}
+
+// String returns the fields as space separated key=value pairs,
+// sorted by key. Values containing spaces or quotes are quoted.
+func (fields Fields) String() string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := new(bytes.Buffer)
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := fmt.Sprintf("%v", fields[k])
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(value)
+	}
+	return buf.String()
+}
+
+// FieldsLogger is a Logger that appends fields to all the messages
+// it sends to an underlying logger
+type FieldsLogger struct {
+	Fields Fields
+	Logger Logger
+}
+
+// NewFieldsLogger returns a FieldsLogger that appends fields to the
+// messages sent to logger
+func NewFieldsLogger(fields Fields, logger Logger) *FieldsLogger {
+	return &FieldsLogger{
+		Fields: fields,
+		Logger: logger,
+	}
+}
+
+// suffix returns the fields formatted to be appended to a message,
+// with '%' escaped so they're not interpreted by the logger.
+func (fl *FieldsLogger) suffix() string {
+	if len(fl.Fields) == 0 {
+		return ""
+	}
+	return " " + strings.Replace(fl.Fields.String(), "%", "%%", -1)
+}
+
+func (fl *FieldsLogger) Infof(format string, v ...interface{}) {
+	fl.Logger.Infof(format+fl.suffix(), v...)
+}
+
+func (fl *FieldsLogger) Warningf(format string, v ...interface{}) {
+	fl.Logger.Warningf(format+fl.suffix(), v...)
+}
+
+func (fl *FieldsLogger) Errorf(format string, v ...interface{}) {
+	fl.Logger.Errorf(format+fl.suffix(), v...)
+}
+
+func (fl *FieldsLogger) Printf(format string, v ...interface{}) {
+	fl.Logger.Printf(format+fl.suffix(), v...)
+}
+
 // array for fast int -> string conversion
 const digits = "0123456789"
 
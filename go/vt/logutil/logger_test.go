@@ -115,3 +115,35 @@ func TestTeeLogger(t *testing.T) {
 		}
 	}
 }
+
+func TestPrefixLogger(t *testing.T) {
+	ml := NewMemoryLogger()
+	pl := NewPrefixLogger("[run1] ", ml)
+	pl.Infof("test infof %v %v", 1, 2)
+	pl.Errorf("test errorf %v %v", 3, 4)
+	if len(ml.Events) != 2 {
+		t.Fatalf("Invalid ml size: %v", ml)
+	}
+	if ml.Events[0].Value != "[run1] test infof 1 2" {
+		t.Errorf("Invalid ml[0]: %v", ml.Events[0].Value)
+	}
+	if ml.Events[1].Value != "[run1] test errorf 3 4" || ml.Events[1].Level != LOGGER_ERROR {
+		t.Errorf("Invalid ml[1]: %v", ml.Events[1])
+	}
+}
+
+func TestFieldsLogger(t *testing.T) {
+	ml := NewMemoryLogger()
+	fl := NewFieldsLogger(Fields{
+		"tablet_alias": "cell1-0000000001",
+		"keyspace":     "ks",
+		"msg":          "100% done",
+	}, ml)
+	fl.Infof("test infof %v", 1)
+	if len(ml.Events) != 1 {
+		t.Fatalf("Invalid ml size: %v", ml)
+	}
+	if want := `test infof 1 keyspace=ks msg="100% done" tablet_alias=cell1-0000000001`; ml.Events[0].Value != want {
+		t.Errorf("Invalid ml[0]: %v, want %v", ml.Events[0].Value, want)
+	}
+}
@@ -92,6 +92,27 @@ func (conn *vtgateConn) StreamExecute(ctx context.Context, query string, bindVar
 	return srout, func() error { return c.Error }
 }
 
+func (conn *vtgateConn) StreamExecuteShard(ctx context.Context, query string, keyspace string, shards []string, bindVars map[string]interface{}, tabletType topo.TabletType) (<-chan *mproto.QueryResult, vtgateconn.ErrFunc) {
+	req := &proto.QueryShard{
+		Sql:           query,
+		BindVariables: bindVars,
+		Keyspace:      keyspace,
+		Shards:        shards,
+		TabletType:    tabletType,
+		Session:       conn.session,
+	}
+	sr := make(chan *proto.QueryResult, 10)
+	c := conn.rpcConn.StreamGo("VTGate.StreamExecuteShard", req, sr)
+	srout := make(chan *mproto.QueryResult, 1)
+	go func() {
+		defer close(srout)
+		for r := range sr {
+			srout <- r.Result
+		}
+	}()
+	return srout, func() error { return c.Error }
+}
+
 func (conn *vtgateConn) Begin(ctx context.Context) error {
 	if conn.session != nil {
 		return fmt.Errorf("begin: already in a transaction")
@@ -6,13 +6,20 @@ package gorpcvtgateconn
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
 	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/rpcplus"
+	"github.com/youtube/vitess/go/rpcwrap/bsonrpc"
+	"github.com/youtube/vitess/go/sqltypes"
 	"github.com/youtube/vitess/go/vt/tabletserver/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	vtgproto "github.com/youtube/vitess/go/vt/vtgate/proto"
 	"github.com/youtube/vitess/go/vt/vtgate/vtgateconn"
 	"github.com/youtube/vitess/go/vt/vttest"
 	"golang.org/x/net/context"
@@ -144,6 +151,60 @@ func TestStreamExecute(t *testing.T) {
 	}
 }
 
+// fakeVTGate is a VTGate rpc service streaming the query it gets.
+type fakeVTGate struct {
+	mu    sync.Mutex
+	query *vtgproto.QueryShard
+}
+
+func (f *fakeVTGate) StreamExecuteShard(ctx context.Context, query *vtgproto.QueryShard, sendReply func(interface{}) error) error {
+	f.mu.Lock()
+	f.query = query
+	f.mu.Unlock()
+	if err := sendReply(&vtgproto.QueryResult{Result: &mproto.QueryResult{Fields: []mproto.Field{{Name: "id", Type: mproto.VT_LONGLONG}}}}); err != nil {
+		return err
+	}
+	return sendReply(&vtgproto.QueryResult{Result: &mproto.QueryResult{Rows: [][]sqltypes.Value{{sqltypes.MakeNumeric([]byte("1"))}}}})
+}
+
+func TestStreamExecuteShard(t *testing.T) {
+	// Listen on a random port, and serve the fake VTGate from it
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &fakeVTGate{}
+	server := rpcplus.NewServer()
+	server.RegisterName("VTGate", fake)
+	handler := http.NewServeMux()
+	bsonrpc.ServeCustomRPC(handler, server, false)
+	go http.Serve(listener, handler)
+
+	conn, err := dial(context.Background(), listener.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	ch, errFunc := conn.StreamExecuteShard(context.Background(), "select id from t", "ks", []string{"-80"}, nil, topo.TYPE_REPLICA)
+	var results []*mproto.QueryResult
+	for result := range ch {
+		results = append(results, result)
+	}
+	if err := errFunc(); err != nil {
+		t.Fatalf("StreamExecuteShard failed: %v", err)
+	}
+	if len(results) != 2 || len(results[0].Fields) != 1 || len(results[1].Rows) != 1 || results[1].Rows[0][0].String() != "1" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.query == nil || fake.query.Sql != "select id from t" || fake.query.Keyspace != "ks" || !reflect.DeepEqual(fake.query.Shards, []string{"-80"}) || fake.query.TabletType != topo.TYPE_REPLICA {
+		t.Errorf("unexpected query sent: %+v", fake.query)
+	}
+}
+
 func TestRollback(t *testing.T) {
 	t.Skip("skipping for go1.3")
 	if testing.Short() {
@@ -57,6 +57,10 @@ type VTGateConn interface {
 	// to see if the stream ended normally or due to a failure.
 	StreamExecute(ctx context.Context, query string, bindVars map[string]interface{}, tabletType topo.TabletType) (<-chan *mproto.QueryResult, ErrFunc)
 
+	// StreamExecuteShard executes a streaming query on vtgate, on a
+	// set of shards of a keyspace. See StreamExecute for the results.
+	StreamExecuteShard(ctx context.Context, query string, keyspace string, shards []string, bindVars map[string]interface{}, tabletType topo.TabletType) (<-chan *mproto.QueryResult, ErrFunc)
+
 	// Transaction support
 	Begin(ctx context.Context) error
 	Commit(ctx context.Context) error
@@ -0,0 +1,31 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package events
+
+import (
+	"time"
+
+	base "github.com/youtube/vitess/go/vt/events"
+)
+
+// SQLDiff is an event that records the outcome of a SQL diff, for
+// auditing. It is dispatched once the diff reached a terminal state,
+// with that state and its error, if any, as the status.
+type SQLDiff struct {
+	base.StatusUpdater
+
+	RunID, Name string
+
+	// User and Host are who ran the diff, and where.
+	User, Host string
+
+	// SupersetSource and SubsetSource are where each side was read
+	// from, SupersetSQL and SubsetSQL the queries compared.
+	SupersetSource, SupersetSQL string
+	SubsetSource, SubsetSQL     string
+
+	StartTime, EndTime time.Time
+	FoundDifferences   bool
+}
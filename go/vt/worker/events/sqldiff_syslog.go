@@ -0,0 +1,25 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package events
+
+import (
+	"fmt"
+	"log/syslog"
+
+	"github.com/youtube/vitess/go/event/syslogger"
+)
+
+// Syslog writes a SQLDiff event to syslog. Diffs that found
+// differences are logged as warnings.
+func (ev *SQLDiff) Syslog() (syslog.Priority, string) {
+	priority := syslog.LOG_INFO
+	if ev.FoundDifferences {
+		priority = syslog.LOG_WARNING
+	}
+	return priority, fmt.Sprintf("%s [sql diff %s] %s by %s@%s: superset %s, subset %s, differences: %v",
+		ev.Name, ev.RunID, ev.Status, ev.User, ev.Host, ev.SupersetSource, ev.SubsetSource, ev.FoundDifferences)
+}
+
+var _ syslogger.Syslogger = (*SQLDiff)(nil) // compile-time interface check
@@ -0,0 +1,34 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package events
+
+import (
+	"log/syslog"
+	"testing"
+
+	base "github.com/youtube/vitess/go/vt/events"
+)
+
+func TestSQLDiffSyslog(t *testing.T) {
+	wantSev, wantMsg := syslog.LOG_WARNING, "lookup-check [sql diff run-1] error: 3 differences by alice@host-1: superset ks/0, subset lookup/0, differences: true"
+	ev := &SQLDiff{
+		RunID:            "run-1",
+		Name:             "lookup-check",
+		User:             "alice",
+		Host:             "host-1",
+		SupersetSource:   "ks/0",
+		SubsetSource:     "lookup/0",
+		FoundDifferences: true,
+		StatusUpdater:    base.StatusUpdater{Status: "error: 3 differences"},
+	}
+	gotSev, gotMsg := ev.Syslog()
+
+	if gotSev != wantSev {
+		t.Errorf("wrong severity: got %v, want %v", gotSev, wantSev)
+	}
+	if gotMsg != wantMsg {
+		t.Errorf("wrong message: got %v, want %v", gotMsg, wantMsg)
+	}
+}
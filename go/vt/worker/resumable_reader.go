@@ -0,0 +1,163 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// This file contains the ResumableReader, which reads a query again
+// from where a previous read stopped.
+
+// ReaderOpener opens a QueryResultReader for the sql query. The
+// returned function releases its resources, once it is closed.
+type ReaderOpener func(ctx context.Context, sql string) (*QueryResultReader, context.CancelFunc, error)
+
+// ResumableReader opens the readers of a query ordered by a unique
+// first key column, and can open it again after the last key read: the
+// query is then rebuilt with a "key > last" condition, as deltaSQL
+// does, which compares the keys in the order of the ORDER BY, so no
+// row is skipped or read twice whatever the collation. It is the base of the features resuming a read where it
+// stopped, like SQLDiffOptions.ReselectOnUnhealthy.
+type ResumableReader struct {
+	sql  string
+	open ReaderOpener
+
+	// all subsequent fields are protected by the mutex, as the
+	// readers record the keys they yield
+	mu sync.Mutex
+	// lastKey is the key the next Open resumes after, NULL to
+	// read the query from the start. startKey is the one the
+	// last Open started after.
+	lastKey  sqltypes.Value
+	startKey sqltypes.Value
+}
+
+// NewResumableReader returns a ResumableReader for the sql query,
+// opening its readers with open. It fails if the query can't be
+// resumed.
+func NewResumableReader(sql string, open ReaderOpener) (*ResumableReader, error) {
+	if _, err := deltaSQL(sql, sqltypes.MakeNumeric([]byte("0"))); err != nil {
+		return nil, fmt.Errorf("query can't be resumed: %v", err)
+	}
+	return &ResumableReader{
+		sql:  sql,
+		open: open,
+	}, nil
+}
+
+// LastKey returns the key the next Open resumes after: the key of the
+// last row yielded by the last reader, or the one of the last Seek.
+// It is NULL if the query is read from the start.
+func (r *ResumableReader) LastKey() sqltypes.Value {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastKey
+}
+
+// Seek sets the key the next Open resumes after. A consumer that
+// buffers rows seeks to the key of the last row it processed, as the
+// rows yielded after it would otherwise be skipped. A NULL key goes
+// back to the key the last Open started after.
+func (r *ResumableReader) Seek(key sqltypes.Value) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key.IsNull() {
+		r.lastKey = r.startKey
+		return
+	}
+	r.lastKey = key
+}
+
+// SQL returns the query the next Open runs.
+func (r *ResumableReader) SQL() (string, error) {
+	lastKey := r.LastKey()
+	if lastKey.IsNull() {
+		return r.sql, nil
+	}
+	return deltaSQL(r.sql, lastKey)
+}
+
+// Open opens a reader for the query, resuming after LastKey. The
+// reader records the key of each row it yields, as returned by
+// LastKey. Its results are yielded one at a time, so a consumer that
+// read all of them, like one that got a stream error, processed all
+// the rows up to LastKey.
+func (r *ResumableReader) Open(ctx context.Context) (*QueryResultReader, context.CancelFunc, error) {
+	sql, err := r.SQL()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the stream is cancelled by Close, so the goroutine can't stay
+	// blocked reading it
+	ctx, cancelRead := context.WithCancel(ctx)
+	qrr, cancel, err := r.open(ctx, sql)
+	if err != nil {
+		cancelRead()
+		return nil, nil, err
+	}
+	if len(qrr.Fields) == 0 {
+		qrr.Close()
+		cancel()
+		cancelRead()
+		return nil, nil, fmt.Errorf("query '%v' returned no field", sql)
+	}
+	keyField := qrr.Fields[0]
+	r.mu.Lock()
+	r.startKey = r.lastKey
+	r.mu.Unlock()
+
+	output := make(chan *mproto.QueryResult)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer close(output)
+		for result := range qrr.Output {
+			select {
+			case output <- result:
+			case <-done:
+				return
+			}
+			if len(result.Rows) > 0 {
+				key := resumeKeyValue(keyField, result.Rows[len(result.Rows)-1][0])
+				r.mu.Lock()
+				r.lastKey = key
+				r.mu.Unlock()
+			}
+		}
+	}()
+	reader := NewQueryResultReader(output, qrr.Fields, qrr.Error, func() {
+		close(done)
+		cancelRead()
+		qrr.Close()
+		<-stopped
+	})
+	reader.ctx = ctx
+	return reader, func() {
+		cancel()
+		cancelRead()
+	}, nil
+}
+
+// resumeKeyValue returns a first key value as a numeric value for the
+// integer columns, so it can be used in a query. The other values are
+// compared as strings.
+func resumeKeyValue(field mproto.Field, key sqltypes.Value) sqltypes.Value {
+	if key.IsNull() {
+		return sqltypes.Value{}
+	}
+	switch field.Type {
+	case mproto.VT_TINY, mproto.VT_SHORT, mproto.VT_LONG, mproto.VT_LONGLONG, mproto.VT_INT24:
+		return sqltypes.MakeNumeric(key.Raw())
+	}
+	return sqltypes.MakeString(key.Raw())
+}
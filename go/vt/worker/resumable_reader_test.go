@@ -0,0 +1,130 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+func TestResumableReader(t *testing.T) {
+	var opened []string
+	open := func(ctx context.Context, sql string) (*QueryResultReader, context.CancelFunc, error) {
+		opened = append(opened, sql)
+		// the stream fails after its rows
+		qrr := newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"}, []string{"2", "b"}, []string{"3", "c"}))
+		qrr.clientErrFn = func() error { return fmt.Errorf("connection reset") }
+		return qrr, func() {}, nil
+	}
+	if _, err := NewResumableReader("select id, msg from t", open); err == nil {
+		t.Errorf("NewResumableReader() of an unordered query should have failed")
+	}
+	r, err := NewResumableReader("select id, msg from t order by id", open)
+	if err != nil {
+		t.Fatalf("NewResumableReader() failed: %v", err)
+	}
+
+	// the rows yielded before the stream error were all read
+	qrr, cancel, err := r.Open(context.Background())
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	rr := NewRowReader(qrr)
+	rows := 0
+	for {
+		row, err := rr.Next()
+		if err != nil {
+			break
+		}
+		if row == nil {
+			t.Fatalf("the stream error was not returned")
+		}
+		rows++
+	}
+	qrr.Close()
+	cancel()
+	if rows != 3 || r.LastKey().String() != "3" || !r.LastKey().IsNumeric() {
+		t.Errorf("read %v rows, LastKey() = %v, want 3 rows and a numeric 3", rows, r.LastKey())
+	}
+	if sql, err := r.SQL(); err != nil || !strings.Contains(sql, "where id > 3") {
+		t.Errorf("SQL() = %q, %v, want the keys above 3", sql, err)
+	}
+
+	// the next reader resumes after the last key, a consumer that
+	// only processed some of the rows seeks back
+	qrr, cancel, err = r.Open(context.Background())
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if len(opened) != 2 || !strings.Contains(opened[1], "where id > 3") {
+		t.Errorf("opened %v, want a resumed query", opened)
+	}
+	if _, err := NewRowReader(qrr).Next(); err != nil {
+		t.Errorf("Next() failed: %v", err)
+	}
+	qrr.Close()
+	cancel()
+	r.Seek(sqltypes.MakeNumeric([]byte("2")))
+	if sql, _ := r.SQL(); !strings.Contains(sql, "where id > 2") {
+		t.Errorf("SQL() = %q after Seek(2)", sql)
+	}
+	r.Seek(sqltypes.Value{})
+	if sql, _ := r.SQL(); !strings.Contains(sql, "where id > 3") {
+		t.Errorf("SQL() = %q after Seek(NULL), want the start of the last reader", sql)
+	}
+}
+
+func TestResumableReaderStringKey(t *testing.T) {
+	open := func(ctx context.Context, sql string) (*QueryResultReader, context.CancelFunc, error) {
+		return newFakeQueryResultReader(allShardsFields, nil), func() {}, nil
+	}
+	r, err := NewResumableReader("select name, msg from t order by name", open)
+	if err != nil {
+		t.Fatalf("NewResumableReader() failed: %v", err)
+	}
+	// the key is compared with the collation the rows are sorted by
+	r.Seek(sqltypes.MakeString([]byte("Bob")))
+	if sql, err := r.SQL(); err != nil || !strings.Contains(sql, "where name > 'Bob' order by name asc") {
+		t.Errorf("SQL() = %q, %v, want the keys above 'Bob' in the collation order", sql, err)
+	}
+}
+
+func TestResumableReaderCloseBlockedStream(t *testing.T) {
+	// the stream only ends once its context is cancelled
+	open := func(ctx context.Context, sql string) (*QueryResultReader, context.CancelFunc, error) {
+		output := make(chan *mproto.QueryResult)
+		go func() {
+			<-ctx.Done()
+			close(output)
+		}()
+		return NewQueryResultReader(output, allShardsFields, ctx.Err, nil), func() {}, nil
+	}
+	r, err := NewResumableReader("select id, msg from t order by id", open)
+	if err != nil {
+		t.Fatalf("NewResumableReader() failed: %v", err)
+	}
+	qrr, cancel, err := r.Open(context.Background())
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer cancel()
+	closed := make(chan struct{})
+	go func() {
+		qrr.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close() of a reader blocked on its stream didn't return")
+	}
+}
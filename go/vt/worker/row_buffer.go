@@ -0,0 +1,104 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// This file contains the accounting of the results buffered by the
+// RowReaders of a RowSubsetDiffer, and the spilling of the results
+// going over its limit to temporary files.
+
+// rowBuffer accounts for the bytes of the results buffered by the
+// RowReaders of a differ: each of them holds its current result,
+// until its rows are all compared. The peak is always tracked. If
+// maxBytes is set, a result making the total go over it is spilled to
+// a gzipped file in spillDir, and read back one row at a time, or
+// fails the diff if spillDir is not set.
+type rowBuffer struct {
+	maxBytes int64
+	spillDir string
+
+	bytes     int64
+	peakBytes int64
+}
+
+// add accounts for size more bytes, and returns true if they are over
+// the limit.
+func (rb *rowBuffer) add(size int64) bool {
+	rb.bytes += size
+	if rb.bytes > rb.peakBytes {
+		rb.peakBytes = rb.bytes
+	}
+	return rb.maxBytes > 0 && rb.bytes > rb.maxBytes
+}
+
+// spilledRows reads back the rows of a result spilled to a temporary
+// file. The file is removed as soon as it is created, so it goes away
+// when closed, even if the worker dies.
+type spilledRows struct {
+	file    *os.File
+	decoder *json.Decoder
+}
+
+// spillRows writes the rows to a gzipped temporary file in dir, in
+// the snapshot row format, and returns their reader.
+func spillRows(dir string, rows [][]sqltypes.Value) (*spilledRows, error) {
+	file, err := ioutil.TempFile(dir, "vtworker-spill-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create spill file: %v", err)
+	}
+	os.Remove(file.Name())
+	gz := gzip.NewWriter(file)
+	encoder := json.NewEncoder(gz)
+	for _, row := range rows {
+		if err := encoder.Encode(snapshotValues(row)); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot spill rows: %v", err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot spill rows: %v", err)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot read spilled rows back: %v", err)
+	}
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot read spilled rows back: %v", err)
+	}
+	return &spilledRows{
+		file:    file,
+		decoder: json.NewDecoder(gzr),
+	}, nil
+}
+
+// next returns the next spilled row, or nil once they are all read.
+func (sr *spilledRows) next() ([]sqltypes.Value, error) {
+	var values [][]byte
+	if err := sr.decoder.Decode(&values); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot read spilled rows back: %v", err)
+	}
+	return snapshotRow(values), nil
+}
+
+// close closes and so removes the spill file.
+func (sr *spilledRows) close() {
+	sr.file.Close()
+}
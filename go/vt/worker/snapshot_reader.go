@@ -0,0 +1,237 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// This file contains the readers of table snapshots exported to files
+// or object storage, to diff live data against a point in time.
+//
+// A snapshot is a stream of JSON values: first the fields of the rows,
+// as a JSON array of mproto.Field, then each row as a JSON array of its
+// values, base64 encoded, or null for NULL, and last a snapshotTrailer
+// object. The rows are in the order of the query the snapshot was
+// exported with, so they can be diffed in a streaming way. A snapshot
+// whose URL path ends with ".gz" is gzipped. WriteSnapshot writes
+// snapshots in this format.
+
+// snapshotTrailer ends a snapshot. A snapshot cut short, by a failed
+// export or upload, has none, or one with the wrong row count, so it
+// is not mistaken for a table with fewer rows.
+type snapshotTrailer struct {
+	Rows int
+}
+
+// SnapshotOpener opens the snapshot object at u for reading.
+type SnapshotOpener func(ctx context.Context, u *url.URL) (io.ReadCloser, error)
+
+var (
+	snapshotOpenersMu sync.Mutex
+	snapshotOpeners   = map[string]SnapshotOpener{
+		"file": openFileSnapshot,
+	}
+)
+
+// RegisterSnapshotOpener registers the opener of the snapshot URLs
+// with the provided scheme, like "gs" or "s3", usually from the init
+// function of the plugin implementing it. The "file" scheme is built
+// in.
+func RegisterSnapshotOpener(scheme string, opener SnapshotOpener) {
+	snapshotOpenersMu.Lock()
+	defer snapshotOpenersMu.Unlock()
+	if _, ok := snapshotOpeners[scheme]; ok {
+		log.Fatalf("SnapshotOpener %s already exists", scheme)
+	}
+	snapshotOpeners[scheme] = opener
+}
+
+// snapshotOpener returns the opener of the snapshot URL.
+func snapshotOpener(rawurl string) (SnapshotOpener, *url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid snapshot URL: %v", err)
+	}
+	snapshotOpenersMu.Lock()
+	defer snapshotOpenersMu.Unlock()
+	opener, ok := snapshotOpeners[u.Scheme]
+	if !ok {
+		return nil, nil, fmt.Errorf("no SnapshotOpener registered for the %q scheme of snapshot %v", u.Scheme, redactSnapshotURL(rawurl))
+	}
+	return opener, u, nil
+}
+
+// openFileSnapshot opens a "file:///path" snapshot.
+func openFileSnapshot(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	return os.Open(u.Path)
+}
+
+// redactSnapshotURL returns the snapshot URL without its credentials
+// and its query, which can hold a signature.
+func redactSnapshotURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "invalid URL"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// NewQueryResultReaderForSnapshot creates a new QueryResultReader
+// streaming the rows of the snapshot at rawurl. The snapshot is
+// closed once its rows are read, or when ctx is done. A snapshot
+// without its trailer, or with a different row count, fails the
+// stream as truncated.
+func NewQueryResultReaderForSnapshot(ctx context.Context, rawurl string) (*QueryResultReader, error) {
+	opener, u, err := snapshotOpener(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := opener(ctx, u)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open snapshot %v: %v", redactSnapshotURL(rawurl), err)
+	}
+	var r io.Reader = rc
+	if strings.HasSuffix(u.Path, ".gz") {
+		gz, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("cannot uncompress snapshot %v: %v", redactSnapshotURL(rawurl), err)
+		}
+		r = gz
+	}
+	decoder := json.NewDecoder(r)
+	var fields []mproto.Field
+	if err := decoder.Decode(&fields); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("cannot read the fields of snapshot %v: %v", redactSnapshotURL(rawurl), err)
+	}
+
+	// streamErr is written before output is closed, so it can be
+	// read once output is drained
+	output := make(chan *mproto.QueryResult, 10)
+	var streamErr error
+	go func() {
+		defer close(output)
+
+		var rows [][]sqltypes.Value
+		count := 0
+		var trailer *snapshotTrailer
+		for {
+			var raw json.RawMessage
+			err := decoder.Decode(&raw)
+			switch {
+			case err == io.EOF:
+				if trailer == nil || trailer.Rows != count {
+					streamErr = fmt.Errorf("snapshot %v is truncated: it ended after %v rows without a trailer matching them", redactSnapshotURL(rawurl), count)
+					return
+				}
+			case err != nil:
+				streamErr = fmt.Errorf("cannot read snapshot %v: %v", redactSnapshotURL(rawurl), err)
+				return
+			case trailer != nil:
+				streamErr = fmt.Errorf("cannot read snapshot %v: values after its trailer", redactSnapshotURL(rawurl))
+				return
+			case len(raw) > 0 && raw[0] == '{':
+				trailer = &snapshotTrailer{}
+				if err := json.Unmarshal(raw, trailer); err != nil {
+					streamErr = fmt.Errorf("cannot read the trailer of snapshot %v: %v", redactSnapshotURL(rawurl), err)
+					return
+				}
+				continue
+			default:
+				var values [][]byte
+				if err := json.Unmarshal(raw, &values); err != nil {
+					streamErr = fmt.Errorf("cannot read snapshot %v: %v", redactSnapshotURL(rawurl), err)
+					return
+				}
+				count++
+				rows = append(rows, snapshotRow(values))
+				if len(rows) < mysqlReaderBatchSize {
+					continue
+				}
+			}
+			if len(rows) > 0 {
+				select {
+				case output <- &mproto.QueryResult{Rows: rows}:
+				case <-ctx.Done():
+					streamErr = ctx.Err()
+					return
+				}
+				rows = nil
+			}
+			if err == io.EOF {
+				return
+			}
+		}
+	}()
+	qrr := NewQueryResultReader(output, fields, func() error { return streamErr }, func() { rc.Close() })
+	qrr.ctx = ctx
+	return qrr, nil
+}
+
+// WriteSnapshot writes the rows of qrr to w in the snapshot format,
+// for instance to export a table to compare against later. The
+// trailer is only written once all the rows were read. It returns the
+// number of rows written.
+func WriteSnapshot(w io.Writer, qrr *QueryResultReader) (int, error) {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(qrr.Fields); err != nil {
+		return 0, err
+	}
+	rr := NewRowReader(qrr)
+	count := 0
+	for {
+		row, err := rr.Next()
+		if err != nil {
+			return count, err
+		}
+		if row == nil {
+			return count, encoder.Encode(snapshotTrailer{Rows: count})
+		}
+		if err := encoder.Encode(snapshotValues(row)); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+// snapshotValues returns the values of a row as written in a snapshot,
+// with nil for NULL.
+func snapshotValues(row []sqltypes.Value) [][]byte {
+	values := make([][]byte, len(row))
+	for i, v := range row {
+		if !v.IsNull() {
+			values[i] = append([]byte{}, v.Raw()...)
+		}
+	}
+	return values
+}
+
+// snapshotRow returns the row of values read from a snapshot.
+func snapshotRow(values [][]byte) []sqltypes.Value {
+	row := make([]sqltypes.Value, len(values))
+	for i, v := range values {
+		if v != nil {
+			row[i] = sqltypes.MakeString(v)
+		}
+	}
+	return row
+}
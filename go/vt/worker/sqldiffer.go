@@ -7,11 +7,23 @@ package worker
 import (
 	"fmt"
 	"html/template"
+	"math/rand"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/youtube/vitess/go/mysql"
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	"github.com/youtube/vitess/go/sync2"
+	"github.com/youtube/vitess/go/vt/logutil"
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+	"github.com/youtube/vitess/go/vt/sqlparser"
 	"github.com/youtube/vitess/go/vt/topo"
 	"github.com/youtube/vitess/go/vt/wrangler"
 )
@@ -27,6 +39,7 @@ const (
 	sqlDiffNotSarted              sqlDiffWorkerState = "not started"
 	sqlDiffDone                   sqlDiffWorkerState = "done"
 	sqlDiffError                  sqlDiffWorkerState = "error"
+	sqlDiffCancelled              sqlDiffWorkerState = "cancelled"
 	sqlDiffFindTargets            sqlDiffWorkerState = "finding target instances"
 	sqlDiffSynchronizeReplication sqlDiffWorkerState = "synchronizing replication"
 	sqlDiffRunning                sqlDiffWorkerState = "running the diff"
@@ -37,13 +50,857 @@ func (state sqlDiffWorkerState) String() string {
 	return string(state)
 }
 
+// SQLDiffErrorCategory classifies the error a SQLDiffWorker ended
+// with, so monitoring can react differently to each kind of failure.
+type SQLDiffErrorCategory string
+
+const (
+	// SQLDiffErrorNone is used when there is no error.
+	SQLDiffErrorNone SQLDiffErrorCategory = ""
+
+	// SQLDiffErrorNoTarget means no suitable rdonly tablet could
+	// be found or marked as checker (a capacity problem).
+	SQLDiffErrorNoTarget SQLDiffErrorCategory = "no_target"
+
+	// SQLDiffErrorRPC means a RPC to a tablet failed (usually a
+	// transient problem).
+	SQLDiffErrorRPC SQLDiffErrorCategory = "rpc"
+
+	// SQLDiffErrorQuery means MySQL rejected one of the queries
+	// (a configuration problem).
+	SQLDiffErrorQuery SQLDiffErrorCategory = "query"
+
+	// SQLDiffErrorDifferences means the diff ran and found
+	// differences (a data problem).
+	SQLDiffErrorDifferences SQLDiffErrorCategory = "differences"
+
+	// SQLDiffErrorCountAssertion means the row counts of both
+	// sides violate SQLDiffOptions.CountAssertion (a data
+	// problem).
+	SQLDiffErrorCountAssertion SQLDiffErrorCategory = "count_assertion"
+
+	// SQLDiffErrorInconsistent means the replication position of
+	// a tablet moved while it was read, with the StrictConsistency
+	// option, or the VerifyChecksum checks failed, so the diff
+	// result can't be trusted (retry it).
+	SQLDiffErrorInconsistent SQLDiffErrorCategory = "inconsistent"
+
+	// SQLDiffErrorDuplicateKeys means a query returned some keys
+	// more than once, with the VerifyKeyUniqueness option, so it
+	// couldn't be diffed (a query or data problem).
+	SQLDiffErrorDuplicateKeys SQLDiffErrorCategory = "duplicate_keys"
+
+	// SQLDiffErrorIncomplete means the ErrorClassifier decided to
+	// ignore the error of a diff, which then didn't compare all
+	// the rows (retry it).
+	SQLDiffErrorIncomplete SQLDiffErrorCategory = "incomplete"
+
+	// SQLDiffErrorInterrupted means the worker was cancelled.
+	SQLDiffErrorInterrupted SQLDiffErrorCategory = "interrupted"
+
+	// SQLDiffErrorCleanUp means the run itself succeeded, but the
+	// cleanup failed.
+	SQLDiffErrorCleanUp SQLDiffErrorCategory = "cleanup"
+
+	// SQLDiffErrorOther is used for all other errors.
+	SQLDiffErrorOther SQLDiffErrorCategory = "other"
+)
+
+// sqlDiffCategorizedError is an error tagged with its category.
+type sqlDiffCategorizedError struct {
+	category SQLDiffErrorCategory
+	err      error
+}
+
+func (e *sqlDiffCategorizedError) Error() string {
+	return e.err.Error()
+}
+
+// categorize tags err with the provided category. It returns nil for
+// a nil error, and doesn't change interruptions or errors that
+// already have a category.
+func categorize(category SQLDiffErrorCategory, err error) error {
+	if err == nil || err == topo.ErrInterrupted {
+		return err
+	}
+	if _, ok := err.(*sqlDiffCategorizedError); ok {
+		return err
+	}
+	return &sqlDiffCategorizedError{
+		category: category,
+		err:      err,
+	}
+}
+
+// sqlDiffCleanUpError combines the job error of a run with the
+// cleanup error that followed it, so neither is lost. It has the
+// category of the job error.
+type sqlDiffCleanUpError struct {
+	err  error
+	cerr error
+}
+
+func (e *sqlDiffCleanUpError) Error() string {
+	return fmt.Sprintf("%v (in addition, CleanUp failed: %v)", e.err, e.cerr)
+}
+
+// jobError returns the job error of err, without the cleanup error
+// that may have followed it.
+func jobError(err error) error {
+	if e, ok := err.(*sqlDiffCleanUpError); ok {
+		return e.err
+	}
+	return err
+}
+
+// errorCategory returns the category of the provided error.
+func errorCategory(err error) SQLDiffErrorCategory {
+	switch e := err.(type) {
+	case nil:
+		return SQLDiffErrorNone
+	case *sqlDiffCategorizedError:
+		return e.category
+	case *sqlDiffCleanUpError:
+		return errorCategory(e.err)
+	}
+	if err == topo.ErrInterrupted {
+		return SQLDiffErrorInterrupted
+	}
+	return SQLDiffErrorOther
+}
+
+// sqlDiffQueryError is a MySQL error returned for the query of one
+// side.
+type sqlDiffQueryError struct {
+	side    string
+	code    int
+	message string
+}
+
+func (e *sqlDiffQueryError) Error() string {
+	return fmt.Sprintf("%v query failed with MySQL error %v: %v", e.side, e.code, e.message)
+}
+
+// mysqlErrorExtract matches the MySQL error message and code at the
+// end of the errors returned by the tablets, after their prefixes.
+var mysqlErrorExtract = regexp.MustCompile(`: ([^:]+) \(errno ([0-9]+)\)`)
+
+// newSQLDiffQueryError returns a sqlDiffQueryError if err contains a
+// MySQL error, or nil.
+func newSQLDiffQueryError(side string, err error) *sqlDiffQueryError {
+	// errors from an external MySQL source are not wrapped, and
+	// client errors (2000 and above) are connection problems
+	if sqlErr, ok := err.(*mysql.SqlError); ok {
+		if sqlErr.Number() >= 2000 {
+			return nil
+		}
+		return &sqlDiffQueryError{
+			side:    side,
+			code:    sqlErr.Number(),
+			message: sqlErr.Message,
+		}
+	}
+	match := mysqlErrorExtract.FindStringSubmatch(err.Error())
+	if match == nil {
+		return nil
+	}
+	code, convErr := strconv.Atoi(match[2])
+	if convErr != nil {
+		return nil
+	}
+	return &sqlDiffQueryError{
+		side:    side,
+		code:    code,
+		message: match[1],
+	}
+}
+
+// messageTooLargeErrors are the messages of the RPC errors returned
+// when a streamed result is larger than the transport allows.
+var messageTooLargeErrors = []string{
+	"message too large",
+	"larger than max",
+	"exceeds maximum message size",
+}
+
+// explainMessageTooLarge adds a hint to RPC errors caused by results
+// too large for the transport, which are otherwise quite opaque. Such
+// results are usually caused by rows with large BLOB or TEXT columns.
+func explainMessageTooLarge(err error) error {
+	msg := strings.ToLower(err.Error())
+	for _, tooLarge := range messageTooLargeErrors {
+		if strings.Contains(msg, tooLarge) {
+			return fmt.Errorf("%v: a streamed row is too large for the RPC transport, exclude the large BLOB/TEXT columns from the query, or raise the transport message size limit", err)
+		}
+	}
+	return err
+}
+
+// mysqlErrorCode returns the MySQL error code of the provided error,
+// or 0.
+func mysqlErrorCode(err error) int {
+	err = jobError(err)
+	if e, ok := err.(*sqlDiffCategorizedError); ok {
+		err = e.err
+	}
+	if e, ok := err.(*sqlDiffQueryError); ok {
+		return e.code
+	}
+	return 0
+}
+
+// MySQLErrorCode returns the MySQL error code of an error returned by
+// a phase of a SQLDiffWorker, as passed to its ErrorClassifier, or 0.
+func MySQLErrorCode(err error) int {
+	return mysqlErrorCode(err)
+}
+
+// Decision is what to do about the error of a SQLDiffWorker phase,
+// see ErrorClassifier.
+type Decision int
+
+const (
+	// DecisionAbort fails the run with the error.
+	DecisionAbort Decision = iota
+
+	// DecisionRetry runs the phase again, up to
+	// SQLDiffOptions.MaxRetries times.
+	DecisionRetry
+
+	// DecisionIgnore logs the error, and goes on as if the phase
+	// succeeded. A diff that failed can't be ignored, as its rows
+	// were not all compared: the run then fails with the
+	// incomplete error category.
+	DecisionIgnore
+)
+
+func (d Decision) String() string {
+	switch d {
+	case DecisionAbort:
+		return "abort"
+	case DecisionRetry:
+		return "retry"
+	case DecisionIgnore:
+		return "ignore"
+	}
+	return fmt.Sprintf("Decision(%d)", int(d))
+}
+
+// ErrorClassifier decides what to do about the RPC and query errors of
+// the synchronization and diff phases of a SQLDiffWorker. MySQLErrorCode
+// extracts the MySQL error code of the query errors. Without a
+// classifier, all errors abort the run. The errors finding the tablets
+// and cleaning up are not classified: finding the tablets is not
+// retried, and the cleanup always runs all its actions.
+type ErrorClassifier func(err error) Decision
+
 // SourceSpec specifies a SQL query in some keyspace and shard.
 type SourceSpec struct {
 	Keyspace string
 	Shard    string
-	SQL      string
+
+	// SQL is the query returning the rows to compare. It has to
+	// be a SELECT or UNION the tablets can stream, which can read
+	// from a view, or a CALL of a stored procedure returning a
+	// result set on a DSN source, if the AllowCall option is set.
+	SQL string
+
+	// Cell is the cell to pick a rdonly tablet from. If empty,
+	// the worker cell is used.
+	Cell string
+
+	// QueryTimeout, if non-zero, limits how long opening and
+	// reading the query results can take. It overrides the
+	// worker QueryTimeout option.
+	QueryTimeout time.Duration
+
+	// KeyColumns names the columns used to match rows between
+	// both sides. The query needs to be ordered by them first. If
+	// empty, the other spec KeyColumns are used, and if both are
+	// empty, the first column of each query is the key.
+	KeyColumns []string
+
+	// DSN, if set, is the address of a MySQL server that is not
+	// a Vitess tablet, to read from instead of a tablet of
+	// Keyspace/Shard. See ParseMySQLDSN for its format. No tablet is
+	// picked and no replication is stopped for that side, so the
+	// server data needs to be static during the diff, for instance
+	// a legacy database whose writes were moved to Vitess.
+	DSN string
+
+	// VTGate, if set, is the address of a vtgate to run the query
+	// through, on a VTGateTabletType tablet of Keyspace/Shard, for
+	// environments where the tablets can't be queried directly.
+	// Like with DSN, no tablet is picked and no replication is
+	// stopped for that side: vtgate picks the tablet, whose data
+	// keeps changing during the diff. RerunOnDifference helps
+	// telling replication artifacts from real differences.
+	VTGate string
+
+	// VTGateTabletType is the type of the tablets vtgate runs the
+	// query on, rdonly if empty.
+	VTGateTabletType topo.TabletType
+
+	// Snapshot, if set, is the URL of a table snapshot exported to
+	// a file or to object storage, like "file:///backups/t.json.gz",
+	// to read the rows from instead, see
+	// NewQueryResultReaderForSnapshot. SQL is the query the
+	// snapshot was exported with: it is not run, but its key
+	// columns and ordering are checked. No tablet is picked for
+	// that side, which diffs the live data of the other side
+	// against that point in time.
+	Snapshot string
+
+	// TimeZone is the session time zone the source renders its
+	// TIMESTAMP values in, as a zone database name like
+	// "America/Los_Angeles". If set on either spec, these values
+	// are converted to UTC on both sides before they are compared,
+	// so servers in different zones don't show false differences.
+	// DATETIME values are stored as written, whatever the session
+	// time zone, so they are compared as is. A spec without
+	// TimeZone is assumed to be UTC.
+	TimeZone string
+
+	// Sync is how the tablet of the spec is synchronized with the
+	// other side. It defaults to SyncStopReplication.
+	Sync SyncStrategy
+
+	// AllShards reads the query on all the shards of Keyspace, and
+	// merges their rows in key order into a single stream, instead
+	// of reading Shard. It diffs a whole keyspace against a single
+	// subset, when the query can't be restricted to the key range
+	// of a shard. It is only supported for the superset, read
+	// through VTGate or with the SyncSnapshot strategy, as
+	// replication can't be stopped on all the shards together.
+	AllShards bool
 
 	alias topo.TabletAlias
+
+	// shards and shardAliases are the shards read with AllShards,
+	// and the tablets picked in them, see alias.
+	shards       []string
+	shardAliases []topo.TabletAlias
+}
+
+// SyncStrategy is how a SQLDiffWorker synchronizes the tablet of a
+// side with the other one.
+type SyncStrategy string
+
+const (
+	// SyncStopReplication stops replication on the tablet, a few
+	// seconds after the other side, so both sides are read at
+	// about the same replication position.
+	SyncStopReplication SyncStrategy = "stop_replication"
+
+	// SyncSnapshot doesn't stop replication on the tablet: the
+	// streaming query reads a consistent snapshot of the side, as
+	// of its start, while replication goes on. It avoids stopping
+	// replication on a busy side, but that side is then ahead of
+	// the other one, which shows as differences on the rows
+	// written in between. RerunOnDifference filters them out.
+	SyncSnapshot SyncStrategy = "snapshot"
+)
+
+// hasTablet returns true if the spec reads from a tablet picked by
+// the worker, whose replication is stopped during the diff.
+func (spec SourceSpec) hasTablet() bool {
+	return spec.DSN == "" && spec.VTGate == "" && spec.Snapshot == ""
+}
+
+// stopsReplication returns true if replication is stopped on the
+// tablet of the spec during the diff.
+func (spec SourceSpec) stopsReplication() bool {
+	return spec.hasTablet() && spec.Sync != SyncSnapshot
+}
+
+// name returns the keyspace and shard of the spec, or the address of
+// the external MySQL server or snapshot, without its credentials.
+func (spec SourceSpec) name() string {
+	if spec.Snapshot != "" {
+		return "snapshot(" + redactSnapshotURL(spec.Snapshot) + ")"
+	}
+	if spec.VTGate != "" {
+		return "vtgate(" + spec.VTGate + ")/" + spec.Keyspace + "/" + spec.Shard
+	}
+	if spec.AllShards {
+		return spec.Keyspace + "/*"
+	}
+	if spec.DSN == "" {
+		return spec.Keyspace + "/" + spec.Shard
+	}
+	params, err := ParseMySQLDSN(spec.DSN)
+	if err != nil {
+		return "external MySQL"
+	}
+	if params.UnixSocket != "" {
+		return "mysql(" + params.UnixSocket + ")/" + params.DbName
+	}
+	return fmt.Sprintf("mysql(%v:%v)/%v", params.Host, params.Port, params.DbName)
+}
+
+// SQLDiffOptions contains the optional settings for a SQLDiffWorker.
+// The zero value runs the default subset check.
+type SQLDiffOptions struct {
+	// Name identifies the check in the run history. If empty,
+	// the keyspaces and shards of both specs are used.
+	Name string
+
+	// Reverse makes the worker check that every superset row
+	// exists in the subset (a coverage check), instead of
+	// checking that every subset row exists in the superset.
+	Reverse bool
+
+	// Exact makes the worker check both sides have exactly the
+	// same rows: the superset rows missing from the subset are
+	// differences too, like the subset rows missing from the
+	// superset.
+	Exact bool
+
+	// TargetSelector picks the tablets to use. If nil, a random
+	// healthy rdonly tablet is picked, as tuned by
+	// SelectionJitter, AvoidCheckers and TabletTags. It is not
+	// part of the JSON encoding of the options.
+	TargetSelector TargetSelector `json:"-"`
+
+	// SelectionJitter is the maximum random delay to wait
+	// before picking each rdonly tablet, so workers started at
+	// the same time spread their load.
+	SelectionJitter time.Duration
+
+	// AvoidCheckers makes the worker skip rdonly tablets that
+	// are already used by another worker, unless they are the
+	// only candidates.
+	AvoidCheckers bool
+
+	// IgnorePeakWindow lets the worker run during the
+	// -sqldiff_peak_window, when diffs reading from tablets are
+	// otherwise refused.
+	IgnorePeakWindow bool
+
+	// TabletTags, if set, restricts the rdonly tablets to the ones
+	// with all these tags, like purpose=analytics, to keep the
+	// diff load on the tablets designated for batch work.
+	TabletTags map[string]string
+
+	// IgnoreColumns lists the columns that are not compared,
+	// for instance generated columns that are recomputed on each
+	// server and can legitimately differ.
+	IgnoreColumns []string
+
+	// CompareColumns, if set, restricts the comparison to the
+	// listed columns (and the key columns). It is the opposite of
+	// IgnoreColumns, for queries where only a few columns are
+	// expected to be consistent.
+	CompareColumns []string
+
+	// Filter, if set, is added to the WHERE clause of the queries
+	// of both sides, so they are filtered the same way.
+	Filter SQLFilter
+
+	// ChecksumBlockSize, if set, makes the worker compare the
+	// checksums of the blocks of ChecksumBlockSize consecutive
+	// key values of both sides first, and only diff the rows of
+	// the blocks whose checksums differ, which is much faster on
+	// mostly identical tables. It requires a single integer key
+	// column, and queries listing their columns.
+	ChecksumBlockSize int64
+
+	// ChecksumOnly only checks whether both results are
+	// identical: an order independent checksum of each full
+	// result is computed as it is streamed, and only the
+	// checksums are compared, which is much cheaper than the row
+	// diff. The rows that differ are not reported, the diff
+	// fails with the differences category if the checksums
+	// don't match. The raw values are checksummed, so it can't
+	// be used with the options normalizing them.
+	ChecksumOnly bool
+
+	// MaterializeSuperset, if set, copies the rows of the superset
+	// query into a scratch table on its tablet first, and diffs
+	// against that table, so the superset read doesn't keep a
+	// transaction open on a busy tablet for the whole diff. The
+	// table is dropped once the diff is done. The superset query
+	// needs to be ordered by columns it returns.
+	MaterializeSuperset bool
+
+	// VerifyKeyUniqueness, if set, checks that no key is returned
+	// twice by either query before diffing them, with a
+	// GROUP BY ... HAVING COUNT(*) > 1 version of the queries. The
+	// diff assumes the keys are unique, and matches the rows of a
+	// duplicate key arbitrarily otherwise, as a composite key with
+	// missing columns or a bad join can cause. The run fails with
+	// the duplicate keys found, if any.
+	VerifyKeyUniqueness bool
+
+	// CountAssertion, if set, is checked against the number of
+	// rows read from each side by the diff, which fails if it
+	// doesn't hold. It is not checked with KeySet.
+	CountAssertion CountAssertion
+
+	// KeySet, if set, restricts the diff to the rows whose key is
+	// in the set (see RowKey for the format). It is meant for
+	// targeted re-checks of a list of keys too large to inline
+	// in the queries.
+	KeySet map[string]bool
+
+	// Delta makes the check only diff the rows whose key is above
+	// the high-water key of its last clean run, for append-mostly
+	// tables. The high-water keys are kept per HistoryKey, in
+	// memory. The queries need a single key column, their first
+	// ORDER BY column, which is used in the WHERE clause added to
+	// both queries. Without a high-water key, the run is a full
+	// diff, which records one if it is clean. The keys are
+	// compared in the order of that column, as the rows are sorted.
+	Delta bool
+
+	// DeltaFullEvery, if non-zero with Delta, makes every
+	// DeltaFullEvery-th run a full diff, to catch the changes to
+	// the rows below the high-water key.
+	DeltaFullEvery int
+
+	// SamplePercent, if non-zero, only compares a deterministic
+	// pseudo-random sample of that percentage of the rows, for
+	// cheap periodic checks between full diffs.
+	SamplePercent float64
+
+	// CheckSameCell warns if the superset and subset tablets
+	// are in different cells, as the diff will then be slow
+	// and expensive.
+	CheckSameCell bool
+
+	// StrictSameCell makes the cell check fail the run instead
+	// of just warning. It implies CheckSameCell.
+	StrictSameCell bool
+
+	// Canonicalizer, if set, is applied to every value on both
+	// sides before comparing them, to normalize representation
+	// differences between the main and lookup tables. It is not
+	// part of the JSON encoding of the options.
+	Canonicalizer Canonicalizer `json:"-"`
+
+	// Transforms maps superset column names to a function
+	// returning the value expected in the subset, for lookup
+	// columns storing a derived value (a hash, a slug...). It can
+	// also be done with a SQL expression in the superset query. It
+	// is not part of the JSON encoding of the options.
+	Transforms map[string]Transform `json:"-"`
+
+	// Partitioner, if set, maps the rows found different to a
+	// partition label, like their tenant. The partitions with the
+	// most differences are then shown in the report and status,
+	// to spot differences clustering in a partition. It is not
+	// part of the JSON config.
+	Partitioner Partitioner `json:"-"`
+
+	// OnDifference, if set, is called with each difference found,
+	// from both sides' point of view: in reverse mode, the rows
+	// missing from the subset are DifferenceMissingInSubset. With
+	// RerunOnDifference, it is also called for the re-run. It is
+	// not part of the JSON config.
+	OnDifference func(DifferenceRecord) `json:"-"`
+
+	// ReviewQueries, if set, is called with the final queries of
+	// both sides once the tablets are picked, before replication
+	// is stopped, as returned by PlannedQueries. It returns the
+	// queries to run, which can be edited but still need to pass
+	// the read-only checks, or an error to abort the run. It is
+	// not part of the JSON config.
+	ReviewQueries func(superset, subset string) (string, string, error) `json:"-"`
+
+	// DifferenceSink, if set, is published each difference found,
+	// like OnDifference, from a separate goroutine, and flushed at
+	// the end of the diff. If it fails, the check fails. It is not
+	// part of the JSON config.
+	DifferenceSink DifferenceSink `json:"-"`
+
+	// DifferenceSinkBuffer is the number of differences buffered
+	// for the DifferenceSink: when it is full, the diff waits for
+	// the sink to catch up. Defaults to 1000.
+	DifferenceSinkBuffer int
+
+	// ErrorClassifier, if set, decides if the RPC and query errors
+	// of the synchronization and diff phases abort the run, make
+	// it retry the phase, or are ignored. Only the synchronization
+	// errors can be ignored, an ignored diff error fails the run
+	// as incomplete. A retried diff may call OnDifference and
+	// DifferenceSink again for the same rows. It is not part of
+	// the JSON config.
+	ErrorClassifier ErrorClassifier `json:"-"`
+
+	// MaxRetries is the number of times a phase can be retried, as
+	// decided by the ErrorClassifier. Defaults to 3.
+	MaxRetries int
+
+	// RetryDelay is how long to wait before retrying a phase.
+	RetryDelay time.Duration
+
+	// KeyFunc, if set, extracts the keys the rows are matched by,
+	// instead of using the key columns, for queries whose key is
+	// not made of leading columns. The queries need to be ordered
+	// by that key, in byte order. See RowSubsetDiffer.SetKeyFunc.
+	// It is not part of the JSON config.
+	KeyFunc KeyFunc `json:"-"`
+
+	// Tolerances maps DECIMAL, FLOAT or DOUBLE column names to
+	// the tolerance within which their values are considered
+	// equal, to ignore rounding differences between servers.
+	Tolerances map[string]Tolerance
+
+	// JSONColumns names the columns holding JSON documents, which
+	// are compared by semantic equality: documents serialized
+	// with a different key order or whitespace are equal.
+	JSONColumns []string
+
+	// HashColumns names large BLOB or binary columns that are
+	// compared by their SHA2 hash, computed by MySQL, instead of
+	// their bytes: the queries select SHA2(column, 256) in their
+	// place, which saves transferring and buffering the values.
+	// The columns need to be selected by name, and can't be keys.
+	HashColumns []string
+
+	// ReselectOnUnhealthy watches the health of the tablets during
+	// the diff. If one becomes unhealthy, the diff is stopped, a
+	// new tablet is picked in its place, replication is
+	// synchronized again, and the diff resumes after the last key
+	// compared. A run only replaces up to maxReselections tablets.
+	// It requires a single key column, and can't be used with
+	// the options needing the full diff in a single pass.
+	ReselectOnUnhealthy bool
+
+	// MaxBufferBytes, if non-zero, limits how many bytes of
+	// results both sides can buffer together, so diffs of very
+	// wide tables don't run out of memory: a result going over the
+	// limit is spilled to SpillDir, or fails the diff cleanly.
+	MaxBufferBytes int64
+
+	// SpillDir, if set with MaxBufferBytes, is the directory the
+	// results going over the limit are spilled to, as gzipped
+	// temporary files, instead of failing the diff.
+	SpillDir string
+
+	// MaxLookahead, if non-zero, makes each side read its rows
+	// ahead of the comparison in the background, with at most that
+	// many rows waiting: the stream of a side faster than the other
+	// one is then held back. See NewLookaheadQueryResultReader.
+	MaxLookahead int
+
+	// MaxRows, if non-zero, makes the diff fail if either side
+	// returns more rows, to protect against accidental full table
+	// diffs. Larger tables should be diffed by key range windows.
+	MaxRows int
+
+	// QueryTimeout, if non-zero, is the default limit for opening
+	// and reading each side's query results. SourceSpec can
+	// override it.
+	QueryTimeout time.Duration
+
+	// SQLMode, if set, is the sql_mode both sides are read with,
+	// like "NO_ZERO_DATE,PAD_CHAR_TO_FULL_LENGTH", as it changes
+	// how some values are rendered. The sessions of the external
+	// MySQL servers are set to it. The ones of the tablets and
+	// vtgates can't be, the worker checks their sql_mode is the
+	// same instead. The individual modes need to be listed, as
+	// MySQL reports them, not combination modes like TRADITIONAL.
+	SQLMode string
+
+	// AllowCall allows the queries of the DSN sources to be a CALL
+	// of a stored procedure returning a result set. It is an
+	// explicit opt-in, as the worker can't check the procedure is
+	// read-only. The tablets, and the vtgates, only stream SELECTs,
+	// so it doesn't apply to them.
+	AllowCall bool
+
+	// SettleDelay is how long the worker waits after marking the
+	// tablets as checkers, before stopping their replication. It
+	// gives the type change time to reach the serving graph, so
+	// the tablets are not still transitioning when replication
+	// is stopped. Zero doesn't wait.
+	SettleDelay time.Duration
+
+	// CleanUpDeadline, if non-zero, caps how long the cleanup can
+	// take. Cleanup actions still running then, for instance on a
+	// tablet that became unreachable, are abandoned: their tablets
+	// are logged and listed in the status, so they can be fixed
+	// manually, and the worker reaches its error state.
+	CleanUpDeadline time.Duration
+
+	// StopPosition, if set, makes the worker stop replication on
+	// both slaves once they reach that position, instead of
+	// stopping them a few seconds apart. It is meant for keyspaces
+	// replicating from the same upstream, to compare them close to
+	// the same logical point: a slave is stopped at or shortly after
+	// the position, as it keeps replicating until the stop takes
+	// effect, and the position it stopped at is logged. A slave
+	// already past the position can't go back to it, and fails the
+	// run.
+	StopPosition myproto.ReplicationPosition
+
+	// StopPositionWaitTime is how long each slave is waited for to
+	// reach StopPosition, or with FilteredReplication the position
+	// of the other side. Zero waits 30 seconds.
+	StopPositionWaitTime time.Duration
+
+	// FilteredReplication makes the worker stop both slaves at the
+	// same point of the filtered replication from the superset shard
+	// to the subset shard, like the SplitDiffWorker does, instead of
+	// stopping them a few seconds apart. The subset shard master
+	// pauses filtered replication while the slaves are stopped. It
+	// is set by ReshardingOverlapConfig, see
+	// synchronizeFilteredReplication.
+	FilteredReplication bool
+
+	// AtomicStop makes stopping replication on both slaves all or
+	// nothing: if it fails on either of them, replication is
+	// restarted right away where it was stopped, instead of by the
+	// final cleanup, and the run fails without diffing.
+	AtomicStop bool
+
+	// CompensateLag, if non-zero, makes the worker compare the
+	// replication positions of both slaves once stopped: if the
+	// subset slave is behind the superset slave, it is restarted
+	// until it reaches the superset position, for up to
+	// CompensateLag. If it can't catch up in time, the diff still
+	// runs, and the positions are reported as a caveat, as the
+	// rows missing from the subset may then be replication lag.
+	CompensateLag time.Duration
+
+	// StrictConsistency makes the worker check the replication
+	// position of the tablets doesn't move while they are read,
+	// as it would if StopSlave didn't fully take effect. The run
+	// then fails instead of reporting differences that may be
+	// artifacts of data changing under the readers. The tablets
+	// read with SyncSnapshot are not checked.
+	StrictConsistency bool
+
+	// VerifyChecksum adds a defense in depth check to the diff: the
+	// keys of both sides need to be in ascending order, and if no
+	// difference is found, the subset keys need to be within the
+	// superset key range. Checksums of the keys of both sides are
+	// logged with the report. A failed check ends the run with the
+	// inconsistent error category.
+	VerifyChecksum bool
+
+	// SameTablet runs both queries on the same rdonly tablet,
+	// found in the superset shard, to check invariants between
+	// tables of a shard. Both specs need to be in the same shard.
+	// There is then no replication to synchronize between
+	// tablets, it is just stopped on the tablet.
+	SameTablet bool
+
+	// SameTabletAlias, with SameTablet, is the rdonly tablet of
+	// the superset shard both queries run on, instead of a tablet
+	// picked by the TargetSelector.
+	SameTabletAlias topo.TabletAlias
+
+	// QueryEquivalence frames the diff as a query equivalence
+	// test: the superset query is the reference, and the subset
+	// query a candidate that needs to return exactly the same
+	// rows, like a rewrite of it. It requires the SameTablet and
+	// Exact options. See QueryEquivalenceConfig.
+	QueryEquivalence bool
+
+	// CheckKeyCollation makes the worker check that the key
+	// columns have the same collation on both sides, as the
+	// diff relies on both sides being sorted the same way. The
+	// queries need to be simple SELECTs from a single table.
+	CheckKeyCollation bool
+
+	// CheckSchema makes the worker compare the schema of the
+	// queried tables on both tablets before the diff, and record
+	// the columns added, removed or with a different type. The
+	// drift is shown in the status, as data differences may be a
+	// consequence of it. The queries need to be simple SELECTs
+	// from a single table. Sides without a tablet are not checked.
+	CheckSchema bool
+
+	// ForceBinaryKeySort rewrites the queries to ORDER BY
+	// BINARY(column) for the key columns the differ compares as
+	// bytes, like strings, so both sides are sorted in the byte
+	// order the differ expects, whatever their collations. The
+	// integer and floating point keys keep their numeric order.
+	// The key column types are read from the tablets, once
+	// picked. It makes CheckKeyCollation unnecessary.
+	ForceBinaryKeySort bool
+
+	// KeysOnly rewrites the queries to only select their key
+	// columns, and only compares the presence of the keys on both
+	// sides: only missing and extra keys are reported, never
+	// mismatched rows. It is much cheaper than a full row diff
+	// when only the set of keys matters. The queries need to be
+	// simple SELECTs ordered by their key columns.
+	KeysOnly bool
+
+	// Aggregate compares GROUP BY queries, like
+	// "SELECT user_id, COUNT(*) FROM t GROUP BY user_id", to check
+	// summary tables. The grouping columns are the keys, unless
+	// KeyColumns are set, and the queries are ordered by them if
+	// they have no ORDER BY. The groups whose aggregates differ
+	// are reported as mismatched rows.
+	Aggregate bool
+
+	// RerunOnDifference makes the worker confirm the differences
+	// it finds: replication is restarted and synchronized again,
+	// and the diff is re-run on the rows found different. Only the
+	// differences found in both runs are reported, to filter out
+	// artifacts of the approximate replication synchronization.
+	RerunOnDifference bool
+
+	// NewQueryResultReader creates the readers for the queries.
+	// If nil, NewQueryResultReaderForTablet is used. It is a seam
+	// to inject faults and latency in tests. Likewise, the tablet
+	// RPCs can be intercepted by the wrangler TabletManagerClient.
+	NewQueryResultReader QueryResultReaderFactory `json:"-"`
+
+	// LowPriority streams the rows of each query at most at
+	// -low_priority_rows_per_second, to leave the tablets and MySQL
+	// servers room for serving. The tablets have no lower priority
+	// stream pool, so the worker reads slower instead.
+	LowPriority bool
+
+	// StatusStore, if set, is saved the status of the check while
+	// it runs, and when it's done, so the last known status can be
+	// shown after a restart. It is not part of the JSON config.
+	StatusStore StatusStore `json:"-"`
+
+	// StatusSaveInterval is the minimum time between two saves of
+	// the status of the running check. Defaults to 30s.
+	StatusSaveInterval time.Duration
+
+	// RPCLimiter, if set, bounds the RPCs the worker has in flight
+	// to the topology server, the tablets and the external sources:
+	// a slot is acquired before each of them, and released after.
+	// It is meant to be shared by many workers run together, to
+	// bound their combined load on the cluster, whatever their
+	// number. It is not part of the JSON config.
+	RPCLimiter *sync2.Semaphore `json:"-"`
+}
+
+// SQLFilter is a predicate restricting the rows of both sides of a
+// SQLDiffWorker, like "created < :cutoff". The values of its bind
+// variables are encoded in the queries as SQL literals, as the
+// tablets do, so they can't alter the queries.
+type SQLFilter struct {
+	Predicate string
+	BindVars  map[string]interface{}
+}
+
+// SQLDiffConfig captures all the inputs of a SQLDiffWorker, so a run
+// can be reproduced with NewSQLDiffWorkerFromConfig. It can be encoded
+// in JSON, without the options that are code (TargetSelector,
+// Canonicalizer, Transforms, Partitioner, OnDifference,
+// DifferenceSink, ErrorClassifier, KeyFunc, NewQueryResultReader and
+// StatusStore).
+type SQLDiffConfig struct {
+	Cell     string
+	Superset SourceSpec
+	Subset   SourceSpec
+	Options  SQLDiffOptions
+}
+
+// NewSQLDiffWorkerFromConfig returns a new SQLDiffWorker object
+// running with the provided configuration.
+func NewSQLDiffWorkerFromConfig(wr *wrangler.Wrangler, config SQLDiffConfig) Worker {
+	return NewSQLDiffWorker(wr, config.Cell, config.Superset, config.Subset, config.Options)
 }
 
 // SQLDiffWorker runs a sanity check in in a system with a lookup
@@ -51,16 +908,19 @@ type SourceSpec struct {
 // the superset spec.
 type SQLDiffWorker struct {
 	wr        *wrangler.Wrangler
+	runID     string
 	cell      string
 	shard     string
 	cleaner   *wrangler.Cleaner
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
-	// alias in the following 2 fields is during
-	// SQLDifferFindTargets, read-only after that.
+	// alias in the following 2 fields is written under the mutex
+	// during SQLDifferFindTargets, read-only after that. Other
+	// goroutines read it with SupersetAlias and SubsetAlias.
 	superset SourceSpec
 	subset   SourceSpec
+	options  SQLDiffOptions
 
 	// all subsequent fields are protected by the mutex
 	mu    sync.Mutex
@@ -68,130 +928,1964 @@ type SQLDiffWorker struct {
 
 	// populated if state == SQLDiffError
 	err error
+
+	// populated during sqlDiffCleanUp
+	restoringCount  int
+	cleanUpFailures []string
+
+	// populated once the diff ran
+	counts        sqlDiffCounts
+	partitions    []PartitionCount
+	schemaDrift   []string
+	processedRows int
+
+	// confirmedRows is the number of rows processed by the
+	// RerunOnDifference confirmation diff, not in processedRows.
+	confirmedRows int
+
+	// supersetBytesRead and subsetBytesRead are the bytes read
+	// from each side, by all the diffs, including failed ones.
+	supersetBytesRead int64
+	subsetBytesRead   int64
+
+	// deltaAfter is the high-water key the queries were scoped
+	// above, for a delta run, and highWaterKey the one recorded by
+	// a clean run, see the Delta option.
+	deltaAfter   sqltypes.Value
+	highWaterKey sqltypes.Value
+
+	// lagCaveat is set if CompensateLag couldn't make the subset
+	// slave catch up with the superset slave.
+	lagCaveat string
+
+	// countAssertion is the outcome of the CountAssertion, once
+	// checked.
+	countAssertion string
+
+	// checksumBlocks and mismatchedBlocks count the blocks compared
+	// by checksum, and the ones whose rows were diffed, see the
+	// ChecksumBlockSize option.
+	checksumBlocks   int
+	mismatchedBlocks int
+
+	// checksumVerdict describes the result checksums of both
+	// sides, see the ChecksumOnly option.
+	checksumVerdict string
+
+	// sqlMode is the sql_mode both sides are read with, once
+	// checked, see the SQLMode option.
+	sqlMode string
+
+	// jsonNormalized counts the JSON values found equal only
+	// semantically, see the JSONColumns option.
+	jsonNormalized int
+
+	// timeline has the states the worker went through, see
+	// StateTimeline.
+	timeline []StateTransition
+
+	// diffCtx, if set, is the context of the diff, which can be
+	// interrupted alone, see the ReselectOnUnhealthy option. The
+	// differences found by the interrupted diffs are carried over
+	// to the resumed one, and resumables, if set, open the readers
+	// of both sides, by side name, where the diff resumes.
+	diffCtx    context.Context
+	carried    sqlDiffCounts
+	resumables map[string]*ResumableReader
+	// reselections are the tablets replaced as they became
+	// unhealthy during the diff.
+	reselections []string
+
+	// hashedColumns are the columns compared by hash, once the
+	// queries are rewritten, see the HashColumns option.
+	hashedColumns []string
+
+	// plannedSuperset and plannedSubset are the queries of both
+	// sides, once the tablets are picked, see PlannedQueries.
+	plannedSuperset string
+	plannedSubset   string
+
+	// materializations counts the tables the superset was
+	// materialized in, see the MaterializeSuperset option.
+	materializations int
+
+	// interruption describes the phase and progress of the run
+	// when it was cancelled or timed out, see noteInterruption.
+	// interruptedRows is the number of rows processed by the diff
+	// when it was interrupted.
+	interruption    string
+	interruptedRows int
+
+	// populated by Run
+	startTime time.Time
+	endTime   time.Time
+
+	// confirming is set while the differences are re-checked,
+	// see RerunOnDifference.
+	confirming bool
+}
+
+// sqlDiffCounts splits the differences found by kind: rows missing
+// from one side usually mean lost replication events, while rows
+// present on both sides with different values mean corrupt data.
+type sqlDiffCounts struct {
+	missingInSuperset int
+	missingInSubset   int
+	valueMismatch     int
+}
+
+// sqlDiffTopPartitions is the number of partitions shown in the status.
+const sqlDiffTopPartitions = 10
+
+// newSQLDiffCounts maps the report of a differ run in the provided
+// direction to the superset and subset sides. The differ superset
+// side is the worker subset in reverse mode.
+func newSQLDiffCounts(report DiffSummary, reverse bool) sqlDiffCounts {
+	counts := sqlDiffCounts{
+		valueMismatch:     report.MismatchedRows(),
+		missingInSuperset: report.MissingInSuperset(),
+		missingInSubset:   report.MissingInSubset(),
+	}
+	if reverse {
+		counts.missingInSuperset, counts.missingInSubset = counts.missingInSubset, counts.missingInSuperset
+	}
+	return counts
+}
+
+// add returns the sum of both counts.
+func (counts sqlDiffCounts) add(other sqlDiffCounts) sqlDiffCounts {
+	return sqlDiffCounts{
+		missingInSuperset: counts.missingInSuperset + other.missingInSuperset,
+		missingInSubset:   counts.missingInSubset + other.missingInSubset,
+		valueMismatch:     counts.valueMismatch + other.valueMismatch,
+	}
+}
+
+func (counts sqlDiffCounts) String() string {
+	return fmt.Sprintf("%v missing in superset, %v missing in subset, %v with different values", counts.missingInSuperset, counts.missingInSubset, counts.valueMismatch)
 }
 
-// NewSQLDiffWorker returns a new SQLDiffWorker object.
-func NewSQLDiffWorker(wr *wrangler.Wrangler, cell string, superset, subset SourceSpec) Worker {
+// NewSQLDiffWorker returns a new SQLDiffWorker object. The worker is
+// registered while its Run runs, see CancelAllForKeyspace.
+func NewSQLDiffWorker(wr *wrangler.Wrangler, cell string, superset, subset SourceSpec, options SQLDiffOptions) Worker {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &SQLDiffWorker{
-		wr:        wr,
+	runID := newSQLDiffRunID()
+	worker := &SQLDiffWorker{
+		// all the logs of this worker are prefixed by the run ID
+		wr:        wrangler.New(logutil.NewPrefixLogger("["+runID+"] ", wr.Logger()), wr.TopoServer(), wr.TabletManagerClient(), wr.LockTimeout()),
+		runID:     runID,
 		cell:      cell,
 		superset:  superset,
 		subset:    subset,
+		options:   options,
 		cleaner:   new(wrangler.Cleaner),
 		ctx:       ctx,
 		ctxCancel: cancel,
 
 		state: sqlDiffNotSarted,
 	}
+	return worker
 }
 
-func (worker *SQLDiffWorker) setState(state sqlDiffWorkerState) {
-	worker.mu.Lock()
-	worker.state = state
-	worker.mu.Unlock()
+// Config returns the configuration of the worker. The passwords of the
+// DSNs are redacted, they need to be set again to replay the config.
+func (worker *SQLDiffWorker) Config() SQLDiffConfig {
+	config := SQLDiffConfig{
+		Cell:     worker.cell,
+		Superset: worker.superset,
+		Subset:   worker.subset,
+		Options:  worker.options,
+	}
+	config.Superset.DSN = redactDSN(config.Superset.DSN)
+	config.Subset.DSN = redactDSN(config.Subset.DSN)
+	config.Superset.alias = topo.TabletAlias{}
+	config.Subset.alias = topo.TabletAlias{}
+	config.Superset.shards, config.Superset.shardAliases = nil, nil
+	config.Subset.shards, config.Subset.shardAliases = nil, nil
+	return config
 }
 
-func (worker *SQLDiffWorker) recordError(err error) {
-	worker.mu.Lock()
-	defer worker.mu.Unlock()
-
-	worker.state = sqlDiffError
-	worker.err = err
+// redactDSN returns the DSN with its password redacted.
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil {
+		return dsn
+	}
+	if _, ok := u.User.Password(); !ok {
+		return dsn
+	}
+	u.User = url.UserPassword(u.User.Username(), mysql.RedactedPassword)
+	return u.String()
 }
 
-// StatusAsHTML is part of the Worker interface
-func (worker *SQLDiffWorker) StatusAsHTML() template.HTML {
-	worker.mu.Lock()
-	defer worker.mu.Unlock()
+// direction returns a human readable description of the inclusion
+// this worker is checking.
+func (worker *SQLDiffWorker) direction() string {
+	if worker.options.QueryEquivalence {
+		return "query equivalence on " + worker.superset.name() + ": the candidate query returns exactly the rows of the reference query"
+	}
+	if worker.options.Exact {
+		return "subset " + worker.subset.name() + " has the same rows as superset " + worker.superset.name()
+	}
+	if worker.options.Reverse {
+		return "superset " + worker.superset.name() + " is included in subset " + worker.subset.name()
+	}
+	return "subset " + worker.subset.name() + " is included in superset " + worker.superset.name()
+}
 
-	result := "<b>Working on:</b> " + worker.subset.Keyspace + "/" + worker.subset.Shard + "</br>\n"
-	result += "<b>State:</b> " + worker.state.String() + "</br>\n"
-	switch worker.state {
-	case sqlDiffError:
-		result += "<b>Error</b>: " + worker.err.Error() + "</br>\n"
-	case sqlDiffRunning:
-		result += "<b>Running...</b></br>\n"
-	case sqlDiffDone:
-		result += "<b>Success.</b></br>\n"
+// HistoryKey returns the key of the history of this check: the Name
+// option, or the checked keyspaces and shards. See History.
+func (worker *SQLDiffWorker) HistoryKey() string {
+	if worker.options.Name != "" {
+		return worker.options.Name
 	}
+	return worker.superset.name() + " " + worker.subset.name()
+}
 
-	return template.HTML(result)
+// newSQLDiffRunID returns a new unique ID for a SQLDiffWorker run.
+func newSQLDiffRunID() string {
+	return fmt.Sprintf("sqldiff-%v-%08x", time.Now().Format("20060102-150405"), rand.Uint32())
 }
 
-// StatusAsText is part of the Worker interface
-func (worker *SQLDiffWorker) StatusAsText() string {
-	worker.mu.Lock()
-	defer worker.mu.Unlock()
+// RunID returns the unique ID of this worker run. All the worker log
+// lines are prefixed with it.
+func (worker *SQLDiffWorker) RunID() string {
+	return worker.runID
+}
 
-	result := "Working on: " + worker.subset.Keyspace + "/" + worker.subset.Shard + "\n"
-	result += "State: " + worker.state.String() + "\n"
-	switch worker.state {
-	case sqlDiffError:
-		result += "Error: " + worker.err.Error() + "\n"
-	case sqlDiffRunning:
-		result += "Running...\n"
-	case sqlDiffDone:
-		result += "Success.\n"
+// SQLDiffStatus is a machine-readable snapshot of the status of a
+// SQLDiffWorker.
+type SQLDiffStatus struct {
+	RunID         string
+	State         string
+	Error         string
+	ErrorCategory SQLDiffErrorCategory
+
+	// CleanUpError is set if the cleanup failed, even if the job
+	// failed first: replication may then still be stopped on some
+	// tablets.
+	CleanUpError string
+
+	// MySQLErrorCode is set if MySQL rejected one of the queries.
+	MySQLErrorCode int
+
+	// MissingInSuperset, MissingInSubset and ValueMismatch count
+	// the rows found missing from one side, or present on both
+	// sides with different values.
+	MissingInSuperset int
+	MissingInSubset   int
+	ValueMismatch     int
+
+	// Confirming is true while the differences found are being
+	// confirmed by a re-run, see SQLDiffOptions.RerunOnDifference.
+	Confirming bool
+
+	// TopPartitions are the partitions with the most differences,
+	// if SQLDiffOptions.Partitioner is set.
+	TopPartitions []PartitionCount
+
+	// SchemaDrift lists the column differences between the queried
+	// tables, if SQLDiffOptions.CheckSchema is set.
+	SchemaDrift []string
+
+	// CountAssertion is the outcome of
+	// SQLDiffOptions.CountAssertion, once checked.
+	CountAssertion string
+
+	// ChecksumBlocks and MismatchedBlocks count the blocks compared
+	// by checksum, and the ones whose rows were diffed, see
+	// SQLDiffOptions.ChecksumBlockSize.
+	ChecksumBlocks   int
+	MismatchedBlocks int
+
+	// ChecksumVerdict describes the result checksums of both
+	// sides, see SQLDiffOptions.ChecksumOnly.
+	ChecksumVerdict string
+
+	// SQLMode is the sql_mode both sides were read with, see
+	// SQLDiffOptions.SQLMode.
+	SQLMode string
+
+	// JSONNormalized counts the values of the
+	// SQLDiffOptions.JSONColumns that were different bytes, but the
+	// same JSON document.
+	JSONNormalized int
+
+	// Timeline has the states the run went through, with when they
+	// were entered, how long they lasted and what triggered them.
+	Timeline []StateTransition
+
+	// HashedColumns are the columns compared by their hash, see
+	// SQLDiffOptions.HashColumns.
+	HashedColumns []string
+
+	// Reselections describe the tablets replaced during the diff
+	// as they became unhealthy, see
+	// SQLDiffOptions.ReselectOnUnhealthy.
+	Reselections []string
+
+	// Interruption is set if the run was cancelled or timed out,
+	// to the phase and progress it was interrupted at, like
+	// "cancelled while running the diff after 3.1M rows". It is
+	// also added to Error.
+	Interruption string
+
+	// LagCaveat is set if SQLDiffOptions.CompensateLag couldn't
+	// make the subset slave catch up with the superset slave, with
+	// their positions.
+	LagCaveat string
+
+	// ProcessedRows is the number of rows processed by the diff.
+	ProcessedRows int
+
+	// ConfirmedRows is the number of rows processed again by the
+	// RerunOnDifference confirmation diff.
+	ConfirmedRows int
+
+	// SupersetBytesRead and SubsetBytesRead are the bytes of the
+	// values read from each side, see QueryResultReader.BytesRead.
+	SupersetBytesRead int64
+	SubsetBytesRead   int64
+
+	// DeltaAfter is set for a delta run, to the high-water key
+	// the diff started after. HighWaterKey is the high-water key
+	// recorded by the run, if it was clean. See
+	// SQLDiffOptions.Delta.
+	DeltaAfter   string
+	HighWaterKey string
+
+	// Duration is how long the worker ran, or has been running.
+	Duration time.Duration
+}
+
+// GetStatus returns the current status of the worker.
+func (worker *SQLDiffWorker) GetStatus() SQLDiffStatus {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	status := SQLDiffStatus{
+		RunID:          worker.runID,
+		State:          worker.state.String(),
+		ErrorCategory:  errorCategory(worker.err),
+		MySQLErrorCode: mysqlErrorCode(worker.err),
+
+		MissingInSuperset: worker.counts.missingInSuperset,
+		MissingInSubset:   worker.counts.missingInSubset,
+		ValueMismatch:     worker.counts.valueMismatch,
+		TopPartitions:     worker.partitions,
+		SchemaDrift:       worker.schemaDrift,
+		LagCaveat:         worker.lagCaveat,
+		CountAssertion:    worker.countAssertion,
+		ChecksumBlocks:    worker.checksumBlocks,
+		MismatchedBlocks:  worker.mismatchedBlocks,
+		ChecksumVerdict:   worker.checksumVerdict,
+		SQLMode:           worker.sqlMode,
+		JSONNormalized:    worker.jsonNormalized,
+		HashedColumns:     worker.hashedColumns,
+		Reselections:      worker.reselections,
+		Timeline:          worker.stateTimeline(),
+		Interruption:      worker.interruption,
+		Confirming:        worker.confirming,
+		ProcessedRows:     worker.processedRows,
+		ConfirmedRows:     worker.confirmedRows,
+		SupersetBytesRead: worker.supersetBytesRead,
+		SubsetBytesRead:   worker.subsetBytesRead,
+	}
+	if !worker.deltaAfter.IsNull() {
+		status.DeltaAfter = worker.deltaAfter.String()
+	}
+	if !worker.highWaterKey.IsNull() {
+		status.HighWaterKey = worker.highWaterKey.String()
+	}
+	switch {
+	case !worker.endTime.IsZero():
+		status.Duration = worker.endTime.Sub(worker.startTime)
+	case !worker.startTime.IsZero():
+		status.Duration = time.Now().Sub(worker.startTime)
+	}
+	if worker.err != nil {
+		status.Error = worker.err.Error()
+	}
+	if worker.interruption != "" {
+		status.Error += " (" + worker.interruption + ")"
+	}
+	switch e := worker.err.(type) {
+	case *sqlDiffCleanUpError:
+		status.CleanUpError = e.cerr.Error()
+	case *sqlDiffCategorizedError:
+		if e.category == SQLDiffErrorCleanUp {
+			status.CleanUpError = e.err.Error()
+		}
+	}
+	return status
+}
+
+// setState moves the worker to a new state, recording the transition
+// and what triggered it in the timeline, see StateTimeline.
+func (worker *SQLDiffWorker) setState(state sqlDiffWorkerState, trigger string) {
+	worker.mu.Lock()
+	worker.transition(state, trigger)
+	worker.mu.Unlock()
+}
+
+// recordError records the terminal error of the worker. A
+// cancellation is recorded as the sqlDiffCancelled state, so it
+// isn't mistaken for a failure.
+func (worker *SQLDiffWorker) recordError(err error) {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	worker.noteInterruption(err)
+	trigger := err.Error()
+	if worker.interruption != "" {
+		trigger = worker.interruption
+	}
+	if jobError(err) == topo.ErrInterrupted {
+		worker.transition(sqlDiffCancelled, trigger)
+	} else {
+		worker.transition(sqlDiffError, trigger)
+	}
+	worker.err = err
+}
+
+// StatusAsHTML is part of the Worker interface
+func (worker *SQLDiffWorker) StatusAsHTML() template.HTML {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	result := "<b>Working on:</b> " + worker.subset.name() + "</br>\n"
+	result += "<b>Run ID:</b> " + worker.runID + "</br>\n"
+	result += "<b>Checking:</b> " + worker.direction() + "</br>\n"
+	result += "<b>State:</b> " + worker.state.String() + "</br>\n"
+	if worker.confirming {
+		result += "<b>Confirmation re-run in progress</b></br>\n"
+	}
+	switch worker.state {
+	case sqlDiffError:
+		result += "<b>Error</b>: " + worker.err.Error() + "</br>\n"
+		if worker.interruption != "" {
+			result += "<b>Interrupted</b>: " + template.HTMLEscapeString(worker.interruption) + "</br>\n"
+		}
+		if errorCategory(worker.err) == SQLDiffErrorDifferences {
+			result += "<b>Differences</b>: " + worker.counts.String() + "</br>\n"
+			if len(worker.partitions) > 0 {
+				result += "<b>Top partitions</b>: " + formatPartitions(worker.partitions) + "</br>\n"
+			}
+		}
+	case sqlDiffCancelled:
+		result += "<b>Cancelled</b>"
+		if worker.interruption != "" {
+			result += ": " + template.HTMLEscapeString(worker.interruption)
+		}
+		result += "</br>\n"
+	case sqlDiffRunning:
+		result += "<b>Running...</b></br>\n"
+	case sqlDiffCleanUp:
+		result += fmt.Sprintf("<b>Restoring replication on %v tablets...</b></br>\n", worker.restoringCount)
+	case sqlDiffDone:
+		result += "<b>Success.</b></br>\n"
+	}
+	if !worker.deltaAfter.IsNull() {
+		result += "<b>Delta run:</b> keys above " + template.HTMLEscapeString(worker.deltaAfter.String()) + "</br>\n"
+	}
+	if !worker.highWaterKey.IsNull() {
+		result += "<b>High-water key:</b> " + template.HTMLEscapeString(worker.highWaterKey.String()) + "</br>\n"
+	}
+	if worker.supersetBytesRead > 0 || worker.subsetBytesRead > 0 {
+		result += fmt.Sprintf("<b>Bytes read:</b> %v from superset, %v from subset</br>\n", worker.supersetBytesRead, worker.subsetBytesRead)
+	}
+	if len(worker.schemaDrift) > 0 {
+		result += "<b>Schema drift:</b> " + template.HTMLEscapeString(strings.Join(worker.schemaDrift, "; ")) + " (data differences may be a consequence)</br>\n"
+	}
+	if worker.lagCaveat != "" {
+		result += "<b>Replication lag:</b> " + template.HTMLEscapeString(worker.lagCaveat) + "</br>\n"
+	}
+	if worker.countAssertion != "" {
+		result += "<b>Count assertion:</b> " + template.HTMLEscapeString(worker.countAssertion) + "</br>\n"
+	}
+	if worker.checksumBlocks > 0 {
+		result += fmt.Sprintf("<b>Checksum blocks:</b> %v mismatched of %v</br>\n", worker.mismatchedBlocks, worker.checksumBlocks)
+	}
+	if worker.checksumVerdict != "" {
+		result += "<b>Result checksums:</b> " + template.HTMLEscapeString(worker.checksumVerdict) + "</br>\n"
+	}
+	if worker.sqlMode != "" {
+		result += "<b>SQL mode:</b> " + template.HTMLEscapeString(worker.sqlMode) + "</br>\n"
+	}
+	if worker.jsonNormalized > 0 {
+		result += fmt.Sprintf("<b>JSON values normalized:</b> %v</br>\n", worker.jsonNormalized)
+	}
+	if len(worker.hashedColumns) > 0 {
+		result += "<b>Compared by hash:</b> " + template.HTMLEscapeString(strings.Join(worker.hashedColumns, ", ")) + "</br>\n"
+	}
+	for _, reselection := range worker.reselections {
+		result += "<b>Reselected:</b> " + template.HTMLEscapeString(reselection) + "</br>\n"
+	}
+	if len(worker.cleanUpFailures) > 0 {
+		result += "<b>Clean up failed on:</b> " + template.HTMLEscapeString(strings.Join(worker.cleanUpFailures, ", ")) + " (replication may still be stopped)</br>\n"
+	}
+
+	return template.HTML(result)
+}
+
+// StatusAsText is part of the Worker interface
+func (worker *SQLDiffWorker) StatusAsText() string {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	result := "Working on: " + worker.subset.name() + "\n"
+	result += "Run ID: " + worker.runID + "\n"
+	result += "Checking: " + worker.direction() + "\n"
+	result += "State: " + worker.state.String() + "\n"
+	if worker.confirming {
+		result += "Confirmation re-run in progress\n"
+	}
+	switch worker.state {
+	case sqlDiffError:
+		result += "Error: " + worker.err.Error() + "\n"
+		if worker.interruption != "" {
+			result += "Interrupted: " + worker.interruption + "\n"
+		}
+		if errorCategory(worker.err) == SQLDiffErrorDifferences {
+			result += "Differences: " + worker.counts.String() + "\n"
+			if len(worker.partitions) > 0 {
+				result += "Top partitions: " + formatPartitions(worker.partitions) + "\n"
+			}
+		}
+	case sqlDiffCancelled:
+		result += "Cancelled"
+		if worker.interruption != "" {
+			result += ": " + worker.interruption
+		}
+		result += "\n"
+	case sqlDiffRunning:
+		result += "Running...\n"
+	case sqlDiffCleanUp:
+		result += fmt.Sprintf("Restoring replication on %v tablets...\n", worker.restoringCount)
+	case sqlDiffDone:
+		result += "Success.\n"
+	}
+	if !worker.deltaAfter.IsNull() {
+		result += "Delta run: keys above " + worker.deltaAfter.String() + "\n"
+	}
+	if !worker.highWaterKey.IsNull() {
+		result += "High-water key: " + worker.highWaterKey.String() + "\n"
+	}
+	if worker.supersetBytesRead > 0 || worker.subsetBytesRead > 0 {
+		result += fmt.Sprintf("Bytes read: %v from superset, %v from subset\n", worker.supersetBytesRead, worker.subsetBytesRead)
+	}
+	if len(worker.schemaDrift) > 0 {
+		result += "Schema drift: " + strings.Join(worker.schemaDrift, "; ") + " (data differences may be a consequence)\n"
+	}
+	if worker.lagCaveat != "" {
+		result += "Replication lag: " + worker.lagCaveat + "\n"
+	}
+	if worker.countAssertion != "" {
+		result += "Count assertion: " + worker.countAssertion + "\n"
+	}
+	if worker.checksumBlocks > 0 {
+		result += fmt.Sprintf("Checksum blocks: %v mismatched of %v\n", worker.mismatchedBlocks, worker.checksumBlocks)
+	}
+	if worker.checksumVerdict != "" {
+		result += "Result checksums: " + worker.checksumVerdict + "\n"
+	}
+	if worker.sqlMode != "" {
+		result += "SQL mode: " + worker.sqlMode + "\n"
+	}
+	if worker.jsonNormalized > 0 {
+		result += fmt.Sprintf("JSON values normalized: %v\n", worker.jsonNormalized)
+	}
+	if len(worker.hashedColumns) > 0 {
+		result += "Compared by hash: " + strings.Join(worker.hashedColumns, ", ") + "\n"
+	}
+	for _, reselection := range worker.reselections {
+		result += "Reselected: " + reselection + "\n"
+	}
+	if len(worker.cleanUpFailures) > 0 {
+		result += "Clean up failed on: " + strings.Join(worker.cleanUpFailures, ", ") + " (replication may still be stopped)\n"
+	}
+	return result
+}
+
+// Cancel is part of the Worker interface
+func (worker *SQLDiffWorker) Cancel() {
+	worker.ctxCancel()
+}
+
+func (worker *SQLDiffWorker) checkInterrupted() bool {
+	select {
+	case <-worker.ctx.Done():
+		if worker.ctx.Err() == context.DeadlineExceeded {
+			return false
+		}
+		worker.recordError(topo.ErrInterrupted)
+		return true
+	default:
+	}
+	return false
+}
+
+// Run is mostly a wrapper to run the cleanup at the end.
+func (worker *SQLDiffWorker) Run() {
+	sqlDiffWorkers.register(worker)
+	defer sqlDiffWorkers.unregister(worker)
+	// deferred first, so the final status is saved once the end time
+	// is set below
+	if worker.options.StatusStore != nil {
+		done := make(chan struct{})
+		go worker.saveStatusLoop(done)
+		defer func() {
+			close(done)
+			worker.saveStatus()
+		}()
+	}
+	worker.mu.Lock()
+	worker.startTime = time.Now()
+	worker.mu.Unlock()
+	defer func() {
+		worker.mu.Lock()
+		worker.endTime = time.Now()
+		endTime := worker.endTime
+		worker.mu.Unlock()
+		sqlDiffWorkers.record(worker.HistoryKey(), DiffResult{
+			SQLDiffStatus: worker.GetStatus(),
+			EndTime:       endTime,
+			Config:        worker.Config(),
+		})
+		worker.dispatchAuditEvent()
+	}()
+	err := worker.run()
+	worker.mu.Lock()
+	worker.noteInterruption(err)
+	worker.mu.Unlock()
+
+	// nothing to clean up if we didn't get to change any tablet
+	if worker.cleaner.IsEmpty() {
+		if err != nil {
+			worker.recordError(err)
+			return
+		}
+		worker.setState(sqlDiffDone, "diff done, nothing to clean up")
+		return
+	}
+
+	worker.mu.Lock()
+	if err != nil {
+		worker.transition(sqlDiffCleanUp, "run ended: "+err.Error())
+	} else {
+		worker.transition(sqlDiffCleanUp, "diff done")
+	}
+	worker.restoringCount = len(worker.cleaner.GetTargetsByName(wrangler.StartSlaveActionName))
+	worker.mu.Unlock()
+	var cerr error
+	if worker.options.CleanUpDeadline > 0 {
+		cerr = worker.cleaner.CleanUpWithDeadline(worker.wr, worker.options.CleanUpDeadline)
+	} else {
+		cerr = worker.cleaner.CleanUp(worker.wr)
+	}
+	if cerr != nil {
+		failures := worker.cleaner.FailedTargets()
+		if abandoned := worker.cleaner.AbandonedTargets(); len(abandoned) > 0 {
+			worker.wr.Logger().Errorf("CleanUp abandoned after %v, tablets %v were not restored and need to be fixed manually", worker.options.CleanUpDeadline, abandoned)
+			failures = append(failures, abandoned...)
+		}
+		worker.wr.Logger().Errorf("CleanUp failed on tablets %v, replication may still be stopped on them", failures)
+		worker.mu.Lock()
+		worker.cleanUpFailures = failures
+		worker.mu.Unlock()
+		if err != nil {
+			worker.wr.Logger().Errorf("CleanUp failed in addition to job error: %v", cerr)
+			err = &sqlDiffCleanUpError{err: err, cerr: cerr}
+		} else {
+			err = categorize(SQLDiffErrorCleanUp, cerr)
+		}
+	}
+	if err != nil {
+		worker.recordError(err)
+		return
+	}
+	worker.setState(sqlDiffDone, "tablets restored")
+}
+
+func (worker *SQLDiffWorker) Error() error {
+	return worker.err
+}
+
+// FoundDifferences is part of the DifferenceFinder interface. A
+// violated CountAssertion is a difference too. It is false if the
+// cleanup failed too, as replication may then still be stopped,
+// which needs attention as an error.
+func (worker *SQLDiffWorker) FoundDifferences() bool {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if _, ok := worker.err.(*sqlDiffCleanUpError); ok {
+		return false
+	}
+	category := errorCategory(worker.err)
+	return category == SQLDiffErrorDifferences || category == SQLDiffErrorCountAssertion
+}
+
+func (worker *SQLDiffWorker) run() error {
+	if err := worker.checkPeakWindow(time.Now()); err != nil {
+		return err
+	}
+	if err := worker.options.CountAssertion.validate(); err != nil {
+		return err
+	}
+	if err := worker.checkAllShards(); err != nil {
+		return err
+	}
+	if err := worker.checkSnapshots(); err != nil {
+		return err
+	}
+	if worker.options.Aggregate {
+		if err := worker.prepareAggregates(); err != nil {
+			return err
+		}
+	}
+	if err := worker.checkQueries(); err != nil {
+		return err
+	}
+
+	if worker.options.Filter.Predicate != "" {
+		if err := worker.applyFilter(); err != nil {
+			return err
+		}
+	}
+	if worker.options.ChecksumBlockSize > 0 {
+		if err := worker.checkChecksumMode(); err != nil {
+			return err
+		}
+	}
+	if worker.options.ChecksumOnly {
+		if err := worker.checkChecksumOnly(); err != nil {
+			return err
+		}
+	}
+	if worker.options.Delta {
+		if err := worker.scopeDelta(); err != nil {
+			return err
+		}
+	}
+	if worker.options.KeysOnly {
+		if err := worker.projectKeysOnly(); err != nil {
+			return err
+		}
+	}
+	if len(worker.options.HashColumns) > 0 {
+		if err := worker.hashColumns(); err != nil {
+			return err
+		}
+	}
+	if worker.options.ForceBinaryKeySort {
+		if err := worker.checkBinaryKeySort(); err != nil {
+			return err
+		}
+	}
+	if worker.options.MaterializeSuperset {
+		if err := worker.checkMaterialize(); err != nil {
+			return err
+		}
+	}
+	if worker.options.VerifyKeyUniqueness {
+		if err := worker.checkKeyUniqueness(); err != nil {
+			return err
+		}
+	}
+	if worker.options.QueryEquivalence {
+		if err := worker.checkQueryEquivalence(); err != nil {
+			return err
+		}
+	}
+	if worker.options.ReselectOnUnhealthy {
+		if err := worker.checkReselect(); err != nil {
+			return err
+		}
+	}
+	if worker.options.FilteredReplication {
+		if err := worker.checkFilteredReplication(); err != nil {
+			return err
+		}
+	}
+
+	// first state: find targets
+	worker.setState(sqlDiffFindTargets, "run started")
+	if err := worker.findTargets(worker.ctx, worker.cleaner); err != nil {
+		return categorize(SQLDiffErrorNoTarget, err)
+	}
+	if worker.checkInterrupted() {
+		return topo.ErrInterrupted
+	}
+	if worker.options.ForceBinaryKeySort {
+		if err := worker.forceBinaryKeySort(); err != nil {
+			return err
+		}
+	}
+	if err := worker.planQueries(); err != nil {
+		return err
+	}
+	if worker.options.SQLMode != "" {
+		if err := worker.checkSQLModes(); err != nil {
+			return err
+		}
+	}
+	if worker.options.CheckKeyCollation && !worker.options.ForceBinaryKeySort {
+		if err := worker.checkKeyCollations(); err != nil {
+			return err
+		}
+	}
+	if worker.options.CheckSchema {
+		if err := worker.checkSchema(); err != nil {
+			return err
+		}
+	}
+	if worker.options.VerifyKeyUniqueness {
+		if err := worker.verifyKeyUniqueness(); err != nil {
+			return err
+		}
+	}
+	if err := worker.settle(); err != nil {
+		return err
+	}
+
+	// second phase: synchronize replication
+	if err := worker.runPhase("replication synchronization", true, worker.synchronizeReplicationPhase); err != nil {
+		return err
+	}
+	if worker.checkInterrupted() {
+		return topo.ErrInterrupted
+	}
+
+	// third phase: diff
+	var differentKeys map[string]bool
+	err := worker.runPhase("diff", false, func() (err error) {
+		differentKeys, err = worker.diffWithReselection(worker.options.KeySet)
+		return err
+	})
+	if err == nil || !worker.options.RerunOnDifference || errorCategory(err) != SQLDiffErrorDifferences {
+		return err
+	}
+
+	// optional fourth phase: confirm the differences
+	return worker.confirmDifferences(differentKeys)
+}
+
+// confirmDifferences phase:
+// - restart replication on both slaves, and let them catch up
+// - synchronize replication again
+// - re-run the diff on the rows that were found different
+func (worker *SQLDiffWorker) confirmDifferences(differentKeys map[string]bool) error {
+	worker.mu.Lock()
+	worker.confirming = true
+	worker.mu.Unlock()
+	defer func() {
+		worker.mu.Lock()
+		worker.confirming = false
+		worker.mu.Unlock()
+	}()
+	worker.wr.Logger().Infof("Found differences on %v rows, re-synchronizing replication to confirm them", len(differentKeys))
+
+	worker.setState(sqlDiffSynchronizeReplication, fmt.Sprintf("differences found on %v rows, confirming them", len(differentKeys)))
+	restarted := false
+	for _, alias := range []topo.TabletAlias{worker.subset.alias, worker.superset.alias} {
+		if worker.stoppedReplication(alias) {
+			restarted = true
+		}
+		if err := worker.restartReplication(alias); err != nil {
+			return categorize(SQLDiffErrorRPC, err)
+		}
+	}
+	// let the restarted slaves catch up
+	if restarted {
+		if err := worker.sleep(catchUpDelay); err != nil {
+			return err
+		}
+	}
+	if worker.checkInterrupted() {
+		return topo.ErrInterrupted
+	}
+	if err := worker.runPhase("replication synchronization", true, worker.synchronizeReplicationPhase); err != nil {
+		return err
+	}
+	if worker.checkInterrupted() {
+		return topo.ErrInterrupted
+	}
+
+	err := worker.runPhase("confirmation diff", false, func() error {
+		_, err := worker.diff(differentKeys)
+		return err
+	})
+	if err == nil {
+		worker.wr.Logger().Infof("The differences found were not confirmed by the re-run, they were replication artifacts")
+	}
+	return err
+}
+
+// synchronizeReplicationPhase runs synchronizeReplication, with its
+// errors categorized for runPhase.
+func (worker *SQLDiffWorker) synchronizeReplicationPhase() error {
+	if err := worker.synchronizeReplication(); err != nil {
+		if worker.checkInterrupted() {
+			return topo.ErrInterrupted
+		}
+		return categorize(SQLDiffErrorRPC, err)
+	}
+	return nil
+}
+
+// runPhase runs a phase of the worker, and consults the
+// ErrorClassifier option about its RPC and query errors: the phase is
+// then retried, up to MaxRetries times, its error is ignored, or
+// returned. The errors of the phases that are not ignorable, like the
+// diffs, are never ignored: the run would look clean without all the
+// rows compared.
+func (worker *SQLDiffWorker) runPhase(name string, ignorable bool, phase func() error) error {
+	maxRetries := worker.options.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+	for retries := 0; ; retries++ {
+		err := phase()
+		if err == nil || worker.options.ErrorClassifier == nil || worker.checkInterrupted() {
+			return err
+		}
+		if category := errorCategory(err); category != SQLDiffErrorRPC && category != SQLDiffErrorQuery {
+			return err
+		}
+		switch worker.options.ErrorClassifier(err) {
+		case DecisionRetry:
+			if retries == maxRetries {
+				worker.wr.Logger().Errorf("Giving up on the %v after %v retries: %v", name, retries, err)
+				return err
+			}
+			worker.wr.Logger().Warningf("Retrying the %v in %v (retry %v of %v) after: %v", name, worker.options.RetryDelay, retries+1, maxRetries, err)
+			select {
+			case <-time.After(worker.options.RetryDelay):
+			case <-worker.ctx.Done():
+				return topo.ErrInterrupted
+			}
+		case DecisionIgnore:
+			if !ignorable {
+				worker.wr.Logger().Errorf("The ErrorClassifier decided to ignore the error of the %v, but it is incomplete: %v", name, err)
+				return categorize(SQLDiffErrorIncomplete, fmt.Errorf("the %v is incomplete, not all the rows were compared: %v", name, err))
+			}
+			worker.wr.Logger().Warningf("Ignoring the error of the %v, as decided by the ErrorClassifier: %v", name, err)
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// settle waits for the SettleDelay option after the tablets were
+// marked as checkers, so the type change reaches the serving graph
+// before their replication is stopped.
+func (worker *SQLDiffWorker) settle() error {
+	if worker.options.SettleDelay <= 0 {
+		return nil
+	}
+	worker.wr.Logger().Infof("Waiting %v for the checker tablets to settle", worker.options.SettleDelay)
+	return worker.sleep(worker.options.SettleDelay)
+}
+
+// stoppedReplication returns true if the worker stopped replication
+// on the provided slave, and will restart it.
+func (worker *SQLDiffWorker) stoppedReplication(alias topo.TabletAlias) bool {
+	_, err := worker.cleaner.GetActionByName(wrangler.StartSlaveActionName, alias.String())
+	return err == nil
+}
+
+// sleep waits for the provided duration, or returns
+// topo.ErrInterrupted if the worker is cancelled first.
+func (worker *SQLDiffWorker) sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-worker.ctx.Done():
+		return topo.ErrInterrupted
+	}
+}
+
+// restartReplication restarts replication on the provided slave, if
+// the worker stopped it. Its StartSlave() cleaner action is removed,
+// as synchronizeReplication will record it again when stopping
+// replication.
+func (worker *SQLDiffWorker) restartReplication(alias topo.TabletAlias) error {
+	action, err := worker.cleaner.GetActionByName(wrangler.StartSlaveActionName, alias.String())
+	if err != nil {
+		// we didn't stop replication on that slave
+		return nil
+	}
+	worker.wr.Logger().Infof("Restarting replication on slave %v", alias)
+	release, err := worker.acquireRPC()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(worker.ctx, 60*time.Second)
+	err = action.CleanUp(ctx, worker.wr)
+	cancel()
+	release()
+	if err != nil {
+		return fmt.Errorf("Cannot restart slave %v: %v", alias, err)
+	}
+	return worker.cleaner.RemoveActionByName(wrangler.StartSlaveActionName, alias.String())
+}
+
+// findTargets phase:
+// - find one rdonly in superset
+// - find one rdonly in subset
+// - mark them all as 'checker' pointing back to us
+// The actions to undo this are recorded in the provided cleaner.
+func (worker *SQLDiffWorker) findTargets(ctx context.Context, cleaner *wrangler.Cleaner) error {
+	selector := worker.targetSelector()
+
+	if worker.options.SameTablet && (!worker.superset.hasTablet() || !worker.subset.hasTablet()) {
+		return fmt.Errorf("SameTablet cannot be used with an external MySQL or vtgate source")
+	}
+	if worker.options.SameTablet && worker.superset.Sync != worker.subset.Sync {
+		return fmt.Errorf("SameTablet requires superset and subset to use the same Sync strategy, got %q and %q", worker.superset.Sync, worker.subset.Sync)
+	}
+	for _, spec := range []SourceSpec{worker.superset, worker.subset} {
+		if spec.Sync != "" && spec.Sync != SyncStopReplication && spec.Sync != SyncSnapshot {
+			return fmt.Errorf("unknown Sync strategy %q for %v", spec.Sync, spec.name())
+		}
+	}
+	if worker.options.SameTablet && (worker.superset.Keyspace != worker.subset.Keyspace || worker.superset.Shard != worker.subset.Shard) {
+		return fmt.Errorf("SameTablet requires superset and subset to be in the same shard, got %v/%v and %v/%v", worker.superset.Keyspace, worker.superset.Shard, worker.subset.Keyspace, worker.subset.Shard)
+	}
+	if !worker.options.SameTabletAlias.IsZero() {
+		if !worker.options.SameTablet {
+			return fmt.Errorf("SameTabletAlias requires the SameTablet option")
+		}
+		selector = &aliasTargetSelector{alias: worker.options.SameTabletAlias}
+	}
+
+	// find an appropriate endpoint in superset, unless it is an
+	// external MySQL server or a vtgate, or one in each of its
+	// shards with AllShards
+	var supersetAlias, subsetAlias topo.TabletAlias
+	var err error
+	if worker.superset.AllShards {
+		if err := worker.findAllShardsTargets(ctx, cleaner, selector); err != nil {
+			return err
+		}
+		supersetAlias = worker.SupersetAlias()
+	} else if worker.superset.hasTablet() {
+		supersetAlias, err = worker.findChecker(ctx, cleaner, worker.superset, worker.superset.Shard, selector)
+		if err != nil {
+			return err
+		}
+	}
+
+	// both queries may run on the same tablet
+	if worker.options.SameTablet {
+		worker.setAliases(supersetAlias, supersetAlias)
+		return nil
+	}
+
+	// find an appropriate endpoint in subset
+	if worker.subset.hasTablet() {
+		subsetAlias, err = worker.findChecker(ctx, cleaner, worker.subset, worker.subset.Shard, selector)
+		if err != nil {
+			return err
+		}
+	}
+	worker.setAliases(supersetAlias, subsetAlias)
+
+	return worker.checkSameCell()
+}
+
+// targetSelector returns the TargetSelector option, or the default
+// selector configured by the other options.
+func (worker *SQLDiffWorker) targetSelector() TargetSelector {
+	if worker.options.TargetSelector != nil {
+		return worker.options.TargetSelector
+	}
+	return &randomTargetSelector{
+		options: checkerOptions{
+			jitter:        worker.options.SelectionJitter,
+			avoidCheckers: worker.options.AvoidCheckers,
+			tags:          worker.options.TabletTags,
+		},
+	}
+}
+
+// setAliases records the tablets found by findTargets. They are
+// written under the mutex so SupersetAlias and SubsetAlias can be
+// called while the worker is running.
+func (worker *SQLDiffWorker) setAliases(superset, subset topo.TabletAlias) {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	worker.superset.alias = superset
+	worker.subset.alias = subset
+}
+
+// SupersetAlias returns the tablet used for the superset query, or
+// a zero alias if it has not been picked yet. It is safe to call
+// while the worker is running, for instance to keep a reparent away
+// from the tablets a diff is using.
+func (worker *SQLDiffWorker) SupersetAlias() topo.TabletAlias {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.superset.alias
+}
+
+// SubsetAlias returns the tablet used for the subset query, or a zero
+// alias if it has not been picked yet. It is safe to call while the
+// worker is running.
+func (worker *SQLDiffWorker) SubsetAlias() topo.TabletAlias {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.subset.alias
+}
+
+// PreflightCheck validates the worker configuration without running
+// the diff: it finds the targets, and opens and closes a query
+// connection to each of them with a LIMIT 1 version of the queries.
+// Replication is not stopped, and the targets are returned to their
+// original type before returning. It should not be called
+// concurrently with Run.
+func (worker *SQLDiffWorker) PreflightCheck(ctx context.Context) error {
+	cleaner := new(wrangler.Cleaner)
+	err := worker.preflightCheck(ctx, cleaner)
+	if cerr := cleaner.CleanUp(worker.wr); cerr != nil {
+		if err != nil {
+			worker.wr.Logger().Errorf("CleanUp failed in addition to preflight error: %v", cerr)
+		} else {
+			err = categorize(SQLDiffErrorCleanUp, cerr)
+		}
+	}
+	if err != nil {
+		worker.wr.Logger().Errorf("Preflight check failed: %v", err)
+		return err
+	}
+	worker.wr.Logger().Infof("Preflight check successful for %v", worker.direction())
+	return nil
+}
+
+func (worker *SQLDiffWorker) preflightCheck(ctx context.Context, cleaner *wrangler.Cleaner) error {
+	if err := worker.checkQueries(); err != nil {
+		return err
+	}
+	if err := worker.findTargets(ctx, cleaner); err != nil {
+		return categorize(SQLDiffErrorNoTarget, err)
+	}
+	for _, source := range []struct {
+		name string
+		spec SourceSpec
+	}{
+		{"superset", worker.superset},
+		{"subset", worker.subset},
+	} {
+		spec := source.spec
+		spec.SQL = probeSQL(spec.SQL)
+		reader, cancel, err := worker.openReader(ctx, source.name, spec)
+		if err != nil {
+			return categorize(SQLDiffErrorRPC, err)
+		}
+		reader.Close()
+		cancel()
+	}
+	return nil
+}
+
+// probeSQL returns a version of the query that only returns one row,
+// unless the query already has its own LIMIT, or is a CALL. The LIMIT
+// of a UNION is parsed as the one of its last SELECT. A query that
+// can't be parsed is returned as is.
+func probeSQL(sql string) string {
+	sql = strings.TrimRight(strings.TrimSpace(sql), ";")
+	if firstKeyword(sql) == "CALL" {
+		return sql
+	}
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return sql
+	}
+	for {
+		union, ok := statement.(*sqlparser.Union)
+		if !ok {
+			break
+		}
+		statement = union.Right
+	}
+	if sel, ok := statement.(*sqlparser.Select); !ok || sel.Limit != nil {
+		return sql
+	}
+	return sql + " LIMIT 1"
+}
+
+// checkQueries validates the queries before running them.
+func (worker *SQLDiffWorker) checkQueries() error {
+	if err := checkReadOnlySQL(worker.superset.SQL, worker.options.AllowCall && worker.superset.DSN != ""); err != nil {
+		return fmt.Errorf("superset: %v", err)
+	}
+	if err := checkReadOnlySQL(worker.subset.SQL, worker.options.AllowCall && worker.subset.DSN != ""); err != nil {
+		return fmt.Errorf("subset: %v", err)
+	}
+	return worker.checkKeyColumns()
+}
+
+// firstKeyword returns the first keyword of a query, in upper case.
+func firstKeyword(sql string) string {
+	fields := strings.Fields(strings.TrimLeft(sql, "( \t\r\n"))
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// checkReadOnlySQL returns an error if the query is not a SELECT or
+// UNION the tablets accept to stream, or a CALL if allowCall is set.
+// Views can be used in SELECTs. Stored procedures can't be checked
+// for side effects, hence the opt-in.
+func checkReadOnlySQL(sql string, allowCall bool) error {
+	if firstKeyword(sql) == "CALL" {
+		if allowCall {
+			return nil
+		}
+		return fmt.Errorf("query '%v' calls a stored procedure, which requires the AllowCall option and a DSN source", sql)
+	}
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	switch stmt := statement.(type) {
+	case *sqlparser.Select:
+		if stmt.Lock != "" {
+			return fmt.Errorf("query '%v' locks the rows it reads, which the tablets don't stream", sql)
+		}
+		return nil
+	case *sqlparser.Union:
+		return nil
+	}
+	return fmt.Errorf("query '%v' is not a SELECT, only read-only queries can be diffed", sql)
+}
+
+// keyColumns returns the key columns for the superset and subset, or
+// nil if the first column is the key.
+func (worker *SQLDiffWorker) keyColumns() ([]string, []string) {
+	superset := worker.superset.KeyColumns
+	subset := worker.subset.KeyColumns
+	if len(superset) == 0 {
+		superset = subset
+	}
+	if len(subset) == 0 {
+		subset = superset
+	}
+	return superset, subset
+}
+
+// checkKeyColumns checks both queries are ordered by their key
+// columns, if any.
+func (worker *SQLDiffWorker) checkKeyColumns() error {
+	supersetKeyColumns, subsetKeyColumns := worker.keyColumns()
+	if len(supersetKeyColumns) == 0 {
+		return nil
+	}
+	if len(supersetKeyColumns) != len(subsetKeyColumns) {
+		return fmt.Errorf("superset and subset have a different number of key columns: %v and %v", supersetKeyColumns, subsetKeyColumns)
+	}
+	if err := checkOrderedByKeyColumns(worker.superset.SQL, supersetKeyColumns); err != nil {
+		return fmt.Errorf("superset: %v", err)
+	}
+	if err := checkOrderedByKeyColumns(worker.subset.SQL, subsetKeyColumns); err != nil {
+		return fmt.Errorf("subset: %v", err)
+	}
+	return nil
+}
+
+// checkOrderedByKeyColumns returns an error if the query is not a
+// SELECT ordered by the key columns first, in ascending order, as
+// the differ relies on it to match rows.
+func checkOrderedByKeyColumns(sql string, keyColumns []string) error {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok {
+		return fmt.Errorf("query '%v' is not a simple SELECT", sql)
+	}
+	for i, name := range keyColumns {
+		if i >= len(sel.OrderBy) {
+			return fmt.Errorf("query '%v' must be ordered by %v first", sql, strings.Join(keyColumns, ", "))
+		}
+		col := orderByColumn(sel.OrderBy[i])
+		if col == nil || !strings.EqualFold(string(col.Name), name) || sel.OrderBy[i].Direction == sqlparser.AST_DESC {
+			return fmt.Errorf("query '%v' must be ordered by %v first, in ascending order", sql, strings.Join(keyColumns, ", "))
+		}
+	}
+	return nil
+}
+
+// orderByColumn returns the column an ORDER BY expression sorts by,
+// either directly or as BINARY(column), or nil.
+func orderByColumn(order *sqlparser.Order) *sqlparser.ColName {
+	switch expr := order.Expr.(type) {
+	case *sqlparser.ColName:
+		return expr
+	case *sqlparser.FuncExpr:
+		if !strings.EqualFold(string(expr.Name), "binary") || len(expr.Exprs) != 1 {
+			return nil
+		}
+		if nse, ok := expr.Exprs[0].(*sqlparser.NonStarExpr); ok {
+			if col, ok := nse.Expr.(*sqlparser.ColName); ok {
+				return col
+			}
+		}
+	}
+	return nil
+}
+
+// binaryKeySortSQL rewrites the query so its first ORDER BY columns
+// whose binaryKeys entry is set are sorted as BINARY(column), to get
+// the byte order the differ compares these keys with, whatever their
+// collation. There is one entry per key column.
+func binaryKeySortSQL(sql string, binaryKeys []bool) (string, error) {
+	keyCount := len(binaryKeys)
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok {
+		return "", fmt.Errorf("query '%v' is not a simple SELECT", sql)
+	}
+	if len(sel.OrderBy) < keyCount {
+		return "", fmt.Errorf("query '%v' must be ordered by its %v key columns first", sql, keyCount)
+	}
+	for i, order := range sel.OrderBy[:keyCount] {
+		if !binaryKeys[i] {
+			continue
+		}
+		if col, ok := order.Expr.(*sqlparser.ColName); ok {
+			order.Expr = &sqlparser.FuncExpr{
+				Name:  []byte("binary"),
+				Exprs: sqlparser.SelectExprs{&sqlparser.NonStarExpr{Expr: col}},
+			}
+		}
+	}
+	return sqlparser.String(sel), nil
+}
+
+// aggregateSQL returns the grouping columns of a GROUP BY query, and
+// the query ordered by them if it has no ORDER BY.
+func aggregateSQL(sql string) (string, []string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok || len(sel.GroupBy) == 0 {
+		return "", nil, fmt.Errorf("query '%v' is not a SELECT with a GROUP BY", sql)
+	}
+	ordered := len(sel.OrderBy) > 0
+	var columns []string
+	for _, expr := range sel.GroupBy {
+		col, ok := expr.(*sqlparser.ColName)
+		if !ok {
+			return "", nil, fmt.Errorf("query '%v' can only be grouped by columns", sql)
+		}
+		columns = append(columns, string(col.Name))
+		if !ordered {
+			sel.OrderBy = append(sel.OrderBy, &sqlparser.Order{Expr: col, Direction: sqlparser.AST_ASC})
+		}
+	}
+	if ordered {
+		return sql, columns, nil
+	}
+	return sqlparser.String(sel), columns, nil
+}
+
+// keysOnlySQL rewrites the query to only select its keyCount first
+// ORDER BY columns.
+func keysOnlySQL(sql string, keyCount int) (string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok {
+		return "", fmt.Errorf("query '%v' is not a simple SELECT", sql)
+	}
+	if len(sel.OrderBy) < keyCount {
+		return "", fmt.Errorf("query '%v' must be ordered by its %v key columns first", sql, keyCount)
+	}
+	exprs := make(sqlparser.SelectExprs, keyCount)
+	for i, order := range sel.OrderBy[:keyCount] {
+		col := orderByColumn(order)
+		if col == nil {
+			return "", fmt.Errorf("query '%v' must be ordered by its %v key columns first", sql, keyCount)
+		}
+		exprs[i] = &sqlparser.NonStarExpr{Expr: col}
+	}
+	sel.SelectExprs = exprs
+	return sqlparser.String(sel), nil
+}
+
+// keyTableAndColumns returns the table the query reads from, and the
+// names of its keyCount first ORDER BY columns.
+func keyTableAndColumns(sql string, keyCount int) (string, []string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok || len(sel.From) != 1 {
+		return "", nil, fmt.Errorf("query '%v' is not a simple SELECT from a single table", sql)
+	}
+	ate, ok := sel.From[0].(*sqlparser.AliasedTableExpr)
+	if !ok {
+		return "", nil, fmt.Errorf("query '%v' is not a simple SELECT from a single table", sql)
+	}
+	table, ok := ate.Expr.(*sqlparser.TableName)
+	if !ok {
+		return "", nil, fmt.Errorf("query '%v' is not a simple SELECT from a single table", sql)
+	}
+	if len(sel.OrderBy) < keyCount {
+		return "", nil, fmt.Errorf("query '%v' must be ordered by its %v key columns first", sql, keyCount)
+	}
+	columns := make([]string, keyCount)
+	for i, order := range sel.OrderBy[:keyCount] {
+		col := orderByColumn(order)
+		if col == nil {
+			return "", nil, fmt.Errorf("query '%v' must be ordered by its %v key columns first", sql, keyCount)
+		}
+		columns[i] = string(col.Name)
+	}
+	return string(table.Name), columns, nil
+}
+
+// keyCount returns the number of key columns.
+func (worker *SQLDiffWorker) keyCount() int {
+	if supersetKeyColumns, _ := worker.keyColumns(); len(supersetKeyColumns) > 0 {
+		return len(supersetKeyColumns)
+	}
+	return 1
+}
+
+// prepareAggregates orders both GROUP BY queries by their grouping
+// columns if needed, and uses them as the key columns unless some
+// are set.
+func (worker *SQLDiffWorker) prepareAggregates() error {
+	hasKeyColumns := len(worker.superset.KeyColumns) > 0 || len(worker.subset.KeyColumns) > 0
+	for _, spec := range []*SourceSpec{&worker.superset, &worker.subset} {
+		sql, columns, err := aggregateSQL(spec.SQL)
+		if err != nil {
+			return err
+		}
+		if sql != spec.SQL {
+			worker.wr.Logger().Infof("Ordering %v by its grouping columns: %v", spec.name(), sql)
+			spec.SQL = sql
+		}
+		if !hasKeyColumns {
+			spec.KeyColumns = columns
+		}
+		worker.wr.Logger().Infof("Comparing the aggregates of %v grouped by %v", spec.name(), strings.Join(columns, ", "))
+	}
+	return nil
+}
+
+// projectKeysOnly rewrites both queries to only select their key
+// columns.
+func (worker *SQLDiffWorker) projectKeysOnly() error {
+	for _, spec := range []*SourceSpec{&worker.superset, &worker.subset} {
+		sql, err := keysOnlySQL(spec.SQL, worker.keyCount())
+		if err != nil {
+			return err
+		}
+		worker.wr.Logger().Infof("Only selecting the keys for %v: %v", spec.name(), sql)
+		spec.SQL = sql
+	}
+	return nil
+}
+
+// scopeDelta rewrites both queries to only read the rows above the
+// high-water key of the last clean run of the check, unless there is
+// none, or a full diff is due as per the DeltaFullEvery option.
+func (worker *SQLDiffWorker) scopeDelta() error {
+	switch {
+	case worker.keyCount() != 1:
+		return fmt.Errorf("the Delta option requires a single key column")
+	case worker.options.KeyFunc != nil:
+		return fmt.Errorf("the Delta option can't be used with a KeyFunc")
+	case worker.options.SamplePercent != 0:
+		return fmt.Errorf("the Delta option can't be used with sampling, the rows below the high-water key wouldn't all be compared")
+	}
+	checkpoint, ok := sqlDiffWorkers.checkpoint(worker.HistoryKey())
+	if !ok {
+		worker.wr.Logger().Infof("No high-water key recorded for %v, running a full diff", worker.HistoryKey())
+		return nil
+	}
+	if worker.options.DeltaFullEvery > 0 && checkpoint.deltaRuns+1 >= worker.options.DeltaFullEvery {
+		worker.wr.Logger().Infof("Running a full diff after %v delta runs", checkpoint.deltaRuns)
+		return nil
+	}
+	for _, spec := range []*SourceSpec{&worker.superset, &worker.subset} {
+		sql, err := deltaSQL(spec.SQL, checkpoint.highWaterKey)
+		if err != nil {
+			return err
+		}
+		worker.wr.Logger().Infof("Only diffing the keys above %v for %v: %v", checkpoint.highWaterKey, spec.name(), sql)
+		spec.SQL = sql
+	}
+	worker.mu.Lock()
+	worker.deltaAfter = checkpoint.highWaterKey
+	worker.mu.Unlock()
+	return nil
+}
+
+// recordHighWaterKey records the high-water key of a clean run, for
+// the next delta runs of the check. If the run read no row, the
+// previous high-water key is kept.
+func (worker *SQLDiffWorker) recordHighWaterKey(highWaterKey sqltypes.Value) {
+	key := worker.HistoryKey()
+	checkpoint, _ := sqlDiffWorkers.checkpoint(key)
+	if worker.deltaAfter.IsNull() {
+		checkpoint.deltaRuns = 0
+	} else {
+		checkpoint.deltaRuns++
+	}
+	if !highWaterKey.IsNull() {
+		checkpoint.highWaterKey = highWaterKey
+	}
+	if checkpoint.highWaterKey.IsNull() {
+		return
+	}
+	sqlDiffWorkers.setCheckpoint(key, checkpoint)
+	worker.wr.Logger().Infof("Recorded high-water key %v for the next delta runs", checkpoint.highWaterKey)
+	worker.mu.Lock()
+	worker.highWaterKey = checkpoint.highWaterKey
+	worker.mu.Unlock()
+}
+
+// deltaSQL rewrites the query to only return the rows whose first
+// ORDER BY column is above highWaterKey. The key is compared with the
+// ORDER BY expression itself, so the rows skipped are exactly the ones
+// sorted before it: with the collation of the column, or in byte
+// order for BINARY(column).
+func deltaSQL(sql string, highWaterKey sqltypes.Value) (string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok || len(sel.OrderBy) == 0 {
+		return "", fmt.Errorf("query '%v' is not a SELECT ordered by its key column", sql)
+	}
+	order := sel.OrderBy[0]
+	col := orderByColumn(order)
+	if col == nil {
+		return "", fmt.Errorf("query '%v' must be ordered by its key column first", sql)
+	}
+	if order.Direction == sqlparser.AST_DESC {
+		return "", fmt.Errorf("query '%v' must be ordered by its key column ascending", sql)
+	}
+	condition := &sqlparser.ComparisonExpr{Operator: sqlparser.AST_GT, Left: order.Expr}
+	if _, isCol := order.Expr.(*sqlparser.ColName); isCol && highWaterKey.IsNumeric() {
+		condition.Right = sqlparser.NumVal(highWaterKey.Raw())
+	} else {
+		condition.Right = sqlparser.StrVal(highWaterKey.Raw())
+	}
+	addWhere(sel, condition)
+	return sqlparser.String(sel), nil
+}
+
+// addWhere adds a condition to the WHERE clause of the query.
+func addWhere(sel *sqlparser.Select, condition sqlparser.BoolExpr) {
+	if sel.Where == nil {
+		sel.Where = &sqlparser.Where{Type: sqlparser.AST_WHERE, Expr: condition}
+		return
+	}
+	sel.Where.Expr = &sqlparser.AndExpr{
+		Left:  &sqlparser.ParenBoolExpr{Expr: sel.Where.Expr},
+		Right: condition,
+	}
+}
+
+// applyFilter adds the Filter to the queries of both sides.
+func (worker *SQLDiffWorker) applyFilter() error {
+	for _, spec := range []*SourceSpec{&worker.superset, &worker.subset} {
+		sql, err := filterSQL(spec.SQL, worker.options.Filter)
+		if err != nil {
+			return err
+		}
+		worker.wr.Logger().Infof("Filtered the query for %v: %v", spec.name(), sql)
+		spec.SQL = sql
+	}
+	return nil
+}
+
+// filterSQL adds the filter predicate to the WHERE clause of the
+// query, with its bind variables replaced by their values.
+func filterSQL(sql string, filter SQLFilter) (string, error) {
+	statement, err := sqlparser.Parse("select 1 from dual where " + filter.Predicate)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse filter predicate '%v': %v", filter.Predicate, err)
+	}
+	predicate := statement.(*sqlparser.Select).Where.Expr
+
+	statement, err = sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok {
+		return "", fmt.Errorf("query '%v' is not a SELECT, it can't be filtered", sql)
+	}
+	addWhere(sel, &sqlparser.ParenBoolExpr{Expr: predicate})
+	buf := sqlparser.NewTrackedBuffer(nil)
+	buf.Myprintf("%v", sel)
+	query, err := buf.ParsedQuery().GenerateQuery(filter.BindVars)
+	if err != nil {
+		return "", fmt.Errorf("cannot bind the filter variables: %v", err)
+	}
+	return string(query), nil
+}
+
+// checkBinaryKeySort checks the queries can be rewritten by
+// forceBinaryKeySort, before the tablets are picked.
+func (worker *SQLDiffWorker) checkBinaryKeySort() error {
+	for _, spec := range []SourceSpec{worker.superset, worker.subset} {
+		if _, err := binaryKeySortSQL(spec.SQL, make([]bool, worker.keyCount())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forceBinaryKeySort rewrites both queries to sort the keys the differ
+// compares as bytes in binary order. The integer and floating point
+// keys are compared as numbers, so they keep their numeric order.
+func (worker *SQLDiffWorker) forceBinaryKeySort() error {
+	for _, side := range []struct {
+		name string
+		spec *SourceSpec
+	}{
+		{"superset", &worker.superset},
+		{"subset", &worker.subset},
+	} {
+		spec := side.spec
+		fields, err := worker.keyFields(side.name, *spec)
+		if err != nil {
+			return err
+		}
+		binaryKeys := make([]bool, len(fields))
+		for i, field := range fields {
+			binaryKeys[i] = comparedAsBytes(field.Type)
+		}
+		sql, err := binaryKeySortSQL(spec.SQL, binaryKeys)
+		if err != nil {
+			return err
+		}
+		worker.wr.Logger().Infof("Forcing binary key sort for %v/%v: %v", spec.Keyspace, spec.Shard, sql)
+		spec.SQL = sql
+	}
+	return nil
+}
+
+// keyFields returns the fields of the key columns of the spec query,
+// read by running it without returning any row.
+func (worker *SQLDiffWorker) keyFields(name string, spec SourceSpec) ([]mproto.Field, error) {
+	sql, err := emptyProbeSQL(spec.SQL)
+	if err != nil {
+		return nil, err
+	}
+	spec.SQL = sql
+	reader, cancel, err := worker.openReader(worker.ctx, name, spec)
+	if err != nil {
+		return nil, err
+	}
+	reader.Close()
+	cancel()
+
+	supersetKeyColumns, subsetKeyColumns := worker.keyColumns()
+	keyColumns := supersetKeyColumns
+	if name == "subset" {
+		keyColumns = subsetKeyColumns
+	}
+	if len(keyColumns) == 0 {
+		if len(reader.Fields) < worker.keyCount() {
+			return nil, fmt.Errorf("%v query returns %v columns, fewer than its %v key columns", name, len(reader.Fields), worker.keyCount())
+		}
+		return reader.Fields[:worker.keyCount()], nil
+	}
+	fields := make([]mproto.Field, len(keyColumns))
+	for i, column := range keyColumns {
+		index := fieldIndex(reader.Fields, column)
+		if index == -1 {
+			return nil, fmt.Errorf("%v key column %v is not returned by the query", name, column)
+		}
+		fields[i] = reader.Fields[index]
+	}
+	return fields, nil
+}
+
+// comparedAsBytes returns true for the types CompareRows compares as
+// bytes, that is all of them but the integer and floating point types.
+func comparedAsBytes(fieldType int64) bool {
+	switch fieldType {
+	case mproto.VT_TINY, mproto.VT_SHORT, mproto.VT_LONG, mproto.VT_LONGLONG, mproto.VT_INT24, mproto.VT_FLOAT, mproto.VT_DOUBLE:
+		return false
+	}
+	return true
+}
+
+// emptyProbeSQL rewrites the query to return no row, so its fields can
+// be read cheaply.
+func emptyProbeSQL(sql string) (string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok {
+		return "", fmt.Errorf("query '%v' is not a simple SELECT", sql)
+	}
+	sel.Limit = &sqlparser.Limit{Rowcount: sqlparser.NumVal("0")}
+	return sqlparser.String(sel), nil
+}
+
+// checkKeyCollations returns an error if the key columns don't have
+// the same collation on both sides: the sides would then be sorted
+// differently, and the diff would silently be wrong.
+func (worker *SQLDiffWorker) checkKeyCollations() error {
+	supersetCollations, err := worker.keyCollations("superset", worker.superset)
+	if err != nil {
+		return err
+	}
+	subsetCollations, err := worker.keyCollations("subset", worker.subset)
+	if err != nil {
+		return err
+	}
+	for i := range supersetCollations {
+		if supersetCollations[i] != subsetCollations[i] {
+			return fmt.Errorf("key column collations differ: superset has %v, subset has %v. Both sides would be sorted differently, use ForceBinaryKeySort or ORDER BY BINARY(column)", supersetCollations, subsetCollations)
+		}
+	}
+	worker.wr.Logger().Infof("Key columns have the same collations on both sides: %v", supersetCollations)
+	return nil
+}
+
+// keyCollations returns the collations of the key columns of a spec,
+// as returned by information_schema. Non-string columns have an
+// empty collation.
+func (worker *SQLDiffWorker) keyCollations(name string, spec SourceSpec) ([]string, error) {
+	table, columns, err := keyTableAndColumns(spec.SQL, worker.keyCount())
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	result := make([]string, len(columns))
+	for i, column := range columns {
+		sql := fmt.Sprintf("SELECT COLLATION_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = %v AND COLUMN_NAME = %v", sqlparser.String(sqlparser.StrVal(table)), sqlparser.String(sqlparser.StrVal(column)))
+		collationSpec := spec
+		collationSpec.SQL = sql
+		if spec.AllShards {
+			// the key columns have the same collation in
+			// all the shards
+			collationSpec.AllShards = false
+			collationSpec.Shard = spec.shards[0]
+		}
+		reader, cancel, err := worker.openReader(worker.ctx, name, collationSpec)
+		if err != nil {
+			return nil, err
+		}
+		row, err := NewRowReader(reader).Next()
+		reader.Close()
+		cancel()
+		if err != nil {
+			return nil, categorize(SQLDiffErrorRPC, fmt.Errorf("cannot read the collation of %v column %v.%v: %v", name, table, column, err))
+		}
+		if row == nil {
+			return nil, fmt.Errorf("%v key column %v.%v not found in information_schema", name, table, column)
+		}
+		result[i] = row[0].String()
+	}
+	return result, nil
+}
+
+// checkSchema compares the schema of the tables read by both queries,
+// and records the column drift between them.
+func (worker *SQLDiffWorker) checkSchema() error {
+	if !worker.superset.hasTablet() || !worker.subset.hasTablet() {
+		worker.wr.Logger().Warningf("Not checking the schema, it needs a tablet on both sides")
+		return nil
+	}
+	supersetTable, err := worker.tableDefinition("superset", worker.superset)
+	if err != nil {
+		return err
+	}
+	subsetTable, err := worker.tableDefinition("subset", worker.subset)
+	if err != nil {
+		return err
+	}
+	drift := schemaDrift(supersetTable, subsetTable)
+	if len(drift) == 0 {
+		worker.wr.Logger().Infof("Tables %v and %v have the same columns", supersetTable.Name, subsetTable.Name)
+		return nil
+	}
+	worker.wr.Logger().Warningf("Schema drift between superset table %v and subset table %v, data differences may be a consequence: %v", supersetTable.Name, subsetTable.Name, strings.Join(drift, "; "))
+	worker.mu.Lock()
+	worker.schemaDrift = drift
+	worker.mu.Unlock()
+	return nil
+}
+
+// tableDefinition returns the definition of the table a spec reads, on
+// its tablet.
+func (worker *SQLDiffWorker) tableDefinition(name string, spec SourceSpec) (*myproto.TableDefinition, error) {
+	table, _, err := keyTableAndColumns(spec.SQL, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	release, err := worker.acquireRPC()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(worker.ctx, 60*time.Second)
+	defer cancel()
+	sd, err := worker.wr.GetSchema(ctx, spec.alias, []string{table}, nil, true)
+	if err != nil {
+		return nil, categorize(SQLDiffErrorRPC, fmt.Errorf("cannot get the %v schema of %v: %v", name, table, err))
 	}
-	return result
+	td, ok := sd.GetTable(table)
+	if !ok {
+		return nil, fmt.Errorf("%v table %v not found on %v", name, table, spec.alias)
+	}
+	return td, nil
 }
 
-// Cancel is part of the Worker interface
-func (worker *SQLDiffWorker) Cancel() {
-	worker.ctxCancel()
+// schemaDrift returns the columns added, removed or with a different
+// type between two tables, as found in their CREATE statements.
+func schemaDrift(superset, subset *myproto.TableDefinition) []string {
+	supersetNames, supersetTypes := tableColumnTypes(superset.Schema)
+	subsetNames, subsetTypes := tableColumnTypes(subset.Schema)
+	var result []string
+	for _, column := range supersetNames {
+		subsetType, ok := subsetTypes[column]
+		switch {
+		case !ok:
+			result = append(result, fmt.Sprintf("column %v only in superset", column))
+		case subsetType != supersetTypes[column]:
+			result = append(result, fmt.Sprintf("column %v is %v in superset, %v in subset", column, supersetTypes[column], subsetType))
+		}
+	}
+	for _, column := range subsetNames {
+		if _, ok := supersetTypes[column]; !ok {
+			result = append(result, fmt.Sprintf("column %v only in subset", column))
+		}
+	}
+	return result
 }
 
-func (worker *SQLDiffWorker) checkInterrupted() bool {
-	select {
-	case <-worker.ctx.Done():
-		if worker.ctx.Err() == context.DeadlineExceeded {
-			return false
+// tableColumnTypes returns the columns of a CREATE TABLE statement, in
+// order, and their types, like "bigint(20) unsigned".
+func tableColumnTypes(createSQL string) ([]string, map[string]string) {
+	var names []string
+	types := make(map[string]string)
+	for _, line := range strings.Split(createSQL, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "`") {
+			continue
 		}
-		worker.recordError(topo.ErrInterrupted)
-		return true
-	default:
+		end := strings.Index(line[1:], "`")
+		if end == -1 {
+			continue
+		}
+		name := line[1 : end+1]
+		fields := strings.Fields(strings.TrimSuffix(line[end+2:], ","))
+		if len(fields) == 0 {
+			continue
+		}
+		columnType := strings.ToLower(fields[0])
+		for _, modifier := range fields[1:] {
+			modifier = strings.ToLower(modifier)
+			if modifier != "unsigned" && modifier != "zerofill" {
+				break
+			}
+			columnType += " " + modifier
+		}
+		names = append(names, name)
+		types[name] = columnType
 	}
-	return false
+	return names, types
 }
 
-// Run is mostly a wrapper to run the cleanup at the end.
-func (worker *SQLDiffWorker) Run() {
-	err := worker.run()
+// sourceCell returns the cell to find a checker in for the spec.
+func (worker *SQLDiffWorker) sourceCell(spec SourceSpec) string {
+	if spec.Cell != "" {
+		return spec.Cell
+	}
+	return worker.cell
+}
 
-	worker.setState(sqlDiffCleanUp)
-	cerr := worker.cleaner.CleanUp(worker.wr)
-	if cerr != nil {
-		if err != nil {
-			worker.wr.Logger().Errorf("CleanUp failed in addition to job error: %v", cerr)
-		} else {
-			err = cerr
-		}
+// checkSameCell warns, or fails in strict mode, if the superset and
+// subset tablets are in different cells.
+func (worker *SQLDiffWorker) checkSameCell() error {
+	if !worker.options.CheckSameCell && !worker.options.StrictSameCell {
+		return nil
 	}
-	if err != nil {
-		worker.recordError(err)
-		return
+	if !worker.superset.hasTablet() || !worker.subset.hasTablet() {
+		return nil
 	}
-	worker.setState(sqlDiffDone)
+	if worker.superset.alias.Cell == worker.subset.alias.Cell {
+		return nil
+	}
+	msg := fmt.Sprintf("superset tablet %v is in cell %v but subset tablet %v is in cell %v, the diff will be slow and expensive", worker.superset.alias, worker.superset.alias.Cell, worker.subset.alias, worker.subset.alias.Cell)
+	if worker.options.StrictSameCell {
+		return fmt.Errorf("%v", msg)
+	}
+	worker.wr.Logger().Warningf("%v", msg)
+	return nil
 }
 
-func (worker *SQLDiffWorker) Error() error {
-	return worker.err
-}
+// catchUpDelay is the time the slaves are given to replicate past
+// each other when synchronizing replication.
+const catchUpDelay = 5 * time.Second
 
-func (worker *SQLDiffWorker) run() error {
-	// first state: find targets
-	if err := worker.findTargets(); err != nil {
-		return err
+// synchronizeReplication phase:
+// 1 - ask the subset slave to stop replication
+// 2 - sleep for catchUpDelay, if it was stopped
+// 3 - ask the superset slave to stop replication
+// Note this is not 100% correct, but good enough for now
+// With the SameTablet option, there is nothing to synchronize:
+// replication is just stopped on the only tablet, so both queries
+// read the same data. With the StopPosition option, both slaves are
+// stopped when they reach that position instead, without sleeping.
+// With the FilteredReplication option, they are stopped at the same
+// point of filtered replication, see synchronizeFilteredReplication.
+// With the CompensateLag option, the subset slave then catches up
+// with the superset slave if it is behind, see compensateLag.
+// An external MySQL or vtgate source has no tablet picked by the
+// worker, so only the tablet of the other side is stopped.
+func (worker *SQLDiffWorker) synchronizeReplication() error {
+	worker.setState(sqlDiffSynchronizeReplication, "targets found")
+
+	if worker.options.SameTablet {
+		if !worker.superset.stopsReplication() {
+			return nil
+		}
+		return worker.stopReplication("shared", worker.superset.alias)
 	}
-	if worker.checkInterrupted() {
-		return topo.ErrInterrupted
+	if !worker.superset.stopsReplication() {
+		if !worker.subset.stopsReplication() {
+			return nil
+		}
+		return worker.stopReplication("subset", worker.subset.alias)
+	}
+	if !worker.subset.stopsReplication() {
+		return worker.stopReplication("superset", worker.superset.alias)
+	}
+	if worker.options.FilteredReplication {
+		return worker.synchronizeFilteredReplication()
 	}
 
-	// second phase: synchronize replication
-	if err := worker.synchronizeReplication(); err != nil {
-		if worker.checkInterrupted() {
-			return topo.ErrInterrupted
+	// stop replication on subset slave
+	if err := worker.stopReplication("subset", worker.subset.alias); err != nil {
+		if worker.options.AtomicStop {
+			return worker.abortStop("subset", err)
 		}
 		return err
 	}
@@ -199,141 +2893,658 @@ func (worker *SQLDiffWorker) run() error {
 		return topo.ErrInterrupted
 	}
 
-	// third phase: diff
-	if err := worker.diff(); err != nil {
-		return err
+	// let the superset slave replicate past the subset slave. Both
+	// slaves stop at the same position with a StopPosition, and a
+	// subset slave whose replication was already stopped is already
+	// behind, so there is no need to wait then.
+	if worker.options.StopPosition.IsZero() && worker.stoppedReplication(worker.subset.alias) {
+		if err := worker.sleep(catchUpDelay); err != nil {
+			return err
+		}
 	}
 
+	// stop replication on superset slave
+	if err := worker.stopReplication("superset", worker.superset.alias); err != nil {
+		if worker.options.AtomicStop {
+			return worker.abortStop("superset", err)
+		}
+		return err
+	}
+	if worker.options.CompensateLag > 0 {
+		return worker.compensateLag()
+	}
 	return nil
 }
 
-// findTargets phase:
-// - find one rdonly in superset
-// - find one rdonly in subset
-// - mark them all as 'checker' pointing back to us
-func (worker *SQLDiffWorker) findTargets() error {
-	worker.setState(sqlDiffFindTargets)
+// compensateLag compares the positions of both stopped slaves, and if
+// the subset slave is behind, restarts it until it reaches the
+// superset slave position, for up to the CompensateLag option. If it
+// doesn't make it, or replication was stopped by someone else and we
+// can't restart it, the diff still runs with the lag recorded as a
+// caveat, in the status and in the differences log.
+func (worker *SQLDiffWorker) compensateLag() error {
+	worker.mu.Lock()
+	worker.lagCaveat = ""
+	worker.mu.Unlock()
 
-	// find an appropriate endpoint in superset
-	var err error
-	worker.superset.alias, err = findChecker(worker.ctx, worker.wr, worker.cleaner, worker.cell, worker.superset.Keyspace, worker.superset.Shard)
+	release, err := worker.acquireRPC()
 	if err != nil {
 		return err
 	}
-
-	// find an appropriate endpoint in subset
-	worker.subset.alias, err = findChecker(worker.ctx, worker.wr, worker.cleaner, worker.cell, worker.subset.Keyspace, worker.subset.Shard)
+	defer release()
+	supersetTablet, err := worker.wr.TopoServer().GetTablet(worker.superset.alias)
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-// synchronizeReplication phase:
-// 1 - ask the subset slave to stop replication
-// 2 - sleep for 5 seconds
-// 3 - ask the superset slave to stop replication
-// Note this is not 100% correct, but good enough for now
-func (worker *SQLDiffWorker) synchronizeReplication() error {
-	worker.setState(sqlDiffSynchronizeReplication)
-
-	// stop replication on subset slave
-	worker.wr.Logger().Infof("Stopping replication on subset slave %v", worker.subset.alias)
 	subsetTablet, err := worker.wr.TopoServer().GetTablet(worker.subset.alias)
 	if err != nil {
 		return err
 	}
 	ctx, cancel := context.WithTimeout(worker.ctx, 60*time.Second)
-	err = worker.wr.TabletManagerClient().StopSlave(ctx, subsetTablet)
+	supersetStatus, err := worker.wr.TabletManagerClient().SlaveStatus(ctx, supersetTablet)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("Cannot get slave status for %v: %v", worker.superset.alias, err)
+	}
+	subsetStatus, err := worker.wr.TabletManagerClient().SlaveStatus(ctx, subsetTablet)
 	cancel()
 	if err != nil {
-		return fmt.Errorf("Cannot stop slave %v: %v", worker.subset.alias, err)
+		return fmt.Errorf("Cannot get slave status for %v: %v", worker.subset.alias, err)
 	}
-	if worker.checkInterrupted() {
-		return topo.ErrInterrupted
+
+	supersetPosition, subsetPosition := supersetStatus.Position, subsetStatus.Position
+	switch {
+	case subsetPosition.AtLeast(supersetPosition):
+		worker.wr.Logger().Infof("Subset slave at %v is not behind superset slave at %v", subsetPosition, supersetPosition)
+		return nil
+	case !supersetPosition.AtLeast(subsetPosition):
+		worker.setLagCaveat(fmt.Sprintf("subset slave %v at %v and superset slave %v at %v have positions that can't be compared, lag was not compensated", worker.subset.alias, subsetPosition, worker.superset.alias, supersetPosition))
+		return nil
+	}
+	if _, err := worker.cleaner.GetActionByName(wrangler.StartSlaveActionName, worker.subset.alias.String()); err != nil {
+		worker.setLagCaveat(fmt.Sprintf("subset slave %v at %v is behind superset slave %v at %v, and replication wasn't stopped by us, so it was not restarted to catch up", worker.subset.alias, subsetPosition, worker.superset.alias, supersetPosition))
+		return nil
 	}
 
-	// change the cleaner actions from ChangeSlaveType(rdonly)
-	// to StartSlave() + ChangeSlaveType(spare)
-	wrangler.RecordStartSlaveAction(worker.cleaner, subsetTablet)
-	action, err := wrangler.FindChangeSlaveTypeActionByTarget(worker.cleaner, worker.subset.alias)
-	if err != nil {
-		return fmt.Errorf("cannot find ChangeSlaveType action for %v: %v", worker.subset.alias, err)
+	logger := worker.tabletLogger(subsetTablet)
+	logger.Infof("Subset slave at %v is behind superset slave at %v, letting it catch up for up to %v", subsetPosition, supersetPosition, worker.options.CompensateLag)
+	ctx, cancel = context.WithTimeout(worker.ctx, worker.options.CompensateLag+60*time.Second)
+	defer cancel()
+	if err := worker.wr.TabletManagerClient().StartSlave(ctx, subsetTablet); err != nil {
+		return fmt.Errorf("Cannot start slave %v to catch up: %v", worker.subset.alias, err)
+	}
+	stoppedAt, err := worker.wr.TabletManagerClient().StopSlaveMinimum(ctx, subsetTablet, supersetPosition, worker.options.CompensateLag)
+	if err == nil {
+		logger.Infof("Subset slave caught up, replication stopped at %v", stoppedAt.Position)
+		return nil
 	}
-	action.TabletType = topo.TYPE_SPARE
 
-	// sleep for a few seconds
-	time.Sleep(5 * time.Second)
-	if worker.checkInterrupted() {
-		return topo.ErrInterrupted
+	// the slave is still running, stop it where it is
+	logger.Warningf("Subset slave didn't catch up with %v: %v", supersetPosition, err)
+	if err := worker.wr.TabletManagerClient().StopSlave(ctx, subsetTablet); err != nil {
+		return fmt.Errorf("Cannot stop slave %v after it failed to catch up: %v", worker.subset.alias, err)
+	}
+	if status, err := worker.wr.TabletManagerClient().SlaveStatus(ctx, subsetTablet); err == nil {
+		subsetPosition = status.Position
 	}
+	worker.setLagCaveat(fmt.Sprintf("subset slave %v only reached %v in %v, behind superset slave %v at %v", worker.subset.alias, subsetPosition, worker.options.CompensateLag, worker.superset.alias, supersetPosition))
+	return nil
+}
 
-	// stop replication on superset slave
-	worker.wr.Logger().Infof("Stopping replication on superset slave %v", worker.superset.alias)
-	supersetTablet, err := worker.wr.TopoServer().GetTablet(worker.superset.alias)
+// setLagCaveat records and logs why the lag between the slaves was not
+// compensated.
+func (worker *SQLDiffWorker) setLagCaveat(caveat string) {
+	worker.wr.Logger().Warningf("Proceeding with the diff, rows missing from the subset may be replication lag: %v", caveat)
+	worker.mu.Lock()
+	worker.lagCaveat = caveat
+	worker.mu.Unlock()
+}
+
+// tabletLogger returns a logger that adds the tablet alias, keyspace
+// and shard fields to the worker log messages about the tablet.
+func (worker *SQLDiffWorker) tabletLogger(tablet *topo.TabletInfo) logutil.Logger {
+	return logutil.NewFieldsLogger(logutil.Fields{
+		"tablet_alias": tablet.Alias,
+		"keyspace":     tablet.Keyspace,
+		"shard":        tablet.Shard,
+	}, worker.wr.Logger())
+}
+
+// abortStop restarts replication on the slaves it was stopped on,
+// after stopping it on the named one failed with stopErr, so neither
+// side is left stopped while the diff doesn't run. See AtomicStop.
+func (worker *SQLDiffWorker) abortStop(name string, stopErr error) error {
+	worker.wr.Logger().Errorf("Stopping replication on %v slave failed, restarting it where it was stopped: %v", name, stopErr)
+	for _, alias := range []topo.TabletAlias{worker.subset.alias, worker.superset.alias} {
+		if err := worker.restartReplication(alias); err != nil {
+			return fmt.Errorf("diff not run, replication could not be stopped on both sides: %v slave: %v, and restarting replication failed, it will be retried by the cleanup: %v", name, stopErr, err)
+		}
+	}
+	return fmt.Errorf("diff not run, replication could not be stopped on both sides: %v slave: %v, replication was restarted where it had been stopped", name, stopErr)
+}
+
+// stopReplication stops replication on the provided slave, and
+// changes its cleaner actions from ChangeSlaveType(rdonly) to
+// StartSlave() + ChangeSlaveType(spare). If replication is already
+// stopped (for instance after a previous run failed to clean up),
+// it is left alone, and no StartSlave() action is recorded, as we
+// shouldn't restart a slave we didn't stop.
+// The cleaner actions are changed *before* stopping replication, so
+// that even if we die in the middle, the slave is restarted.
+func (worker *SQLDiffWorker) stopReplication(name string, alias topo.TabletAlias) error {
+	_, err := worker.stopReplicationAt(name, alias, worker.options.StopPosition, true)
+	return err
+}
+
+// stopReplicationAt is stopReplication stopping the slave at or after
+// stopPos if it is set. It returns the position the slave stopped
+// at, or was already stopped at, and a zero position when stopPos is
+// not set and the slave was stopped, as StopSlave doesn't report it.
+// If pastIsError is set, a slave already past stopPos is an error, as
+// it can't go back to it.
+func (worker *SQLDiffWorker) stopReplicationAt(name string, alias topo.TabletAlias, stopPos myproto.ReplicationPosition, pastIsError bool) (myproto.ReplicationPosition, error) {
+	release, err := worker.acquireRPC()
 	if err != nil {
-		return err
+		return myproto.ReplicationPosition{}, err
 	}
-	ctx, cancel = context.WithTimeout(worker.ctx, 60*time.Second)
-	err = worker.wr.TabletManagerClient().StopSlave(ctx, supersetTablet)
+	defer release()
+	tablet, err := worker.wr.TopoServer().GetTablet(alias)
+	if err != nil {
+		return myproto.ReplicationPosition{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(worker.ctx, 60*time.Second)
+	status, err := worker.wr.TabletManagerClient().SlaveStatus(ctx, tablet)
 	cancel()
 	if err != nil {
-		return fmt.Errorf("Cannot stop slave %v: %v", worker.superset.alias, err)
+		return myproto.ReplicationPosition{}, fmt.Errorf("Cannot get slave status for %v: %v", alias, err)
 	}
 
-	// change the cleaner actions from ChangeSlaveType(rdonly)
-	// to StartSlave() + ChangeSlaveType(spare)
-	wrangler.RecordStartSlaveAction(worker.cleaner, supersetTablet)
-	action, err = wrangler.FindChangeSlaveTypeActionByTarget(worker.cleaner, worker.superset.alias)
+	// the tablet won't be replicating for a while, let it
+	// go back to spare
+	action, err := wrangler.FindChangeSlaveTypeActionByTarget(worker.cleaner, alias)
 	if err != nil {
-		return fmt.Errorf("cannot find ChangeSlaveType action for %v: %v", worker.superset.alias, err)
+		return myproto.ReplicationPosition{}, fmt.Errorf("cannot find ChangeSlaveType action for %v: %v", alias, err)
 	}
 	action.TabletType = topo.TYPE_SPARE
 
-	return nil
-}
+	logger := worker.tabletLogger(tablet)
+	if !status.SlaveRunning() {
+		logger.Warningf("Replication is already stopped on %v slave, not stopping or restarting it", name)
+		return status.Position, nil
+	}
+	if pastIsError && !stopPos.IsZero() && status.Position.AtLeast(stopPos) && !status.Position.Equal(stopPos) {
+		return myproto.ReplicationPosition{}, fmt.Errorf("%v slave %v is already at %v, past the stop position %v", name, alias, status.Position, stopPos)
+	}
 
-// diff phase: will create a list of messages regarding the diff.
-// - get the schema on all checkers
-// - if some table schema mismatches, record them (use existing schema diff tools).
-// - for each table in destination, run a diff pipeline.
+	wrangler.RecordStartSlaveAction(worker.cleaner, tablet)
+	logger.Infof("Stopping replication on %v slave", name)
+	if !stopPos.IsZero() {
+		waitTime := worker.options.StopPositionWaitTime
+		if waitTime == 0 {
+			waitTime = 30 * time.Second
+		}
+		ctx, cancel = context.WithTimeout(worker.ctx, waitTime+30*time.Second)
+		defer cancel()
+		stoppedAt, err := worker.wr.TabletManagerClient().StopSlaveMinimum(ctx, tablet, stopPos, waitTime)
+		if err != nil {
+			return myproto.ReplicationPosition{}, fmt.Errorf("StopSlaveMinimum for %v at %v failed: %v", alias, stopPos, err)
+		}
+		if pastIsError && !stoppedAt.Position.Equal(stopPos) {
+			logger.Warningf("Replication stopped on %v slave at %v, past the stop position %v", name, stoppedAt.Position, stopPos)
+			return stoppedAt.Position, nil
+		}
+		logger.Infof("Replication stopped on %v slave at %v", name, stoppedAt.Position)
+		return stoppedAt.Position, nil
+	}
+	ctx, cancel = context.WithTimeout(worker.ctx, 60*time.Second)
+	defer cancel()
+	if err := worker.wr.TabletManagerClient().StopSlave(ctx, tablet); err != nil {
+		return myproto.ReplicationPosition{}, fmt.Errorf("Cannot stop slave %v: %v", alias, err)
+	}
+	return myproto.ReplicationPosition{}, nil
+}
 
-func (worker *SQLDiffWorker) diff() error {
-	worker.setState(sqlDiffRunning)
+// diff phase: runs the diff pipeline of both queries. If the
+// CheckSchema option is set, the schema drift between the queried
+// tables was recorded before by checkSchema.
+//
+// If keys is set, only the rows with these keys are compared. If the
+// RerunOnDifference option is set, the keys of the rows found
+// different are returned.
+func (worker *SQLDiffWorker) diff(keys map[string]bool) (map[string]bool, error) {
+	worker.setState(sqlDiffRunning, "replication synchronized")
 
 	// run the diff
-	worker.wr.Logger().Infof("Running the diffs...")
+	worker.wr.Logger().Infof("Running the diffs, checking %v...", worker.direction())
+
+	var positions map[topo.TabletAlias]myproto.ReplicationPosition
+	if worker.options.StrictConsistency {
+		var err error
+		positions, err = worker.replicationPositions()
+		if err != nil {
+			return nil, categorize(SQLDiffErrorRPC, err)
+		}
+	}
+
+	// the confirmation re-runs only read their keys anyway
+	if worker.options.ChecksumBlockSize > 0 && keys == nil {
+		restore, err := worker.scopeToMismatchedBlocks()
+		if err != nil {
+			return nil, err
+		}
+		if restore == nil {
+			if positions != nil {
+				if err := worker.checkReplicationPositions(positions); err != nil {
+					return nil, err
+				}
+			}
+			worker.wr.Logger().Infof("No difference found checking %v, all the block checksums match", worker.direction())
+			return nil, nil
+		}
+		defer restore()
+	}
+	if worker.options.ChecksumOnly {
+		return nil, worker.compareResultChecksums(positions)
+	}
+	if worker.options.MaterializeSuperset {
+		restore, err := worker.materializeSuperset()
+		if err != nil {
+			return nil, err
+		}
+		defer restore()
+	}
 
-	supersetQueryResultReader, err := NewQueryResultReaderForTablet(worker.ctx, worker.wr.TopoServer(), worker.superset.alias, worker.superset.SQL)
+	ctx := worker.diffContext()
+	supersetQueryResultReader, supersetCancel, err := worker.openDiffReader(ctx, "superset", worker.superset)
 	if err != nil {
-		worker.wr.Logger().Errorf("NewQueryResultReaderForTablet(superset) failed: %v", err)
-		return err
+		return nil, categorize(SQLDiffErrorRPC, err)
 	}
+	defer supersetCancel()
 	defer supersetQueryResultReader.Close()
 
-	subsetQueryResultReader, err := NewQueryResultReaderForTablet(worker.ctx, worker.wr.TopoServer(), worker.subset.alias, worker.subset.SQL)
+	subsetQueryResultReader, subsetCancel, err := worker.openDiffReader(ctx, "subset", worker.subset)
 	if err != nil {
-		worker.wr.Logger().Errorf("NewQueryResultReaderForTablet(subset) failed: %v", err)
-		return err
+		return nil, categorize(SQLDiffErrorRPC, err)
 	}
+	defer subsetCancel()
 	defer subsetQueryResultReader.Close()
+	worker.wr.Logger().Infof("Superset schema: %v", SchemaFingerprint(supersetQueryResultReader.Fields))
+	worker.wr.Logger().Infof("Subset schema: %v", SchemaFingerprint(subsetQueryResultReader.Fields))
 
-	differ, err := NewRowSubsetDiffer(supersetQueryResultReader, subsetQueryResultReader, 1)
+	// in reverse mode, the superset tablet is the one whose rows
+	// all need to be present on the other side.
+	var differ *RowSubsetDiffer
+	supersetKeyColumns, subsetKeyColumns := worker.keyColumns()
+	switch {
+	case len(supersetKeyColumns) > 0 && worker.options.Reverse:
+		differ, err = NewRowSubsetDifferWithKeyColumns(subsetQueryResultReader, supersetQueryResultReader, subsetKeyColumns, supersetKeyColumns)
+	case len(supersetKeyColumns) > 0:
+		differ, err = NewRowSubsetDifferWithKeyColumns(supersetQueryResultReader, subsetQueryResultReader, supersetKeyColumns, subsetKeyColumns)
+	case worker.options.Reverse:
+		differ, err = NewRowSubsetDiffer(subsetQueryResultReader, supersetQueryResultReader, 1)
+	default:
+		differ, err = NewRowSubsetDiffer(supersetQueryResultReader, subsetQueryResultReader, 1)
+	}
 	if err != nil {
 		worker.wr.Logger().Errorf("NewRowSubsetDiffer() failed: %v", err)
-		return err
+		return nil, err
+	}
+	if err := differ.CompareOnlyColumns(worker.options.CompareColumns); err != nil {
+		worker.wr.Logger().Errorf("CompareOnlyColumns() failed: %v", err)
+		return nil, err
+	}
+	if len(worker.options.CompareColumns) > 0 {
+		worker.wr.Logger().Infof("Only comparing columns %v", worker.options.CompareColumns)
+	}
+	if worker.options.KeysOnly {
+		differ.CompareKeysOnly()
+	}
+	if worker.options.Exact {
+		differ.CompareExactly()
+	}
+	if worker.options.KeyFunc != nil {
+		differ.SetKeyFunc(worker.options.KeyFunc)
+	}
+	if worker.options.Partitioner != nil {
+		differ.SetPartitioner(worker.options.Partitioner)
+	}
+	if worker.superset.TimeZone != "" || worker.subset.TimeZone != "" {
+		supersetZone, err := time.LoadLocation(worker.superset.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid superset time zone: %v", err)
+		}
+		subsetZone, err := time.LoadLocation(worker.subset.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subset time zone: %v", err)
+		}
+		worker.wr.Logger().Infof("Normalizing times to UTC, from %v for the superset and %v for the subset", supersetZone, subsetZone)
+		if worker.options.Reverse {
+			supersetZone, subsetZone = subsetZone, supersetZone
+		}
+		differ.NormalizeTimeZones(supersetZone, subsetZone)
+	}
+	if err := differ.IgnoreColumns(worker.options.IgnoreColumns); err != nil {
+		worker.wr.Logger().Errorf("IgnoreColumns() failed: %v", err)
+		return nil, err
+	}
+	if len(worker.options.IgnoreColumns) > 0 {
+		worker.wr.Logger().Infof("Not comparing columns %v", worker.options.IgnoreColumns)
+	}
+	if err := differ.SetTolerances(worker.options.Tolerances); err != nil {
+		worker.wr.Logger().Errorf("SetTolerances() failed: %v", err)
+		return nil, err
+	}
+	if err := differ.SetJSONColumns(worker.options.JSONColumns); err != nil {
+		worker.wr.Logger().Errorf("SetJSONColumns() failed: %v", err)
+		return nil, err
+	}
+	if worker.options.Canonicalizer != nil {
+		differ.SetCanonicalizer(worker.options.Canonicalizer)
+	}
+	if len(worker.options.Transforms) > 0 {
+		// in reverse mode, the worker superset is the differ subset
+		setTransforms := differ.SetSupersetTransforms
+		if worker.options.Reverse {
+			setTransforms = differ.SetSubsetTransforms
+		}
+		if err := setTransforms(worker.options.Transforms); err != nil {
+			worker.wr.Logger().Errorf("SetTransforms() failed: %v", err)
+			return nil, err
+		}
+	}
+	if worker.options.MaxBufferBytes > 0 {
+		differ.SetMaxBufferBytes(worker.options.MaxBufferBytes)
+		differ.SetSpillDir(worker.options.SpillDir)
+	}
+	if worker.options.MaxRows > 0 {
+		differ.SetMaxRows(worker.options.MaxRows)
+	}
+	if keys != nil {
+		worker.wr.Logger().Infof("Only comparing rows for %v keys", len(keys))
+		differ.FilterKeys(keys)
+	}
+	if worker.options.RerunOnDifference {
+		differ.RecordDifferentKeys()
+	}
+	if worker.options.VerifyChecksum {
+		differ.VerifyChecksum()
+	}
+	if worker.options.SamplePercent != 0 {
+		if err := differ.Sample(worker.options.SamplePercent); err != nil {
+			return nil, err
+		}
+		worker.wr.Logger().Infof("Only comparing a %v%% sample of the rows", worker.options.SamplePercent)
 	}
 
-	report, err := differ.Go(worker.wr.Logger())
+	// the sink goroutine is only started once nothing can fail
+	// before the diff, which closes it
+	onDifference := worker.options.OnDifference
+	var sink *bufferedDifferenceSink
+	if worker.options.DifferenceSink != nil {
+		sink = newBufferedDifferenceSink(worker.ctx, worker.options.DifferenceSink, worker.options.DifferenceSinkBuffer)
+		if callback := onDifference; callback != nil {
+			onDifference = func(record DifferenceRecord) {
+				callback(record)
+				sink.publish(record)
+			}
+		} else {
+			onDifference = sink.publish
+		}
+	}
+	if onDifference != nil {
+		if worker.options.Reverse {
+			// the differ superset is the worker subset
+			differ.SetOnDifference(func(record DifferenceRecord) {
+				record.Superset, record.Subset = record.Subset, record.Superset
+				switch record.Kind {
+				case DifferenceMissingInSuperset:
+					record.Kind = DifferenceMissingInSubset
+				case DifferenceMissingInSubset:
+					record.Kind = DifferenceMissingInSuperset
+				}
+				onDifference(record)
+			})
+		} else {
+			differ.SetOnDifference(onDifference)
+		}
+	}
+
+	report, err := differ.Go(ctx, worker.wr.Logger())
+	worker.mu.Lock()
+	if err != nil {
+		worker.interruptedRows = worker.processedRows + report.processedRows
+		if keys != nil {
+			worker.interruptedRows = worker.confirmedRows + report.processedRows
+		}
+	}
+	worker.supersetBytesRead += supersetQueryResultReader.BytesRead()
+	worker.subsetBytesRead += subsetQueryResultReader.BytesRead()
+	worker.mu.Unlock()
+	if sink != nil {
+		published, serr := sink.close()
+		worker.wr.Logger().Infof("Published %v differences to the difference sink", published)
+		if serr != nil && err == nil {
+			worker.wr.Logger().Errorf("Difference sink failed: %v", serr)
+			return nil, categorize(SQLDiffErrorOther, fmt.Errorf("difference sink failed, not all differences were published: %v", serr))
+		}
+	}
+	if err == nil {
+		// the readers were drained, they should close cleanly
+		if cerr := supersetQueryResultReader.Close(); cerr != nil {
+			worker.wr.Logger().Errorf("Superset reader ended abnormally after the diff: %v", cerr)
+			return nil, categorize(SQLDiffErrorRPC, fmt.Errorf("superset reader ended abnormally, the diff result can't be trusted: %v", cerr))
+		}
+		if cerr := subsetQueryResultReader.Close(); cerr != nil {
+			worker.wr.Logger().Errorf("Subset reader ended abnormally after the diff: %v", cerr)
+			return nil, categorize(SQLDiffErrorRPC, fmt.Errorf("subset reader ended abnormally, the diff result can't be trusted: %v", cerr))
+		}
+	}
+	if err == nil {
+		worker.mu.Lock()
+		worker.counts = newSQLDiffCounts(report, worker.options.Reverse).add(worker.carried)
+		worker.partitions = report.TopPartitions(sqlDiffTopPartitions)
+		if keys != nil {
+			worker.confirmedRows += report.ProcessedRows()
+		} else {
+			worker.processedRows += report.ProcessedRows()
+		}
+		worker.jsonNormalized += report.jsonNormalizedValues
+		worker.mu.Unlock()
+	}
+	if err == nil && positions != nil {
+		if err := worker.checkReplicationPositions(positions); err != nil {
+			return nil, err
+		}
+	}
+	var countErr error
+	if err == nil && worker.options.CountAssertion.Kind != "" && keys == nil {
+		countErr = worker.checkCounts(report)
+	}
 	switch {
+	case err != nil && worker.diffInterrupted():
+		// only the diff was interrupted, to be resumed, the
+		// readers may have failed first
+		worker.carryOver(report)
+		return nil, topo.ErrInterrupted
+	case err == topo.ErrInterrupted:
+		return nil, err
+	case isVerificationError(err):
+		worker.wr.Logger().Errorf("Differ.Go verification failed: %v", err)
+		return nil, categorize(SQLDiffErrorInconsistent, err)
 	case err != nil:
 		worker.wr.Logger().Errorf("Differ.Go failed: %v", err)
-	case report.HasDifferences():
-		worker.wr.Logger().Infof("Found differences: %v", report.String())
+		return nil, categorize(SQLDiffErrorRPC, explainMessageTooLarge(err))
+	case report.HasDifferences() || worker.carried != (sqlDiffCounts{}):
+		counts := newSQLDiffCounts(report, worker.options.Reverse).add(worker.carried)
+		worker.wr.Logger().Infof("Found differences checking %v: %v (%v)", worker.direction(), counts, report.String())
+		if len(worker.schemaDrift) > 0 {
+			worker.wr.Logger().Warningf("The differences may be a consequence of the schema drift: %v", strings.Join(worker.schemaDrift, "; "))
+		}
+		if worker.lagCaveat != "" {
+			worker.wr.Logger().Warningf("The rows missing from the subset may be replication lag: %v", worker.lagCaveat)
+		}
+		return differ.DifferentKeys(), categorize(SQLDiffErrorDifferences, fmt.Errorf("found differences checking %v: %v (%v)", worker.direction(), counts, report.String()))
+	case countErr != nil:
+		return nil, countErr
 	default:
-		worker.wr.Logger().Infof("No difference found (%v rows processed, %v qps)", report.processedRows, report.processingQPS)
+		worker.wr.Logger().Infof("No difference found checking %v (%v rows processed, %v qps)", worker.direction(), report.processedRows, report.processingQPS)
+		if worker.options.Delta && keys == nil {
+			worker.recordHighWaterKey(report.highWaterKey)
+		}
+	}
+
+	return nil, nil
+}
+
+// replicationPositions returns the replication positions of the
+// tablets of the worker, for StrictConsistency.
+func (worker *SQLDiffWorker) replicationPositions() (map[topo.TabletAlias]myproto.ReplicationPosition, error) {
+	positions := make(map[topo.TabletAlias]myproto.ReplicationPosition)
+	for _, spec := range []SourceSpec{worker.superset, worker.subset} {
+		if !spec.stopsReplication() {
+			continue
+		}
+		release, err := worker.acquireRPC()
+		if err != nil {
+			return nil, err
+		}
+		tablet, err := worker.wr.TopoServer().GetTablet(spec.alias)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(worker.ctx, 60*time.Second)
+		status, err := worker.wr.TabletManagerClient().SlaveStatus(ctx, tablet)
+		cancel()
+		release()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot get slave status for %v: %v", spec.alias, err)
+		}
+		positions[spec.alias] = status.Position
 	}
+	return positions, nil
+}
 
+// checkReplicationPositions fails if the replication position of a
+// tablet moved since the provided positions were read.
+func (worker *SQLDiffWorker) checkReplicationPositions(before map[topo.TabletAlias]myproto.ReplicationPosition) error {
+	after, err := worker.replicationPositions()
+	if err != nil {
+		return categorize(SQLDiffErrorRPC, err)
+	}
+	for alias, position := range before {
+		if !after[alias].Equal(position) {
+			return categorize(SQLDiffErrorInconsistent, fmt.Errorf("replication position of tablet %v moved from %v to %v during the diff, its data was not static", alias, position, after[alias]))
+		}
+	}
+	worker.wr.Logger().Infof("Replication positions didn't move during the diff: %v", before)
 	return nil
 }
+
+// openReader opens a QueryResultReader for the spec. The reader
+// context is derived from the provided one, with the spec
+// QueryTimeout, or the worker QueryTimeout, if any. The returned
+// function must be called to release the context once the reader is
+// closed. Errors are categorized: MySQL errors are surfaced with the
+// side that caused them, other errors are RPC errors.
+func (worker *SQLDiffWorker) openReader(parent context.Context, name string, spec SourceSpec) (*QueryResultReader, context.CancelFunc, error) {
+	if spec.AllShards {
+		return worker.openMergedReader(parent, name, spec)
+	}
+	timeout := spec.QueryTimeout
+	if timeout == 0 {
+		timeout = worker.options.QueryTimeout
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+
+	release, err := worker.acquireRPC()
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if !spec.hasTablet() {
+		reader, err := worker.openExternalReader(ctx, spec)
+		release()
+		if err != nil {
+			cancel()
+			worker.wr.Logger().Errorf("Opening the %v query on %v failed: %v", name, spec.name(), err)
+			if qerr := newSQLDiffQueryError(name, err); qerr != nil {
+				return nil, nil, categorize(SQLDiffErrorQuery, qerr)
+			}
+			return nil, nil, categorize(SQLDiffErrorRPC, err)
+		}
+		return reader, cancel, nil
+	}
+
+	newReader := worker.options.NewQueryResultReader
+	if newReader == nil {
+		newReader = NewQueryResultReaderForTablet
+	}
+	reader, err := newReader(ctx, worker.wr.TopoServer(), spec.alias, spec.SQL, worker.options.LowPriority)
+	release()
+	if err != nil {
+		cancel()
+		logutil.NewFieldsLogger(logutil.Fields{
+			"tablet_alias": spec.alias,
+			"keyspace":     spec.Keyspace,
+			"shard":        spec.Shard,
+		}, worker.wr.Logger()).Errorf("NewQueryResultReaderForTablet(%v) failed: %v", name, err)
+		if qerr := newSQLDiffQueryError(name, err); qerr != nil {
+			return nil, nil, categorize(SQLDiffErrorQuery, qerr)
+		}
+		return nil, nil, categorize(SQLDiffErrorRPC, explainMessageTooLarge(err))
+	}
+	return reader, cancel, nil
+}
+
+// openDiffReader opens the reader of a side for the diff, through its
+// ResumableReader if the diff can be resumed.
+func (worker *SQLDiffWorker) openDiffReader(ctx context.Context, name string, spec SourceSpec) (*QueryResultReader, context.CancelFunc, error) {
+	var reader *QueryResultReader
+	var cancel context.CancelFunc
+	var err error
+	if resumable, ok := worker.resumables[name]; ok {
+		reader, cancel, err = resumable.Open(ctx)
+	} else {
+		reader, cancel, err = worker.openReader(ctx, name, spec)
+	}
+	if err != nil || worker.options.MaxLookahead <= 0 {
+		return reader, cancel, err
+	}
+	return NewLookaheadQueryResultReader(reader, worker.options.MaxLookahead), cancel, nil
+}
+
+// openExternalReader opens a QueryResultReader on the vtgate, the
+// external MySQL server or the snapshot of the spec.
+func (worker *SQLDiffWorker) openExternalReader(ctx context.Context, spec SourceSpec) (*QueryResultReader, error) {
+	if spec.Snapshot != "" {
+		return NewQueryResultReaderForSnapshot(ctx, spec.Snapshot)
+	}
+	var qrr *QueryResultReader
+	var err error
+	if spec.VTGate != "" {
+		tabletType := spec.VTGateTabletType
+		if tabletType == "" {
+			tabletType = topo.TYPE_RDONLY
+		}
+		qrr, err = NewQueryResultReaderForVTGate(ctx, spec.VTGate, spec.Keyspace, spec.Shard, tabletType, spec.SQL)
+	} else {
+		var params mysql.ConnectionParams
+		params, err = ParseMySQLDSN(spec.DSN)
+		if err != nil {
+			return nil, err
+		}
+		qrr, err = NewQueryResultReaderForMySQL(ctx, params, worker.options.SQLMode, spec.SQL)
+	}
+	if err != nil || !worker.options.LowPriority {
+		return qrr, err
+	}
+	return NewThrottledQueryResultReader(ctx, qrr, *lowPriorityRowsPerSecond), nil
+}
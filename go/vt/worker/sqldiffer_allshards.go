@@ -0,0 +1,151 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains the AllShards support of the SQLDiffWorker, to
+// read the superset from all the shards of a keyspace, merged into a
+// single stream.
+
+// checkAllShards checks the AllShards option of the specs is used in
+// a supported way.
+func (worker *SQLDiffWorker) checkAllShards() error {
+	if worker.subset.AllShards {
+		return fmt.Errorf("AllShards is only supported for the superset")
+	}
+	spec := worker.superset
+	if !spec.AllShards {
+		return nil
+	}
+	switch {
+	case spec.DSN != "":
+		return fmt.Errorf("AllShards cannot be used with a DSN")
+	case spec.hasTablet() && spec.Sync != SyncSnapshot:
+		return fmt.Errorf("AllShards requires the %q Sync strategy to read from tablets, replication can't be stopped on all the shards together", SyncSnapshot)
+	case worker.options.SameTablet:
+		return fmt.Errorf("AllShards cannot be used with SameTablet")
+	case worker.options.Aggregate:
+		return fmt.Errorf("AllShards cannot be used with Aggregate, the groups of each shard would not be merged")
+	case worker.options.ChecksumBlockSize > 0:
+		return fmt.Errorf("AllShards cannot be used with ChecksumBlockSize")
+	}
+	return nil
+}
+
+// findAllShardsTargets lists the shards of the superset keyspace, and
+// picks a checker tablet in each of them, unless the superset is read
+// through a vtgate. The tablet of the first shard is the superset
+// alias, used to read the schema.
+func (worker *SQLDiffWorker) findAllShardsTargets(ctx context.Context, cleaner *wrangler.Cleaner, selector TargetSelector) error {
+	shards, err := worker.wr.TopoServer().GetShardNames(worker.superset.Keyspace)
+	if err != nil {
+		return fmt.Errorf("cannot list the shards of keyspace %v: %v", worker.superset.Keyspace, err)
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("keyspace %v has no shards", worker.superset.Keyspace)
+	}
+	sort.Strings(shards)
+
+	var aliases []topo.TabletAlias
+	if worker.superset.hasTablet() {
+		for _, shard := range shards {
+			alias, err := worker.findChecker(ctx, cleaner, worker.superset, shard, selector)
+			if err != nil {
+				return err
+			}
+			aliases = append(aliases, alias)
+		}
+	}
+	worker.wr.Logger().Infof("Reading superset from the %v shards of %v: %v", len(shards), worker.superset.Keyspace, shards)
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	worker.superset.shards = shards
+	worker.superset.shardAliases = aliases
+	if len(aliases) > 0 {
+		worker.superset.alias = aliases[0]
+	}
+	return nil
+}
+
+// openMergedReader opens a reader on each shard of an AllShards spec,
+// and merges them in key order. The returned function releases the
+// contexts of all the readers.
+func (worker *SQLDiffWorker) openMergedReader(parent context.Context, name string, spec SourceSpec) (*QueryResultReader, context.CancelFunc, error) {
+	if len(spec.shards) == 0 {
+		return nil, nil, fmt.Errorf("the shards of the %v keyspace %v were not listed", name, spec.Keyspace)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	cancels := []context.CancelFunc{cancel}
+	cancelAll := func() {
+		for _, c := range cancels {
+			c()
+		}
+	}
+	var readers []*QueryResultReader
+	closeAll := func() {
+		for _, reader := range readers {
+			reader.Close()
+		}
+		cancelAll()
+	}
+	for i, shard := range spec.shards {
+		shardSpec := spec
+		shardSpec.AllShards = false
+		shardSpec.Shard = shard
+		if len(spec.shardAliases) > 0 {
+			shardSpec.alias = spec.shardAliases[i]
+		}
+		reader, readerCancel, err := worker.openReader(ctx, name, shardSpec)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		readers = append(readers, reader)
+		cancels = append(cancels, readerCancel)
+	}
+
+	keyColumns, _ := worker.keyColumns()
+	keyIndexes, err := mergeKeyIndexes(readers[0].Fields, keyColumns, worker.keyCount())
+	if err == nil {
+		var merged *QueryResultReader
+		merged, err = NewMergedQueryResultReader(ctx, readers, keyIndexes)
+		if err == nil {
+			return merged, cancelAll, nil
+		}
+	}
+	closeAll()
+	return nil, nil, fmt.Errorf("cannot merge the %v shards: %v", name, err)
+}
+
+// mergeKeyIndexes returns the indexes of the key columns in fields, or
+// the first keyCount columns if keyColumns is empty.
+func mergeKeyIndexes(fields []mproto.Field, keyColumns []string, keyCount int) ([]int, error) {
+	if len(keyColumns) == 0 {
+		indexes := make([]int, keyCount)
+		for i := range indexes {
+			indexes[i] = i
+		}
+		return indexes, nil
+	}
+	indexes := make([]int, len(keyColumns))
+	for i, column := range keyColumns {
+		indexes[i] = fieldIndex(fields, column)
+		if indexes[i] == -1 {
+			return nil, fmt.Errorf("key column %v not found in %v", column, SchemaFingerprint(fields))
+		}
+	}
+	return indexes, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+var allShardsFields = []mproto.Field{
+	{Name: "id", Type: mproto.VT_LONGLONG},
+	{Name: "msg", Type: mproto.VT_VARCHAR},
+}
+
+func TestMergedQueryResultReader(t *testing.T) {
+	readers := []*QueryResultReader{
+		newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"}, []string{"10", "b"})),
+		newFakeQueryResultReader(allShardsFields, makeRows([]string{"2", "c"}, []string{"3", "d"}, []string{"11", "e"})),
+		newFakeQueryResultReader(allShardsFields, nil),
+	}
+	merged, err := NewMergedQueryResultReader(context.Background(), readers, []int{0})
+	if err != nil {
+		t.Fatalf("NewMergedQueryResultReader failed: %v", err)
+	}
+	var got []string
+	rr := NewRowReader(merged)
+	for {
+		row, err := rr.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if row == nil {
+			break
+		}
+		got = append(got, row[1].String())
+	}
+	if fmt.Sprint(got) != "[a c d b e]" {
+		t.Errorf("merged rows = %v, want [a c d b e]", got)
+	}
+	if err := merged.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	other := newFakeQueryResultReader(allShardsFields[:1], nil)
+	if _, err := NewMergedQueryResultReader(context.Background(), []*QueryResultReader{readers[0], other}, []int{0}); err == nil {
+		t.Errorf("merging readers with different fields should have failed")
+	}
+}
+
+func TestMergedQueryResultReaderClosedEarly(t *testing.T) {
+	// enough rows for the merge to block on its full output
+	var values [][]string
+	for i := 0; i < 20*mysqlReaderBatchSize; i++ {
+		values = append(values, []string{fmt.Sprint(i), "a"})
+	}
+	readers := []*QueryResultReader{
+		newFakeQueryResultReader(allShardsFields, makeRows(values...)),
+		newFakeQueryResultReader(allShardsFields, nil),
+	}
+	merged, err := NewMergedQueryResultReader(context.Background(), readers, []int{0})
+	if err != nil {
+		t.Fatalf("NewMergedQueryResultReader failed: %v", err)
+	}
+	<-merged.Output
+
+	// the error is read while the merge is still stopping
+	errs := make(chan error)
+	go func() {
+		for {
+			if err := merged.Error(); err != nil {
+				errs <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err := merged.Close(); err == nil {
+		t.Errorf("Close of an unfinished merged reader should have failed")
+	}
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "merged reader closed") {
+			t.Errorf("Error after Close = %v, want the merged reader closed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("the merge didn't stop after Close")
+	}
+}
+
+func TestSqlDifferAllShards(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	sql := "select id, msg from t order by id"
+	rows := map[uint32][][]string{
+		1: {{"1", "a"}, {"4", "d"}},
+		2: {{"2", "b"}, {"3", "c"}},
+		3: {{"2", "b"}, {"4", "d"}},
+	}
+	factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+		return newFakeQueryResultReader(allShardsFields, makeRows(rows[tabletAlias.Uid]...)), nil
+	}
+	superset := SourceSpec{
+		Keyspace:     "ks1",
+		SQL:          sql,
+		Sync:         SyncSnapshot,
+		AllShards:    true,
+		shards:       []string{"-80", "80-"},
+		shardAliases: []topo.TabletAlias{{Cell: "cell1", Uid: 1}, {Cell: "cell1", Uid: 2}},
+	}
+	subset := SourceSpec{Keyspace: "ks2", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 3}}
+	wrk := NewSQLDiffWorker(wr, "cell1", superset, subset, SQLDiffOptions{NewQueryResultReader: factory}).(*SQLDiffWorker)
+	if err := wrk.checkAllShards(); err != nil {
+		t.Fatalf("checkAllShards failed: %v", err)
+	}
+	if _, err := wrk.diff(nil); err != nil {
+		t.Errorf("diff of a subset of the merged shards failed: %v", err)
+	}
+
+	// the subset can't be read from all shards, nor the superset
+	// with replication stopped
+	for _, c := range []struct {
+		superset, subset SourceSpec
+	}{
+		{SourceSpec{Keyspace: "ks1", AllShards: true}, SourceSpec{Keyspace: "ks2", Shard: "0"}},
+		{SourceSpec{Keyspace: "ks1", Shard: "0"}, SourceSpec{Keyspace: "ks2", AllShards: true, Sync: SyncSnapshot}},
+	} {
+		wrk := NewSQLDiffWorker(wr, "cell1", c.superset, c.subset, SQLDiffOptions{}).(*SQLDiffWorker)
+		if err := wrk.checkAllShards(); err == nil {
+			t.Errorf("checkAllShards(%+v, %+v) should have failed", c.superset, c.subset)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"os"
+	"os/user"
+
+	"github.com/youtube/vitess/go/event"
+	"github.com/youtube/vitess/go/vt/worker/events"
+)
+
+// This file contains the audit trail of the SQLDiffWorker: an event
+// dispatched once it reaches a terminal state, syslogged with the
+// other Vitess events.
+
+// auditUser returns the name of the user running the worker.
+func auditUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// auditEvent returns the SQLDiff event recording the outcome of the
+// worker, and its status: the terminal state of the worker, and its
+// error, if any.
+func (worker *SQLDiffWorker) auditEvent() (*events.SQLDiff, string) {
+	config := worker.Config()
+	host, _ := os.Hostname()
+	foundDifferences := worker.FoundDifferences()
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	status := worker.state.String()
+	if worker.err != nil {
+		status += ": " + worker.err.Error()
+	}
+	return &events.SQLDiff{
+		RunID:            worker.runID,
+		Name:             worker.HistoryKey(),
+		User:             auditUser(),
+		Host:             host,
+		SupersetSource:   config.Superset.name(),
+		SupersetSQL:      config.Superset.SQL,
+		SubsetSource:     config.Subset.name(),
+		SubsetSQL:        config.Subset.SQL,
+		StartTime:        worker.startTime,
+		EndTime:          worker.endTime,
+		FoundDifferences: foundDifferences,
+	}, status
+}
+
+// dispatchAuditEvent dispatches the SQLDiff event recording the
+// outcome of the worker, with its terminal state as the status.
+func (worker *SQLDiffWorker) dispatchAuditEvent() {
+	ev, status := worker.auditEvent()
+	event.DispatchUpdate(ev, status)
+}
@@ -0,0 +1,46 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/event"
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/worker/events"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestSqlDifferAuditEvent(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	superset := SourceSpec{Keyspace: "ks1", Shard: "0", SQL: "not a query"}
+	subset := SourceSpec{Keyspace: "ks2", Shard: "0", SQL: "SELECT id FROM t ORDER BY id"}
+	wrk := NewSQLDiffWorker(wr, "cell1", superset, subset, SQLDiffOptions{Name: "audited"}).(*SQLDiffWorker)
+
+	got := make(chan *events.SQLDiff, 1)
+	event.AddListener(func(ev *events.SQLDiff) {
+		if ev.RunID == wrk.RunID() {
+			got <- ev
+		}
+	})
+	wrk.Run()
+
+	select {
+	case ev := <-got:
+		if ev.Name != "audited" || ev.SupersetSource != "ks1/0" || ev.SubsetSource != "ks2/0" || ev.SubsetSQL != subset.SQL {
+			t.Errorf("unexpected event: %+v", ev)
+		}
+		if !strings.HasPrefix(ev.Status, "error: ") || ev.FoundDifferences {
+			t.Errorf("unexpected event outcome: status %q, found differences %v", ev.Status, ev.FoundDifferences)
+		}
+		if ev.StartTime.IsZero() || ev.EndTime.Before(ev.StartTime) {
+			t.Errorf("unexpected event times: %v - %v", ev.StartTime, ev.EndTime)
+		}
+	default:
+		t.Fatalf("no SQLDiff event dispatched")
+	}
+}
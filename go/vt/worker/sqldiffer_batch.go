@@ -0,0 +1,66 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// This file contains the rollup report of a batch of SQLDiffWorker
+// runs.
+
+// DiffBatchReport aggregates the final status of a batch of
+// SQLDiffWorker runs.
+type DiffBatchReport struct {
+	// Checks is the total number of runs.
+	Checks int
+
+	// Clean, Differences, Cancelled and Errors count the runs
+	// that found no difference, found differences (including
+	// violated count assertions), were cancelled, or failed for
+	// another reason.
+	Clean       int
+	Differences int
+	Cancelled   int
+	Errors      int
+
+	// ProcessedRows is the total number of rows processed.
+	ProcessedRows int
+
+	// Duration is the sum of the durations of the runs.
+	Duration time.Duration
+}
+
+// Add adds the final status of a run to the report.
+func (report *DiffBatchReport) Add(status SQLDiffStatus) {
+	report.Checks++
+	switch {
+	case status.ErrorCategory == SQLDiffErrorDifferences, status.ErrorCategory == SQLDiffErrorCountAssertion:
+		report.Differences++
+	case status.ErrorCategory == SQLDiffErrorInterrupted:
+		report.Cancelled++
+	case status.ErrorCategory != SQLDiffErrorNone:
+		report.Errors++
+	default:
+		report.Clean++
+	}
+	report.ProcessedRows += status.ProcessedRows
+	report.Duration += status.Duration
+}
+
+func (report *DiffBatchReport) String() string {
+	return fmt.Sprintf("DiffBatchReport{%v checks, %v clean, %v with differences, %v cancelled, %v errors, %v rows processed, %v total duration}", report.Checks, report.Clean, report.Differences, report.Cancelled, report.Errors, report.ProcessedRows, report.Duration)
+}
+
+// JSON returns the report encoded in JSON.
+func (report *DiffBatchReport) JSON() (string, error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffBatchReport(t *testing.T) {
+	report := &DiffBatchReport{}
+	report.Add(SQLDiffStatus{ProcessedRows: 10, Duration: time.Second})
+	report.Add(SQLDiffStatus{ErrorCategory: SQLDiffErrorDifferences, ProcessedRows: 20, Duration: 2 * time.Second})
+	report.Add(SQLDiffStatus{ErrorCategory: SQLDiffErrorRPC, Duration: time.Second})
+	report.Add(SQLDiffStatus{ErrorCategory: SQLDiffErrorInterrupted})
+
+	want := DiffBatchReport{
+		Checks:        4,
+		Clean:         1,
+		Differences:   1,
+		Cancelled:     1,
+		Errors:        1,
+		ProcessedRows: 30,
+		Duration:      4 * time.Second,
+	}
+	if *report != want {
+		t.Errorf("got %v, want %v", report, want)
+	}
+	got, err := report.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	if wantJSON := `{"Checks":4,"Clean":1,"Differences":1,"Cancelled":1,"Errors":1,"ProcessedRows":30,"Duration":4000000000}`; got != wantJSON {
+		t.Errorf("got JSON %v, want %v", got, wantJSON)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	blproto "github.com/youtube/vitess/go/vt/binlog/proto"
+)
+
+// This file contains a DifferenceSink feeding the differences found by
+// a SQLDiffWorker to the consumers of the update stream.
+
+// CDCDifferenceSink is a DifferenceSink sending each difference as a
+// DML StreamEvent, like the ones of the update stream, for the row's
+// primary key. As with the update stream, the events only carry the
+// key: the consumers look up the row to know if it was inserted,
+// updated or deleted, which reconciles them with its current state.
+type CDCDifferenceSink struct {
+	table     string
+	keyFields []mproto.Field
+	send      func(*blproto.StreamEvent) error
+}
+
+// NewCDCDifferenceSink returns a CDCDifferenceSink for the rows of
+// table, whose primary key is made of keyFields, the leading columns
+// of the diffed queries. The events are sent with send, which is
+// usually the reply function of an update stream consumer.
+func NewCDCDifferenceSink(table string, keyFields []mproto.Field, send func(*blproto.StreamEvent) error) *CDCDifferenceSink {
+	return &CDCDifferenceSink{
+		table:     table,
+		keyFields: keyFields,
+		send:      send,
+	}
+}
+
+// Publish is part of the DifferenceSink interface.
+func (s *CDCDifferenceSink) Publish(record DifferenceRecord) error {
+	row := record.Subset
+	if row == nil {
+		row = record.Superset
+	}
+	if len(row) < len(s.keyFields) {
+		return fmt.Errorf("row has %v columns, less than the %v of the primary key", len(row), len(s.keyFields))
+	}
+	names := make([]string, len(s.keyFields))
+	values := make([]interface{}, len(s.keyFields))
+	for i, field := range s.keyFields {
+		names[i] = field.Name
+		value, err := encodePKValue(field, row[i])
+		if err != nil {
+			return fmt.Errorf("invalid value for primary key column %v: %v", field.Name, err)
+		}
+		values[i] = value
+	}
+	return s.send(&blproto.StreamEvent{
+		Category:   "DML",
+		TableName:  s.table,
+		PKColNames: names,
+		PKValues:   [][]interface{}{values},
+		Timestamp:  time.Now().Unix(),
+	})
+}
+
+// Flush is part of the DifferenceSink interface. The events are sent
+// as they are published, so there is nothing to flush.
+func (s *CDCDifferenceSink) Flush() error {
+	return nil
+}
+
+// encodePKValue encodes a primary key value as the update stream does:
+// an int64 or uint64 for integer columns, bytes otherwise.
+func encodePKValue(field mproto.Field, value sqltypes.Value) (interface{}, error) {
+	switch field.Type {
+	case mproto.VT_TINY, mproto.VT_SHORT, mproto.VT_LONG, mproto.VT_LONGLONG, mproto.VT_INT24:
+		raw := string(value.Raw())
+		if ival, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return ival, nil
+		}
+		return strconv.ParseUint(raw, 10, 64)
+	}
+	return value.Raw(), nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"reflect"
+	"testing"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/sqltypes"
+	blproto "github.com/youtube/vitess/go/vt/binlog/proto"
+)
+
+func TestCDCDifferenceSink(t *testing.T) {
+	var events []*blproto.StreamEvent
+	sink := NewCDCDifferenceSink("t1", []mproto.Field{
+		{Name: "id", Type: mproto.VT_LONGLONG},
+		{Name: "name", Type: mproto.VT_VAR_STRING},
+	}, func(event *blproto.StreamEvent) error {
+		events = append(events, event)
+		return nil
+	})
+
+	for _, record := range []DifferenceRecord{
+		{
+			Kind:   DifferenceMissingInSuperset,
+			Subset: []sqltypes.Value{sqltypes.MakeString([]byte("1")), sqltypes.MakeString([]byte("a")), sqltypes.MakeString([]byte("x"))},
+		},
+		{
+			Kind:     DifferenceMissingInSubset,
+			Superset: []sqltypes.Value{sqltypes.MakeString([]byte("18446744073709551615")), sqltypes.MakeString([]byte("b")), sqltypes.MakeString([]byte("y"))},
+		},
+	} {
+		if err := sink.Publish(record); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	if err := sink.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	want := [][]interface{}{
+		{int64(1), []byte("a")},
+		{uint64(18446744073709551615), []byte("b")},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %v events, want %v", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.Category != "DML" || event.TableName != "t1" || !reflect.DeepEqual(event.PKColNames, []string{"id", "name"}) {
+			t.Errorf("unexpected event %v: %+v", i, event)
+		}
+		if !reflect.DeepEqual(event.PKValues, [][]interface{}{want[i]}) {
+			t.Errorf("event %v has PKValues %v, want %v", i, event.PKValues, want[i])
+		}
+	}
+
+	if err := sink.Publish(DifferenceRecord{Subset: []sqltypes.Value{sqltypes.MakeString([]byte("x"))}}); err == nil {
+		t.Errorf("Publish should have failed on a row without its full primary key")
+	}
+}
+
+func TestEncodePKValueZerofill(t *testing.T) {
+	// ZEROFILL integer columns are returned with leading zeros,
+	// which are not an octal prefix
+	field := mproto.Field{Name: "id", Type: mproto.VT_LONG}
+	for raw, want := range map[string]int64{
+		"0000000010": 10,
+		"0000000009": 9,
+	} {
+		got, err := encodePKValue(field, sqltypes.MakeString([]byte(raw)))
+		if err != nil || got != want {
+			t.Errorf("encodePKValue(%v) = (%v, %v), want %v", raw, got, err, want)
+		}
+	}
+}
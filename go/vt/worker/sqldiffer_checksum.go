@@ -0,0 +1,231 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/youtube/vitess/go/vt/sqlparser"
+)
+
+// This file contains the checksum mode of the SQLDiffWorker, see
+// SQLDiffOptions.ChecksumBlockSize: the checksums of blocks of keys are
+// compared first, and only the rows of the blocks whose checksums
+// differ are diffed.
+
+// checkChecksumMode returns an error if the ChecksumBlockSize option
+// can't be used with the queries and the other options.
+func (worker *SQLDiffWorker) checkChecksumMode() error {
+	switch {
+	case worker.keyCount() != 1:
+		return fmt.Errorf("the ChecksumBlockSize option requires a single integer key column")
+	case worker.options.KeyFunc != nil:
+		return fmt.Errorf("the ChecksumBlockSize option can't be used with a KeyFunc")
+	case worker.options.Aggregate:
+		return fmt.Errorf("the ChecksumBlockSize option can't be used with Aggregate")
+	case worker.options.Delta:
+		return fmt.Errorf("the ChecksumBlockSize option can't be used with Delta, the high-water key would only be known for the mismatched blocks")
+	case worker.options.CountAssertion.Kind != "":
+		return fmt.Errorf("the ChecksumBlockSize option can't be used with a CountAssertion, only the rows of the mismatched blocks are read")
+	}
+	for _, spec := range []SourceSpec{worker.superset, worker.subset} {
+		if _, err := checksumSQL(spec.SQL, worker.options.ChecksumBlockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checksumSQL rewrites the query to return, for each block of
+// blockSize consecutive values of its key column, the number of rows
+// and a checksum of their values, ordered by block. The key column is
+// the first ORDER BY column.
+func checksumSQL(sql string, blockSize int64) (string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok || len(sel.OrderBy) == 0 {
+		return "", fmt.Errorf("query '%v' is not a SELECT ordered by its key column", sql)
+	}
+	if sel.Distinct != "" || len(sel.GroupBy) > 0 || sel.Having != nil || sel.Limit != nil {
+		return "", fmt.Errorf("query '%v' can't be checksummed by blocks, it can't use DISTINCT, GROUP BY, HAVING or LIMIT", sql)
+	}
+	col := orderByColumn(sel.OrderBy[0])
+	if col == nil {
+		return "", fmt.Errorf("query '%v' must be ordered by its key column first", sql)
+	}
+	var values []string
+	for _, expr := range sel.SelectExprs {
+		nse, ok := expr.(*sqlparser.NonStarExpr)
+		if !ok {
+			return "", fmt.Errorf("query '%v' must list its columns to be checksummed", sql)
+		}
+		// CONCAT_WS skips the NULLs, they are marked apart
+		value := sqlparser.String(nse.Expr)
+		values = append(values, value, "isnull("+value+")")
+	}
+
+	template := fmt.Sprintf("select floor(%v / %v) as checksum_block, count(*), bit_xor(crc32(concat_ws('#', %v))) from dual group by checksum_block order by checksum_block", sqlparser.String(col), blockSize, strings.Join(values, ", "))
+	statement, err = sqlparser.Parse(template)
+	if err != nil {
+		return "", fmt.Errorf("cannot build the checksum query for '%v': %v", sql, err)
+	}
+	checksum := statement.(*sqlparser.Select)
+	checksum.From = sel.From
+	checksum.Where = sel.Where
+	return sqlparser.String(checksum), nil
+}
+
+// blockChecksums runs the checksum query of the spec, and returns the
+// row count and checksum of each block, and the total row count.
+func (worker *SQLDiffWorker) blockChecksums(name string, spec SourceSpec) (map[int64]string, int, error) {
+	sql, err := checksumSQL(spec.SQL, worker.options.ChecksumBlockSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	spec.SQL = sql
+	qrr, cancel, err := worker.openReader(worker.ctx, name, spec)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cancel()
+	defer qrr.Close()
+
+	checksums := make(map[int64]string)
+	total := 0
+	rr := NewRowReader(qrr)
+	for {
+		row, err := rr.Next()
+		if err != nil {
+			return nil, 0, categorize(SQLDiffErrorRPC, fmt.Errorf("reading the %v checksums failed: %v", name, err))
+		}
+		if row == nil {
+			break
+		}
+		if len(row) != 3 {
+			return nil, 0, fmt.Errorf("unexpected %v checksum row: %v", name, row)
+		}
+		block, err := strconv.ParseInt(row[0].String(), 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid %v checksum block %v, is the key column an integer? %v", name, row[0], err)
+		}
+		count, err := strconv.Atoi(row[1].String())
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid %v checksum row count %v: %v", name, row[1], err)
+		}
+		checksums[block] = row[1].String() + "/" + row[2].String()
+		total += count
+	}
+
+	worker.mu.Lock()
+	if name == "superset" {
+		worker.supersetBytesRead += qrr.BytesRead()
+	} else {
+		worker.subsetBytesRead += qrr.BytesRead()
+	}
+	worker.mu.Unlock()
+	return checksums, total, nil
+}
+
+// mismatchedBlocks returns the sorted blocks whose row count or
+// checksum differ between both sides, including the blocks only one
+// side has rows in.
+func mismatchedBlocks(superset, subset map[int64]string) []int64 {
+	var result []int64
+	for block, checksum := range superset {
+		if subset[block] != checksum {
+			result = append(result, block)
+		}
+	}
+	for block := range subset {
+		if _, ok := superset[block]; !ok {
+			result = append(result, block)
+		}
+	}
+	sort.Sort(int64Slice(result))
+	return result
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+// blocksPredicate returns a predicate selecting the keys of the sorted
+// blocks, with one range per run of consecutive blocks.
+func blocksPredicate(column string, blocks []int64, blockSize int64) string {
+	var ranges []string
+	for i := 0; i < len(blocks); {
+		j := i
+		for j+1 < len(blocks) && blocks[j+1] == blocks[j]+1 {
+			j++
+		}
+		ranges = append(ranges, fmt.Sprintf("%v >= %v and %v < %v", column, blocks[i]*blockSize, column, (blocks[j]+1)*blockSize))
+		i = j + 1
+	}
+	if len(ranges) == 1 {
+		return ranges[0]
+	}
+	return "(" + strings.Join(ranges, ") or (") + ")"
+}
+
+// scopeToMismatchedBlocks compares the block checksums of both sides,
+// and restricts their queries to the mismatched blocks. It returns a
+// function restoring the queries, or nil if no block is mismatched,
+// in which case there is nothing to diff.
+func (worker *SQLDiffWorker) scopeToMismatchedBlocks() (func(), error) {
+	supersetChecksums, supersetRows, err := worker.blockChecksums("superset", worker.superset)
+	if err != nil {
+		return nil, err
+	}
+	subsetChecksums, _, err := worker.blockChecksums("subset", worker.subset)
+	if err != nil {
+		return nil, err
+	}
+	blocks := mismatchedBlocks(supersetChecksums, subsetChecksums)
+	total := len(supersetChecksums)
+	for block := range subsetChecksums {
+		if _, ok := supersetChecksums[block]; !ok {
+			total++
+		}
+	}
+	worker.mu.Lock()
+	worker.checksumBlocks = total
+	worker.mismatchedBlocks = len(blocks)
+	worker.mu.Unlock()
+	worker.wr.Logger().Infof("Checksummed %v blocks of %v keys, %v mismatched", total, worker.options.ChecksumBlockSize, len(blocks))
+	if len(blocks) == 0 {
+		worker.mu.Lock()
+		worker.processedRows += supersetRows
+		worker.mu.Unlock()
+		return nil, nil
+	}
+
+	supersetSQL, subsetSQL := worker.superset.SQL, worker.subset.SQL
+	restore := func() {
+		worker.superset.SQL, worker.subset.SQL = supersetSQL, subsetSQL
+	}
+	for _, spec := range []*SourceSpec{&worker.superset, &worker.subset} {
+		statement, err := sqlparser.Parse(spec.SQL)
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		column := sqlparser.String(orderByColumn(statement.(*sqlparser.Select).OrderBy[0]))
+		sql, err := filterSQL(spec.SQL, SQLFilter{Predicate: blocksPredicate(column, blocks, worker.options.ChecksumBlockSize)})
+		if err != nil {
+			restore()
+			return nil, err
+		}
+		spec.SQL = sql
+	}
+	return restore, nil
+}
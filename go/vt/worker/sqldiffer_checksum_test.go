@@ -0,0 +1,140 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestChecksumSQL(t *testing.T) {
+	got, err := checksumSQL("select id, msg from t where msg != 'x' order by id", 1000)
+	if err != nil {
+		t.Fatalf("checksumSQL failed: %v", err)
+	}
+	want := "select floor(id/1000) as checksum_block, count(*), bit_xor(crc32(concat_ws('#', id, isnull(id), msg, isnull(msg)))) from t where msg != 'x' group by checksum_block order by checksum_block asc"
+	if got != want {
+		t.Errorf("checksumSQL() = %v, want %v", got, want)
+	}
+
+	for _, sql := range []string{
+		"select * from t order by id",
+		"select id, count(*) from t group by id order by id",
+		"select id, msg from t",
+	} {
+		if _, err := checksumSQL(sql, 1000); err == nil {
+			t.Errorf("checksumSQL(%v) should have failed", sql)
+		}
+	}
+}
+
+func TestBlocksPredicate(t *testing.T) {
+	want := "(id >= 10 and id < 40) or (id >= 70 and id < 80)"
+	if got := blocksPredicate("id", []int64{1, 2, 3, 7}, 10); got != want {
+		t.Errorf("blocksPredicate() = %v, want %v", got, want)
+	}
+	want = "id >= 20 and id < 30"
+	if got := blocksPredicate("id", []int64{2}, 10); got != want {
+		t.Errorf("blocksPredicate() = %v, want %v", got, want)
+	}
+}
+
+// checksumReaderFactory returns the block checksums of its tablets for
+// the checksum queries, and their rows for the other queries, which
+// it records.
+type checksumReaderFactory struct {
+	checksums map[uint32][]string
+	rows      map[uint32][]string
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (f *checksumReaderFactory) newReader(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+	if strings.Contains(sql, "checksum_block") {
+		fields := []mproto.Field{
+			{Name: "checksum_block", Type: mproto.VT_LONGLONG},
+			{Name: "count(*)", Type: mproto.VT_LONGLONG},
+			{Name: "checksum", Type: mproto.VT_LONGLONG},
+		}
+		var rows [][]string
+		for _, checksum := range f.checksums[tabletAlias.Uid] {
+			rows = append(rows, strings.Split(checksum, " "))
+		}
+		return newFakeQueryResultReader(fields, makeRows(rows...)), nil
+	}
+	f.mu.Lock()
+	f.queries = append(f.queries, sql)
+	f.mu.Unlock()
+	fields := []mproto.Field{
+		{Name: "id", Type: mproto.VT_LONGLONG},
+		{Name: "msg", Type: mproto.VT_VARCHAR},
+	}
+	return newFakeQueryResultReader(fields, makeRows(strings.Split(f.rows[tabletAlias.Uid][0], " "))), nil
+}
+
+func TestSqlDifferChecksumMode(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	sql := "select id, msg from t order by id"
+	for _, c := range []struct {
+		subsetChecksum string
+		differences    bool
+	}{
+		{"1 10 456", false},
+		{"1 10 999", true},
+	} {
+		factory := &checksumReaderFactory{
+			checksums: map[uint32][]string{
+				1: {"0 10 123", "1 10 456"},
+				2: {"0 10 123", c.subsetChecksum},
+			},
+			rows: map[uint32][]string{
+				1: {"15 a"},
+				2: {"15 b"},
+			},
+		}
+		wrk := NewSQLDiffWorker(wr, "cell1",
+			SourceSpec{Keyspace: "ks1", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 1}},
+			SourceSpec{Keyspace: "ks2", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 2}},
+			SQLDiffOptions{ChecksumBlockSize: 10, NewQueryResultReader: factory.newReader}).(*SQLDiffWorker)
+		if err := wrk.checkChecksumMode(); err != nil {
+			t.Fatalf("checkChecksumMode failed: %v", err)
+		}
+
+		_, err := wrk.diff(nil)
+		status := wrk.GetStatus()
+		if !c.differences {
+			if err != nil || len(factory.queries) != 0 || status.ChecksumBlocks != 2 || status.MismatchedBlocks != 0 {
+				t.Errorf("matching checksums: err %v, detailed queries %v, status %+v", err, factory.queries, status)
+			}
+			continue
+		}
+		if errorCategory(err) != SQLDiffErrorDifferences || status.ValueMismatch != 1 || status.MismatchedBlocks != 1 {
+			t.Errorf("mismatched checksum: err %v, status %+v", err, status)
+		}
+		// only the mismatched block was diffed, with the original
+		// queries restored after
+		if len(factory.queries) != 2 || !strings.Contains(factory.queries[0], "where (id >= 10 and id < 20)") {
+			t.Errorf("unexpected detailed queries: %v", factory.queries)
+		}
+		if wrk.superset.SQL != sql || wrk.subset.SQL != sql {
+			t.Errorf("queries were not restored: %v, %v", wrk.superset.SQL, wrk.subset.SQL)
+		}
+	}
+
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{SQL: sql}, SourceSpec{SQL: sql}, SQLDiffOptions{ChecksumBlockSize: 10, Delta: true}).(*SQLDiffWorker)
+	if err := wrk.checkChecksumMode(); err == nil {
+		t.Errorf("checkChecksumMode should have failed with Delta")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/youtube/vitess/go/sqltypes"
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// This file contains the ChecksumOnly mode of the SQLDiffWorker: a
+// checksum of each full result is computed as it is streamed, and
+// only the checksums are compared.
+
+// resultChecksum is an order independent checksum of a result: the
+// sum of the hashes of its rows, so duplicated rows don't cancel out
+// as they would with a XOR, and its row count.
+type resultChecksum struct {
+	rows int
+	sum  uint64
+}
+
+// String is part of the fmt.Stringer interface.
+func (rc resultChecksum) String() string {
+	return fmt.Sprintf("%v rows, checksum %016x", rc.rows, rc.sum)
+}
+
+// add adds a row to the checksum. The values are length prefixed, and
+// NULLs marked apart, so different rows can't hash the same by moving
+// bytes between their values.
+func (rc *resultChecksum) add(row []sqltypes.Value) {
+	h := fnv.New64a()
+	for _, value := range row {
+		if value.IsNull() {
+			h.Write([]byte{0})
+			continue
+		}
+		raw := value.Raw()
+		h.Write([]byte(fmt.Sprintf("\x01%v:", len(raw))))
+		h.Write(raw)
+	}
+	rc.rows++
+	rc.sum += h.Sum64()
+}
+
+// checkChecksumOnly checks the ChecksumOnly option can be used: the
+// rows are never matched, so the options comparing or reporting them
+// are rejected.
+func (worker *SQLDiffWorker) checkChecksumOnly() error {
+	options := worker.options
+	switch {
+	case options.KeyFunc != nil || options.Canonicalizer != nil || len(options.Transforms) > 0 || len(options.Tolerances) > 0 || len(options.JSONColumns) > 0:
+		return fmt.Errorf("ChecksumOnly can't be used with the options normalizing values, the raw values are checksummed")
+	case len(options.IgnoreColumns) > 0 || len(options.CompareColumns) > 0:
+		return fmt.Errorf("ChecksumOnly can't be used with IgnoreColumns or CompareColumns, select the compared columns instead")
+	case worker.superset.TimeZone != "" || worker.subset.TimeZone != "":
+		return fmt.Errorf("ChecksumOnly can't be used with a TimeZone, the raw values are checksummed")
+	case options.Partitioner != nil || options.OnDifference != nil || options.DifferenceSink != nil || options.RerunOnDifference:
+		return fmt.Errorf("ChecksumOnly can't be used with the options reporting differences, no row is matched")
+	case options.SamplePercent != 0 || options.ChecksumBlockSize > 0 || options.Delta:
+		return fmt.Errorf("ChecksumOnly can't be used with SamplePercent, ChecksumBlockSize or Delta, the full results are checksummed")
+	case options.CountAssertion.Kind != "" || options.VerifyChecksum || options.MaterializeSuperset || options.ReselectOnUnhealthy:
+		return fmt.Errorf("ChecksumOnly can't be used with CountAssertion, VerifyChecksum, MaterializeSuperset or ReselectOnUnhealthy")
+	}
+	return nil
+}
+
+// compareResultChecksums streams both results, computing their
+// checksums, and fails with the differences error category if they
+// don't match.
+func (worker *SQLDiffWorker) compareResultChecksums(positions map[topo.TabletAlias]myproto.ReplicationPosition) error {
+	var wg sync.WaitGroup
+	var checksums [2]resultChecksum
+	var errs [2]error
+	for i, side := range []struct {
+		name string
+		spec SourceSpec
+	}{
+		{"superset", worker.superset},
+		{"subset", worker.subset},
+	} {
+		wg.Add(1)
+		go func(i int, name string, spec SourceSpec) {
+			defer wg.Done()
+			checksums[i], errs[i] = worker.resultChecksum(name, spec)
+		}(i, side.name, side.spec)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			if worker.checkInterrupted() {
+				return topo.ErrInterrupted
+			}
+			return err
+		}
+	}
+	if positions != nil {
+		if err := worker.checkReplicationPositions(positions); err != nil {
+			return err
+		}
+	}
+
+	superset, subset := checksums[0], checksums[1]
+	verdict := fmt.Sprintf("superset %v, subset %v", superset, subset)
+	worker.mu.Lock()
+	worker.checksumVerdict = verdict
+	worker.processedRows += superset.rows
+	worker.mu.Unlock()
+	if superset != subset {
+		worker.wr.Logger().Infof("The result checksums differ checking %v: %v", worker.direction(), verdict)
+		return categorize(SQLDiffErrorDifferences, fmt.Errorf("the result checksums differ checking %v: %v", worker.direction(), verdict))
+	}
+	worker.wr.Logger().Infof("No difference found checking %v, the result checksums match: %v", worker.direction(), verdict)
+	return nil
+}
+
+// resultChecksum runs the query of the spec, and returns the checksum
+// of its result.
+func (worker *SQLDiffWorker) resultChecksum(name string, spec SourceSpec) (resultChecksum, error) {
+	var result resultChecksum
+	qrr, cancel, err := worker.openReader(worker.ctx, name, spec)
+	if err != nil {
+		return result, categorize(SQLDiffErrorRPC, err)
+	}
+	defer cancel()
+	defer qrr.Close()
+
+	rr := NewRowReader(qrr)
+	for {
+		row, err := rr.Next()
+		if err != nil {
+			return result, categorize(SQLDiffErrorRPC, fmt.Errorf("reading the %v rows failed: %v", name, err))
+		}
+		if row == nil {
+			break
+		}
+		result.add(row)
+	}
+
+	worker.mu.Lock()
+	if name == "superset" {
+		worker.supersetBytesRead += qrr.BytesRead()
+	} else {
+		worker.subsetBytesRead += qrr.BytesRead()
+	}
+	worker.mu.Unlock()
+	return result, nil
+}
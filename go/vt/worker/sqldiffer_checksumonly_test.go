@@ -0,0 +1,82 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestResultChecksum(t *testing.T) {
+	checksum := func(rows ...[]string) resultChecksum {
+		var rc resultChecksum
+		for _, row := range makeRows(rows...) {
+			rc.add(row)
+		}
+		return rc
+	}
+	// the order of the rows doesn't matter
+	if checksum([]string{"1", "a"}, []string{"2", "b"}) != checksum([]string{"2", "b"}, []string{"1", "a"}) {
+		t.Errorf("the checksums of the same rows in another order differ")
+	}
+	// duplicated rows don't cancel out
+	if checksum([]string{"1", "a"}, []string{"1", "a"}) == checksum() {
+		t.Errorf("the checksums of two identical rows and of no row match")
+	}
+	// the bytes can't be moved between values
+	if checksum([]string{"1", "ab"}) == checksum([]string{"1a", "b"}) {
+		t.Errorf("the checksums of rows with bytes moved between values match")
+	}
+}
+
+func TestSqlDifferChecksumOnly(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	for _, c := range []struct {
+		subset [][]string
+		match  bool
+	}{
+		{[][]string{{"2", "b"}, {"1", "a"}}, true},
+		{[][]string{{"1", "a"}, {"2", "c"}}, false},
+		{[][]string{{"1", "a"}}, false},
+	} {
+		factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+			if tabletAlias.Uid == 2 {
+				return newFakeQueryResultReader(allShardsFields, makeRows(c.subset...)), nil
+			}
+			return newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"}, []string{"2", "b"})), nil
+		}
+		wrk := NewSQLDiffWorker(wr, "cell1",
+			SourceSpec{Keyspace: "ks", Shard: "0", SQL: "select id, msg from t order by id", alias: topo.TabletAlias{Cell: "cell1", Uid: 1}},
+			SourceSpec{Keyspace: "ks", Shard: "1", SQL: "select id, msg from t order by id", alias: topo.TabletAlias{Cell: "cell1", Uid: 2}},
+			SQLDiffOptions{ChecksumOnly: true, NewQueryResultReader: factory}).(*SQLDiffWorker)
+		_, err := wrk.diff(nil)
+		if c.match && err != nil {
+			t.Errorf("diff() with subset %v = %v, want a match", c.subset, err)
+		}
+		if !c.match && (errorCategory(err) != SQLDiffErrorDifferences || !strings.Contains(err.Error(), "result checksums differ")) {
+			t.Errorf("diff() with subset %v = %v, want a checksum mismatch", c.subset, err)
+		}
+		if !strings.Contains(wrk.GetStatus().ChecksumVerdict, "superset 2 rows") {
+			t.Errorf("unexpected verdict: %q", wrk.GetStatus().ChecksumVerdict)
+		}
+	}
+
+	config := SQLDiffConfig{
+		Cell:     "cell1",
+		Superset: SourceSpec{Keyspace: "ks", Shard: "0", SQL: "select id, msg from t order by id"},
+		Subset:   SourceSpec{Keyspace: "ks", Shard: "1", SQL: "select id, msg from t order by id"},
+		Options:  SQLDiffOptions{ChecksumOnly: true, IgnoreColumns: []string{"msg"}},
+	}
+	if err := config.Validate(); err == nil {
+		t.Errorf("ChecksumOnly with IgnoreColumns should have failed")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains the validation of SQLDiffConfigs, and the
+// creation of SQLDiffWorkers from configurations kept outside of the
+// code, in a ConfigProvider.
+
+// ConfigProvider is a source of SQLDiffWorker configurations, like a
+// configuration store, where the checks are defined by name.
+type ConfigProvider interface {
+	// SQLDiffConfig returns the configuration of the named check.
+	SQLDiffConfig(name string) (SQLDiffConfig, error)
+}
+
+// NewSQLDiffWorkerFromProvider reads the configuration of the named
+// check from provider, validates it, and returns a SQLDiffWorker
+// running it. The Name option defaults to the check name, so its
+// history is kept under it.
+func NewSQLDiffWorkerFromProvider(wr *wrangler.Wrangler, provider ConfigProvider, name string) (Worker, error) {
+	config, err := provider.SQLDiffConfig(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the configuration of check %v: %v", name, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration for check %v: %v", name, err)
+	}
+	if config.Options.Name == "" {
+		config.Options.Name = name
+	}
+	return NewSQLDiffWorkerFromConfig(wr, config), nil
+}
+
+// Validate checks the configuration is complete and consistent, and
+// that its queries pass the checks the worker runs before picking its
+// tablets, so a bad configuration is caught without running it.
+func (config SQLDiffConfig) Validate() error {
+	if err := config.Options.CountAssertion.validate(); err != nil {
+		return err
+	}
+	for _, side := range []struct {
+		name string
+		spec SourceSpec
+	}{
+		{"superset", config.Superset},
+		{"subset", config.Subset},
+	} {
+		if err := side.spec.validate(); err != nil {
+			return fmt.Errorf("%v: %v", side.name, err)
+		}
+		if side.spec.hasTablet() && side.spec.Cell == "" && config.Cell == "" {
+			return fmt.Errorf("%v: no cell to pick a tablet from", side.name)
+		}
+	}
+	worker := &SQLDiffWorker{
+		superset: config.Superset,
+		subset:   config.Subset,
+		options:  config.Options,
+	}
+	if err := worker.checkAllShards(); err != nil {
+		return err
+	}
+	if err := worker.checkSnapshots(); err != nil {
+		return err
+	}
+	if config.Options.QueryEquivalence {
+		if err := worker.checkQueryEquivalence(); err != nil {
+			return err
+		}
+	}
+	if config.Options.SQLMode != "" {
+		if _, err := normalizeSQLMode(config.Options.SQLMode); err != nil {
+			return err
+		}
+	}
+	if config.Options.ChecksumOnly {
+		if err := worker.checkChecksumOnly(); err != nil {
+			return err
+		}
+	}
+	if config.Options.ReselectOnUnhealthy {
+		if err := worker.checkReselect(); err != nil {
+			return err
+		}
+	}
+	if config.Options.FilteredReplication {
+		if err := worker.checkFilteredReplication(); err != nil {
+			return err
+		}
+	}
+	if config.Options.SameTablet && config.Superset.Sync != config.Subset.Sync {
+		return fmt.Errorf("SameTablet requires superset and subset to use the same Sync strategy, got %q and %q", config.Superset.Sync, config.Subset.Sync)
+	}
+	if !config.Options.SameTabletAlias.IsZero() && !config.Options.SameTablet {
+		return fmt.Errorf("SameTabletAlias requires the SameTablet option")
+	}
+	if config.Options.Filter.Predicate != "" {
+		for _, spec := range []SourceSpec{config.Superset, config.Subset} {
+			if _, err := filterSQL(spec.SQL, config.Options.Filter); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the GROUP BY queries are only ordered by their key when
+	// the worker runs
+	if config.Options.Aggregate {
+		for _, spec := range []SourceSpec{config.Superset, config.Subset} {
+			if _, _, err := aggregateSQL(spec.SQL); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if config.Options.MaterializeSuperset {
+		if err := worker.checkMaterialize(); err != nil {
+			return err
+		}
+	}
+	if len(config.Options.HashColumns) > 0 {
+		if err := worker.checkHashColumns(); err != nil {
+			return err
+		}
+	}
+	if config.Options.VerifyKeyUniqueness {
+		if err := worker.checkKeyUniqueness(); err != nil {
+			return err
+		}
+	}
+	return worker.checkQueries()
+}
+
+// validate checks the spec is complete and consistent.
+func (spec SourceSpec) validate() error {
+	if spec.SQL == "" {
+		return fmt.Errorf("no query")
+	}
+	if spec.DSN != "" && spec.VTGate != "" {
+		return fmt.Errorf("DSN and VTGate can't be both set")
+	}
+	if spec.Snapshot != "" && (spec.DSN != "" || spec.VTGate != "") {
+		return fmt.Errorf("Snapshot can't be set with DSN or VTGate")
+	}
+	if spec.Snapshot != "" {
+		if _, _, err := snapshotOpener(spec.Snapshot); err != nil {
+			return err
+		}
+	} else if spec.DSN != "" {
+		if _, err := ParseMySQLDSN(spec.DSN); err != nil {
+			return err
+		}
+	} else if spec.Keyspace == "" || (spec.Shard == "" && !spec.AllShards) {
+		return fmt.Errorf("no keyspace and shard to read from")
+	}
+	if spec.Sync != "" && spec.Sync != SyncStopReplication && spec.Sync != SyncSnapshot {
+		return fmt.Errorf("unknown Sync strategy %q", spec.Sync)
+	}
+	if spec.TimeZone != "" {
+		if _, err := time.LoadLocation(spec.TimeZone); err != nil {
+			return fmt.Errorf("invalid time zone: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// mapConfigProvider serves the configurations of a map.
+type mapConfigProvider map[string]SQLDiffConfig
+
+func (p mapConfigProvider) SQLDiffConfig(name string) (SQLDiffConfig, error) {
+	config, ok := p[name]
+	if !ok {
+		return SQLDiffConfig{}, fmt.Errorf("no such check")
+	}
+	return config, nil
+}
+
+func TestNewSQLDiffWorkerFromProvider(t *testing.T) {
+	valid := SQLDiffConfig{
+		Cell:     "cell1",
+		Superset: SourceSpec{Keyspace: "main", Shard: "0", SQL: "SELECT id, name FROM user ORDER BY id"},
+		Subset:   SourceSpec{Keyspace: "lookup", Shard: "0", SQL: "SELECT id, name FROM user_lookup ORDER BY id"},
+		Options:  SQLDiffOptions{Tolerances: map[string]Tolerance{"balance": {Absolute: 0.01}}},
+	}
+	invalid := valid
+	invalid.Subset.SQL = "DELETE FROM user_lookup"
+	noCell := valid
+	noCell.Cell = ""
+	provider := mapConfigProvider{
+		"user_lookup": valid,
+		"invalid":     invalid,
+		"no_cell":     noCell,
+	}
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+
+	w, err := NewSQLDiffWorkerFromProvider(wr, provider, "user_lookup")
+	if err != nil {
+		t.Fatalf("NewSQLDiffWorkerFromProvider failed: %v", err)
+	}
+	wrk := w.(*SQLDiffWorker)
+	if wrk.HistoryKey() != "user_lookup" || wrk.options.Tolerances["balance"].Absolute != 0.01 {
+		t.Errorf("unexpected worker: history key %v, options %+v", wrk.HistoryKey(), wrk.options)
+	}
+
+	for name, want := range map[string]string{
+		"invalid": "subset: query 'DELETE FROM user_lookup' is not a SELECT",
+		"no_cell": "no cell to pick a tablet from",
+		"missing": "no such check",
+	} {
+		if _, err := NewSQLDiffWorkerFromProvider(wr, provider, name); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("NewSQLDiffWorkerFromProvider(%v) returned %v, want an error containing %q", name, err, want)
+		}
+	}
+}
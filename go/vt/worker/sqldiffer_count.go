@@ -0,0 +1,105 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"math"
+)
+
+// This file contains the CountAssertion of the SQLDiffWorker, checking
+// the row counts of both sides on top of the row by row diff.
+
+// CountAssertionKind is the relationship a CountAssertion expects
+// between the row counts of the superset and the subset.
+type CountAssertionKind string
+
+const (
+	// CountEqual expects both sides to have the same number of
+	// rows.
+	CountEqual CountAssertionKind = "equal"
+
+	// CountSubset expects the subset to have at most as many rows
+	// as the superset.
+	CountSubset CountAssertionKind = "subset"
+
+	// CountWithinPercent expects the subset row count to be within
+	// CountAssertion.Percent percent of the superset row count.
+	CountWithinPercent CountAssertionKind = "within-percent"
+)
+
+// CountAssertion is a relationship expected between the row counts of
+// the superset and the subset. If it doesn't hold, the run fails, even
+// if no row is different. The zero value checks nothing.
+type CountAssertion struct {
+	Kind CountAssertionKind
+
+	// Percent is the tolerance of CountWithinPercent.
+	Percent float64
+}
+
+func (ca CountAssertion) String() string {
+	if ca.Kind == CountWithinPercent {
+		return fmt.Sprintf("subset row count within %v%% of the superset row count", ca.Percent)
+	}
+	if ca.Kind == CountEqual {
+		return "subset row count equal to the superset row count"
+	}
+	return "subset row count at most the superset row count"
+}
+
+// validate returns an error if the assertion is not well formed.
+func (ca CountAssertion) validate() error {
+	switch ca.Kind {
+	case "", CountEqual, CountSubset:
+		return nil
+	case CountWithinPercent:
+		if ca.Percent < 0 {
+			return fmt.Errorf("invalid CountAssertion: negative percent %v", ca.Percent)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid CountAssertion: unknown kind %q", ca.Kind)
+}
+
+// holds returns true if the row counts satisfy the assertion.
+func (ca CountAssertion) holds(supersetRows, subsetRows int) bool {
+	switch ca.Kind {
+	case CountEqual:
+		return subsetRows == supersetRows
+	case CountSubset:
+		return subsetRows <= supersetRows
+	case CountWithinPercent:
+		return math.Abs(float64(subsetRows-supersetRows)) <= float64(supersetRows)*ca.Percent/100
+	}
+	return true
+}
+
+// checkCounts evaluates the CountAssertion against the rows read by a
+// diff, and records the outcome for the status. It returns an error if
+// the assertion doesn't hold.
+func (worker *SQLDiffWorker) checkCounts(report DiffSummary) error {
+	// in reverse mode, the worker superset is the differ subset
+	supersetRows, subsetRows := report.RowsRead()
+	if worker.options.Reverse {
+		supersetRows, subsetRows = subsetRows, supersetRows
+	}
+	assertion := worker.options.CountAssertion
+	held := assertion.holds(supersetRows, subsetRows)
+	outcome := "held"
+	if !held {
+		outcome = "violated"
+	}
+	result := fmt.Sprintf("%v: %v (%v superset rows, %v subset rows)", assertion, outcome, supersetRows, subsetRows)
+	worker.mu.Lock()
+	worker.countAssertion = result
+	worker.mu.Unlock()
+	if !held {
+		worker.wr.Logger().Errorf("Count assertion failed checking %v: %v", worker.direction(), result)
+		return categorize(SQLDiffErrorCountAssertion, fmt.Errorf("count assertion failed checking %v: %v", worker.direction(), result))
+	}
+	worker.wr.Logger().Infof("Count assertion %v", result)
+	return nil
+}
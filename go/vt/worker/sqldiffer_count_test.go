@@ -0,0 +1,68 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestCountAssertion(t *testing.T) {
+	for _, c := range []struct {
+		assertion                CountAssertion
+		supersetRows, subsetRows int
+		want                     bool
+	}{
+		{CountAssertion{}, 10, 20, true},
+		{CountAssertion{Kind: CountEqual}, 10, 10, true},
+		{CountAssertion{Kind: CountEqual}, 10, 9, false},
+		{CountAssertion{Kind: CountSubset}, 10, 9, true},
+		{CountAssertion{Kind: CountSubset}, 10, 11, false},
+		{CountAssertion{Kind: CountWithinPercent, Percent: 5}, 100, 105, true},
+		{CountAssertion{Kind: CountWithinPercent, Percent: 5}, 100, 94, false},
+	} {
+		if got := c.assertion.holds(c.supersetRows, c.subsetRows); got != c.want {
+			t.Errorf("%v.holds(%v, %v) = %v, want %v", c.assertion, c.supersetRows, c.subsetRows, got, c.want)
+		}
+	}
+
+	if err := (CountAssertion{Kind: "more"}).validate(); err == nil {
+		t.Errorf("unknown kind should have been rejected")
+	}
+	if err := (CountAssertion{Kind: CountWithinPercent, Percent: -1}).validate(); err == nil {
+		t.Errorf("negative percent should have been rejected")
+	}
+}
+
+func TestSqlDifferCheckCounts(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	options := SQLDiffOptions{Reverse: true, CountAssertion: CountAssertion{Kind: CountSubset}}
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "ks1", Shard: "0"}, SourceSpec{Keyspace: "ks2", Shard: "0"}, options).(*SQLDiffWorker)
+
+	// in reverse mode, the differ left side is the worker subset
+	err := wrk.checkCounts(DiffReport{rowsLeft: 12, rowsRight: 10})
+	if errorCategory(err) != SQLDiffErrorCountAssertion {
+		t.Fatalf("unexpected error for a subset larger than the superset: %v", err)
+	}
+	wrk.recordError(err)
+	status := wrk.GetStatus()
+	if !strings.Contains(status.CountAssertion, "violated (10 superset rows, 12 subset rows)") {
+		t.Errorf("unexpected count assertion status: %v", status.CountAssertion)
+	}
+	if !wrk.FoundDifferences() {
+		t.Errorf("a violated count assertion should count as differences")
+	}
+
+	if err := wrk.checkCounts(DiffReport{rowsLeft: 10, rowsRight: 12}); err != nil {
+		t.Errorf("checkCounts failed: %v", err)
+	}
+	if status := wrk.GetStatus(); !strings.Contains(status.CountAssertion, "held") {
+		t.Errorf("unexpected count assertion status: %v", status.CountAssertion)
+	}
+}
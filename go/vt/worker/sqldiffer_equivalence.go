@@ -0,0 +1,66 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains the helpers to test the equivalence of two
+// queries with a SQLDiffWorker, for instance before and after a query
+// rewrite, by comparing their results on the same tablet.
+
+// QueryEquivalenceConfig returns the configuration of a SQLDiffWorker
+// checking that the candidate query returns exactly the rows of the
+// reference query, both read on the same rdonly tablet of
+// keyspace/shard. Both queries need to return their rows ordered by
+// keyColumns, which are the diff key. Replication is not stopped, each
+// query reads a consistent snapshot as of its start, so the rows
+// written in between show as differences on a tablet taking writes:
+// RerunOnDifference filters them out.
+func QueryEquivalenceConfig(cell, keyspace, shard, reference, candidate string, keyColumns []string, options SQLDiffOptions) SQLDiffConfig {
+	options.QueryEquivalence = true
+	options.SameTablet = true
+	options.Exact = true
+	options.Reverse = false
+	return SQLDiffConfig{
+		Cell: cell,
+		Superset: SourceSpec{
+			Keyspace:   keyspace,
+			Shard:      shard,
+			SQL:        reference,
+			KeyColumns: keyColumns,
+			Sync:       SyncSnapshot,
+		},
+		Subset: SourceSpec{
+			Keyspace:   keyspace,
+			Shard:      shard,
+			SQL:        candidate,
+			KeyColumns: keyColumns,
+			Sync:       SyncSnapshot,
+		},
+		Options: options,
+	}
+}
+
+// NewQueryEquivalenceSQLDiffWorker returns a SQLDiffWorker running the
+// check of QueryEquivalenceConfig.
+func NewQueryEquivalenceSQLDiffWorker(wr *wrangler.Wrangler, cell, keyspace, shard, reference, candidate string, keyColumns []string, options SQLDiffOptions) Worker {
+	return NewSQLDiffWorkerFromConfig(wr, QueryEquivalenceConfig(cell, keyspace, shard, reference, candidate, keyColumns, options))
+}
+
+// checkQueryEquivalence checks the QueryEquivalence option is used
+// with the options it requires.
+func (worker *SQLDiffWorker) checkQueryEquivalence() error {
+	if !worker.options.SameTablet || !worker.options.Exact {
+		return fmt.Errorf("QueryEquivalence requires the SameTablet and Exact options")
+	}
+	if worker.options.Reverse {
+		return fmt.Errorf("QueryEquivalence cannot be used with Reverse")
+	}
+	return nil
+}
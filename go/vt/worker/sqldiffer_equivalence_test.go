@@ -0,0 +1,48 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestQueryEquivalenceConfig(t *testing.T) {
+	reference := "select id, msg from t where msg like 'a%' order by id"
+	candidate := "select id, msg from t where substr(msg, 1, 1) = 'a' order by id"
+	config := QueryEquivalenceConfig("cell1", "ks", "0", reference, candidate, []string{"id"}, SQLDiffOptions{Reverse: true})
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	// the candidate misses a row of the reference
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+		if sql == candidate {
+			return newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"})), nil
+		}
+		return newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"}, []string{"2", "ab"})), nil
+	}
+	config.Options.NewQueryResultReader = factory
+	config.Superset.alias = topo.TabletAlias{Cell: "cell1", Uid: 1}
+	config.Subset.alias = config.Superset.alias
+	wrk := NewSQLDiffWorkerFromConfig(wr, config).(*SQLDiffWorker)
+	_, err := wrk.diff(nil)
+	if err == nil || !strings.Contains(err.Error(), "query equivalence on ks/0") {
+		t.Errorf("diff() = %v, want a query equivalence difference", err)
+	}
+
+	config.Options.SameTablet = false
+	if err := config.Validate(); err == nil {
+		t.Errorf("QueryEquivalence without SameTablet should have failed")
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/youtube/vitess/go/vt/sqlparser"
+)
+
+// This file contains the HashColumns option of the SQLDiffWorker,
+// which compares large columns by a hash computed by MySQL.
+
+// checkHashColumns checks the HashColumns option can be used with the
+// other options, and that both queries can be rewritten.
+func (worker *SQLDiffWorker) checkHashColumns() error {
+	switch {
+	case worker.options.KeysOnly:
+		return fmt.Errorf("HashColumns cannot be used with KeysOnly, which doesn't read them")
+	case worker.options.Aggregate:
+		return fmt.Errorf("HashColumns cannot be used with Aggregate")
+	}
+	for _, name := range worker.options.HashColumns {
+		for _, json := range worker.options.JSONColumns {
+			if strings.EqualFold(name, json) {
+				return fmt.Errorf("column %v cannot be both compared by hash and as JSON", name)
+			}
+		}
+	}
+	for _, spec := range []SourceSpec{worker.superset, worker.subset} {
+		if _, err := hashColumnsSQL(spec.SQL, worker.options.HashColumns, worker.keyCount()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashColumns rewrites both queries to select the hash of the
+// HashColumns, see hashColumnsSQL.
+func (worker *SQLDiffWorker) hashColumns() error {
+	if err := worker.checkHashColumns(); err != nil {
+		return err
+	}
+	for _, spec := range []*SourceSpec{&worker.superset, &worker.subset} {
+		sql, err := hashColumnsSQL(spec.SQL, worker.options.HashColumns, worker.keyCount())
+		if err != nil {
+			return err
+		}
+		worker.wr.Logger().Infof("Comparing %v by hash for %v: %v", strings.Join(worker.options.HashColumns, ", "), spec.name(), sql)
+		spec.SQL = sql
+	}
+	worker.mu.Lock()
+	worker.hashedColumns = worker.options.HashColumns
+	worker.mu.Unlock()
+	return nil
+}
+
+// hashColumnsSQL rewrites the query to select SHA2(column, 256) in
+// place of each of the provided columns, under the column name. The
+// columns need to be selected by name, and not be one of the keyCount
+// first ORDER BY columns, which are the keys.
+func hashColumnsSQL(sql string, columns []string, keyCount int) (string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok {
+		return "", fmt.Errorf("query '%v' is not a simple SELECT", sql)
+	}
+	for i, order := range sel.OrderBy {
+		if i == keyCount {
+			break
+		}
+		if col := orderByColumn(order); col != nil && containsFold(columns, string(col.Name)) {
+			return "", fmt.Errorf("key column %v of query '%v' cannot be compared by hash", string(col.Name), sql)
+		}
+	}
+	found := make(map[string]bool)
+	for _, expr := range sel.SelectExprs {
+		nse, ok := expr.(*sqlparser.NonStarExpr)
+		if !ok {
+			continue
+		}
+		col, ok := nse.Expr.(*sqlparser.ColName)
+		if !ok || !containsFold(columns, string(col.Name)) {
+			continue
+		}
+		found[strings.ToLower(string(col.Name))] = true
+		nse.Expr = &sqlparser.FuncExpr{
+			Name: []byte("sha2"),
+			Exprs: sqlparser.SelectExprs{
+				&sqlparser.NonStarExpr{Expr: col},
+				&sqlparser.NonStarExpr{Expr: sqlparser.NumVal("256")},
+			},
+		}
+		if len(nse.As) == 0 {
+			nse.As = col.Name
+		}
+	}
+	for _, name := range columns {
+		if !found[strings.ToLower(name)] {
+			return "", fmt.Errorf("column %v to compare by hash is not selected by name by query '%v'", name, sql)
+		}
+	}
+	return sqlparser.String(sel), nil
+}
+
+// containsFold returns true if names contains name, ignoring case.
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
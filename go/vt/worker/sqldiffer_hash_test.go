@@ -0,0 +1,39 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"testing"
+)
+
+func TestHashColumnsSQL(t *testing.T) {
+	for _, c := range []struct {
+		sql     string
+		columns []string
+		want    string
+	}{
+		{"select id, payload, msg from t order by id", []string{"payload"}, "select id, sha2(payload, 256) as payload, msg from t order by id asc"},
+		{"select t.id, t.Payload as p from t order by t.id", []string{"payload"}, "select t.id, sha2(t.payload, 256) as p from t order by t.id asc"},
+	} {
+		got, err := hashColumnsSQL(c.sql, c.columns, 1)
+		if err != nil || got != c.want {
+			t.Errorf("hashColumnsSQL(%q) = %q, %v, want %q", c.sql, got, err, c.want)
+		}
+	}
+	for _, c := range []struct {
+		sql     string
+		columns []string
+	}{
+		// a key can't be hashed
+		{"select id, payload from t order by id", []string{"id"}},
+		// the column needs to be selected by name
+		{"select * from t order by id", []string{"payload"}},
+		{"select id, concat(payload) from t order by id", []string{"payload"}},
+	} {
+		if _, err := hashColumnsSQL(c.sql, c.columns, 1); err == nil {
+			t.Errorf("hashColumnsSQL(%q, %v) should have failed", c.sql, c.columns)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains the description of where a SQLDiffWorker run was
+// when it was cancelled or timed out, shown with its error.
+
+// isTimeout returns true if err is a timeout, like the expiration of
+// a QueryTimeout.
+func isTimeout(err error) bool {
+	return err != nil && strings.Contains(err.Error(), context.DeadlineExceeded.Error())
+}
+
+// noteInterruption records the phase the run is in, and its progress
+// in that phase, if err is a cancellation or a timeout. Only the first
+// interruption is recorded: it needs to be called before the state
+// changes, from checkInterrupted or as soon as run returns. The mutex
+// needs to be held.
+func (worker *SQLDiffWorker) noteInterruption(err error) {
+	if worker.interruption != "" {
+		return
+	}
+	err = jobError(err)
+	var what string
+	switch {
+	case err == topo.ErrInterrupted:
+		what = "cancelled"
+	case isTimeout(err):
+		what = "timed out"
+	default:
+		return
+	}
+	switch worker.state {
+	case sqlDiffFindTargets, sqlDiffSynchronizeReplication, sqlDiffRunning:
+	default:
+		return
+	}
+
+	interruption := fmt.Sprintf("%v while %v", what, worker.state)
+	switch worker.state {
+	case sqlDiffSynchronizeReplication:
+		interruption += fmt.Sprintf(", with replication stopped on %v tablets", len(worker.cleaner.GetTargetsByName(wrangler.StartSlaveActionName)))
+	case sqlDiffRunning:
+		interruption += " after " + formatRowCount(worker.interruptedRows) + " rows"
+	}
+	if worker.confirming {
+		interruption += ", confirming the differences found"
+	}
+	worker.interruption = interruption
+	worker.wr.Logger().Warningf("Run %v", interruption)
+}
+
+// formatRowCount returns a short version of a number of rows, like
+// 3.1M.
+func formatRowCount(rows int) string {
+	switch {
+	case rows >= 1000000000:
+		return fmt.Sprintf("%.1fG", float64(rows)/1e9)
+	case rows >= 1000000:
+		return fmt.Sprintf("%.1fM", float64(rows)/1e6)
+	case rows >= 10000:
+		return fmt.Sprintf("%.1fk", float64(rows)/1e3)
+	}
+	return fmt.Sprint(rows)
+}
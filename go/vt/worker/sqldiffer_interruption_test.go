@@ -0,0 +1,63 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestSqlDifferInterruption(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	for _, c := range []struct {
+		state      sqlDiffWorkerState
+		rows       int
+		err        error
+		want       string
+		wantStatus string
+	}{
+		{sqlDiffRunning, 3141592, topo.ErrInterrupted, "cancelled while running the diff after 3.1M rows", "cancelled"},
+		{sqlDiffFindTargets, 0, topo.ErrInterrupted, "cancelled while finding target instances", "cancelled"},
+		{sqlDiffRunning, 42, fmt.Errorf("stream error: %v", context.DeadlineExceeded), "timed out while running the diff after 42 rows", "error"},
+		{sqlDiffRunning, 42, fmt.Errorf("connection refused"), "", "error"},
+	} {
+		wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "ks1", Shard: "0"}, SourceSpec{Keyspace: "ks2", Shard: "0"}, SQLDiffOptions{}).(*SQLDiffWorker)
+		wrk.state = c.state
+		wrk.interruptedRows = c.rows
+		wrk.recordError(c.err)
+
+		// the state the cleanup leaves doesn't change it
+		wrk.state = sqlDiffCleanUp
+		wrk.recordError(c.err)
+
+		status := wrk.GetStatus()
+		if status.Interruption != c.want || status.State != c.wantStatus {
+			t.Errorf("interrupted in %v: got %q in state %v, want %q in state %v", c.state, status.Interruption, status.State, c.want, c.wantStatus)
+		}
+		if c.want != "" && status.Error != c.err.Error()+" ("+c.want+")" {
+			t.Errorf("unexpected status error: %v", status.Error)
+		}
+	}
+}
+
+func TestFormatRowCount(t *testing.T) {
+	for rows, want := range map[int]string{
+		999:        "999",
+		12345:      "12.3k",
+		3100000:    "3.1M",
+		2500000000: "2.5G",
+	} {
+		if got := formatRowCount(rows); got != want {
+			t.Errorf("formatRowCount(%v) = %v, want %v", rows, got, want)
+		}
+	}
+}
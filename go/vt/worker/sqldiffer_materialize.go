@@ -0,0 +1,186 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/sqlparser"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains the MaterializeSuperset support of the
+// SQLDiffWorker: the superset rows are copied into a scratch table on
+// the superset tablet, and the diff reads that table.
+//
+// The table is a regular table, not a TEMPORARY one: the tablet runs
+// the copy and the streaming read on different connections, and a
+// temporary table is only visible to the connection that created it.
+
+// materializedTablePrefix is the prefix of the scratch tables the
+// superset is materialized in.
+const materializedTablePrefix = "_vt_sqldiff_"
+
+// dropTableActionName is the name of the action dropping a scratch
+// table.
+const dropTableActionName = "DropTableAction"
+
+// dropTableAction is a CleanerAction dropping a scratch table on a
+// tablet.
+type dropTableAction struct {
+	alias topo.TabletAlias
+	table string
+}
+
+// CleanUp is part of CleanerAction interface.
+func (dta dropTableAction) CleanUp(ctx context.Context, wr *wrangler.Wrangler) error {
+	_, err := wr.ExecuteFetchAsDba(ctx, dta.alias, "DROP TABLE IF EXISTS "+dta.table, 0, false, true)
+	return err
+}
+
+// checkMaterialize checks the superset can be materialized.
+func (worker *SQLDiffWorker) checkMaterialize() error {
+	if !worker.superset.hasTablet() {
+		return fmt.Errorf("MaterializeSuperset requires the superset to be read from a tablet")
+	}
+	if worker.superset.AllShards {
+		return fmt.Errorf("MaterializeSuperset cannot be used with AllShards")
+	}
+	_, _, err := materializeSQL(worker.superset.SQL, &sqlparser.TableName{Name: []byte("t"), Qualifier: []byte("db")})
+	return err
+}
+
+// materializeSQL returns the query copying the rows of sql into table,
+// and the query reading them back in the same order. The tables of
+// the query are qualified with the database of table, as the copy
+// runs without a default database.
+func materializeSQL(sql string, table *sqlparser.TableName) (string, string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok {
+		return "", "", fmt.Errorf("query '%v' is not a simple SELECT, it can't be materialized", sql)
+	}
+	if len(sel.OrderBy) == 0 {
+		return "", "", fmt.Errorf("query '%v' is not ordered, it can't be materialized", sql)
+	}
+	qualifyTables(sel.From, table.Qualifier)
+	create := fmt.Sprintf("create table %v as %v", sqlparser.String(table), sqlparser.String(sel))
+
+	// the copied columns are only known by their name in the
+	// table
+	for _, order := range sel.OrderBy {
+		col := orderByColumn(order)
+		if col == nil {
+			return "", "", fmt.Errorf("query '%v' must be ordered by columns to be materialized, got %v", sql, sqlparser.String(order))
+		}
+		col.Qualifier = nil
+	}
+	read := fmt.Sprintf("select * from %v%v", sqlparser.String(table), sqlparser.String(sel.OrderBy))
+	return create, read, nil
+}
+
+// qualifyTables qualifies the unqualified tables of a FROM clause,
+// including the ones of its derived tables, with the database db.
+func qualifyTables(exprs sqlparser.TableExprs, db []byte) {
+	for _, expr := range exprs {
+		qualifyTable(expr, db)
+	}
+}
+
+func qualifyTable(expr sqlparser.TableExpr, db []byte) {
+	switch expr := expr.(type) {
+	case *sqlparser.AliasedTableExpr:
+		switch table := expr.Expr.(type) {
+		case *sqlparser.TableName:
+			if table.Qualifier == nil {
+				table.Qualifier = db
+			}
+		case *sqlparser.Subquery:
+			if sel, ok := table.Select.(*sqlparser.Select); ok {
+				qualifyTables(sel.From, db)
+			}
+		}
+	case *sqlparser.ParenTableExpr:
+		qualifyTable(expr.Expr, db)
+	case *sqlparser.JoinTableExpr:
+		qualifyTable(expr.LeftExpr, db)
+		qualifyTable(expr.RightExpr, db)
+	}
+}
+
+// materializeSuperset copies the rows of the superset query into a new
+// scratch table, and points the superset query to it. The returned
+// function restores the query, and drops the table. If dropping it
+// fails, it is left to the cleanup.
+func (worker *SQLDiffWorker) materializeSuperset() (func(), error) {
+	alias := worker.superset.alias
+	tablet, err := worker.wr.TopoServer().GetTablet(alias)
+	if err != nil {
+		return nil, categorize(SQLDiffErrorRPC, err)
+	}
+	worker.mu.Lock()
+	worker.materializations++
+	table := &sqlparser.TableName{
+		Name:      []byte(fmt.Sprintf("%v%v_%v", materializedTablePrefix, strings.Replace(worker.runID, "-", "_", -1), worker.materializations)),
+		Qualifier: []byte(tablet.DbName()),
+	}
+	worker.mu.Unlock()
+	create, read, err := materializeSQL(worker.superset.SQL, table)
+	if err != nil {
+		return nil, err
+	}
+
+	// the drop is recorded first, so a copy interrupted half way
+	// is dropped too
+	action := dropTableAction{alias: alias, table: sqlparser.String(table)}
+	worker.cleaner.Record(dropTableActionName, action.table, action)
+	ctx := worker.ctx
+	timeout := worker.superset.QueryTimeout
+	if timeout == 0 {
+		timeout = worker.options.QueryTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	release, err := worker.acquireRPC()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	_, err = worker.wr.ExecuteFetchAsDba(ctx, alias, create, 0, false, true)
+	release()
+	if err != nil {
+		worker.wr.Logger().Errorf("Materializing the superset in %v on %v failed: %v", action.table, alias, err)
+		if qerr := newSQLDiffQueryError("superset", err); qerr != nil {
+			return nil, categorize(SQLDiffErrorQuery, qerr)
+		}
+		return nil, categorize(SQLDiffErrorRPC, err)
+	}
+	worker.wr.Logger().Infof("Materialized the superset in %v on %v in %v", action.table, alias, time.Now().Sub(start))
+
+	sql := worker.superset.SQL
+	worker.superset.SQL = read
+	return func() {
+		worker.superset.SQL = sql
+		ctx, cancel := context.WithTimeout(worker.ctx, 60*time.Second)
+		err := action.CleanUp(ctx, worker.wr)
+		cancel()
+		if err != nil {
+			worker.wr.Logger().Warningf("Cannot drop %v on %v, leaving it to the cleanup: %v", action.table, alias, err)
+			return
+		}
+		worker.cleaner.RemoveActionByName(dropTableActionName, action.table)
+	}, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/sqlparser"
+	"github.com/youtube/vitess/go/vt/tabletmanager/faketmclient"
+	"github.com/youtube/vitess/go/vt/tabletmanager/tmclient"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+func TestMaterializeSQL(t *testing.T) {
+	table := &sqlparser.TableName{Name: []byte("_vt_sqldiff_1"), Qualifier: []byte("vt_ks")}
+	create, read, err := materializeSQL("select t.id, u.msg from t join other.u on t.id = u.id where t.id > 10 order by binary(t.id)", table)
+	if err != nil {
+		t.Fatalf("materializeSQL failed: %v", err)
+	}
+	if want := "create table vt_ks._vt_sqldiff_1 as select t.id, u.msg from vt_ks.t join other.u on t.id = u.id where t.id > 10 order by binary(t.id) asc"; create != want {
+		t.Errorf("create query = %v, want %v", create, want)
+	}
+	if want := "select * from vt_ks._vt_sqldiff_1 order by binary(id) asc"; read != want {
+		t.Errorf("read query = %v, want %v", read, want)
+	}
+
+	for _, sql := range []string{
+		"select id from t",
+		"select id, msg from t order by id + 1",
+		"select id from t union select id from u",
+	} {
+		if _, _, err := materializeSQL(sql, table); err == nil {
+			t.Errorf("materializeSQL(%v) should have failed", sql)
+		}
+	}
+}
+
+// executeFetchRecordingTabletManagerClient records the queries run
+// with ExecuteFetchAsDba.
+type executeFetchRecordingTabletManagerClient struct {
+	tmclient.TabletManagerClient
+	queries []string
+}
+
+func (client *executeFetchRecordingTabletManagerClient) ExecuteFetchAsDba(ctx context.Context, tablet *topo.TabletInfo, query string, maxRows int, wantFields, disableBinlogs bool) (*mproto.QueryResult, error) {
+	client.queries = append(client.queries, query)
+	return &mproto.QueryResult{}, nil
+}
+
+func TestSqlDifferMaterializeSuperset(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	client := &executeFetchRecordingTabletManagerClient{TabletManagerClient: faketmclient.NewFakeTabletManagerClient()}
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, client, time.Second)
+	supersetAlias := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	if err := topo.CreateTablet(ts, &topo.Tablet{
+		Alias:    supersetAlias,
+		Hostname: "localhost",
+		Keyspace: "ks",
+		Shard:    "0",
+		Type:     topo.TYPE_CHECKER,
+	}); err != nil {
+		t.Fatalf("CreateTablet failed: %v", err)
+	}
+
+	var reads []string
+	factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+		reads = append(reads, sql)
+		return newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"})), nil
+	}
+	sql := "select id, msg from t order by id"
+	wrk := NewSQLDiffWorker(wr, "cell1",
+		SourceSpec{Keyspace: "ks", Shard: "0", SQL: sql, alias: supersetAlias},
+		SourceSpec{Keyspace: "ks2", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 2}},
+		SQLDiffOptions{MaterializeSuperset: true, NewQueryResultReader: factory}).(*SQLDiffWorker)
+	if err := wrk.checkMaterialize(); err != nil {
+		t.Fatalf("checkMaterialize failed: %v", err)
+	}
+	if _, err := wrk.diff(nil); err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+
+	table := "vt_ks." + materializedTablePrefix + strings.Replace(wrk.runID, "-", "_", -1) + "_1"
+	if len(client.queries) != 2 || client.queries[0] != "create table "+table+" as select id, msg from vt_ks.t order by id asc" || client.queries[1] != "DROP TABLE IF EXISTS "+table {
+		t.Errorf("unexpected queries on the superset tablet: %v", client.queries)
+	}
+	if len(reads) != 2 || reads[0] != "select * from "+table+" order by id asc" || reads[1] != sql {
+		t.Errorf("unexpected reads: %v", reads)
+	}
+	if wrk.superset.SQL != sql || !wrk.cleaner.IsEmpty() {
+		t.Errorf("superset query not restored or table not dropped: %v, cleaner empty: %v", wrk.superset.SQL, wrk.cleaner.IsEmpty())
+	}
+}
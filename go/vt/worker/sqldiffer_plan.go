@@ -0,0 +1,53 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+)
+
+// This file contains the review of the queries of a SQLDiffWorker,
+// before they are sent to the tablets.
+
+// PlannedQueries returns the queries the worker sends for both sides,
+// after all the rewrites of its options: filter, delta and key sort.
+// They are empty until the tablets are picked. The ChecksumBlockSize
+// and MaterializeSuperset options rewrite them again during the diff,
+// from these queries.
+func (worker *SQLDiffWorker) PlannedQueries() (superset, subset string) {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.plannedSuperset, worker.plannedSubset
+}
+
+// planQueries records the final queries of both sides, and lets the
+// ReviewQueries hook, if any, approve or override them. The overridden
+// queries are checked again.
+func (worker *SQLDiffWorker) planQueries() error {
+	superset, subset := worker.superset.SQL, worker.subset.SQL
+	if review := worker.options.ReviewQueries; review != nil {
+		reviewedSuperset, reviewedSubset, err := review(superset, subset)
+		if err != nil {
+			return fmt.Errorf("queries rejected by review: %v", err)
+		}
+		if reviewedSuperset != superset || reviewedSubset != subset {
+			worker.wr.Logger().Warningf("Queries overridden by review: superset %q, subset %q", reviewedSuperset, reviewedSubset)
+			worker.superset.SQL = reviewedSuperset
+			worker.subset.SQL = reviewedSubset
+			if err := worker.checkQueries(); err != nil {
+				return fmt.Errorf("invalid queries from review: %v", err)
+			}
+			superset, subset = worker.superset.SQL, worker.subset.SQL
+		}
+	}
+	worker.wr.Logger().Infof("Superset query: %v", superset)
+	worker.wr.Logger().Infof("Subset query: %v", subset)
+
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	worker.plannedSuperset = superset
+	worker.plannedSubset = subset
+	return nil
+}
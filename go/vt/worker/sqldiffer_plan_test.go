@@ -0,0 +1,54 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestSqlDifferPlannedQueries(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	sql := "SELECT id, msg FROM t ORDER BY id"
+	for _, c := range []struct {
+		review       func(superset, subset string) (string, string, error)
+		wantSuperset string
+		wantErr      bool
+	}{
+		{nil, sql, false},
+		{func(superset, subset string) (string, string, error) {
+			return "SELECT id, msg FROM t WHERE id < 100 ORDER BY id", subset, nil
+		}, "SELECT id, msg FROM t WHERE id < 100 ORDER BY id", false},
+		{func(superset, subset string) (string, string, error) {
+			return "", "", fmt.Errorf("full scan of t")
+		}, "", true},
+		{func(superset, subset string) (string, string, error) {
+			return "DELETE FROM t", subset, nil
+		}, "", true},
+	} {
+		wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "ks1", Shard: "0", SQL: sql}, SourceSpec{Keyspace: "ks2", Shard: "0", SQL: sql}, SQLDiffOptions{ReviewQueries: c.review}).(*SQLDiffWorker)
+		err := wrk.planQueries()
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("planQueries() should have failed")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("planQueries failed: %v", err)
+		}
+		superset, subset := wrk.PlannedQueries()
+		if superset != c.wantSuperset || subset != sql {
+			t.Errorf("PlannedQueries() = %q, %q", superset, subset)
+		}
+		if wrk.superset.SQL != c.wantSuperset {
+			t.Errorf("superset query = %q", wrk.superset.SQL)
+		}
+	}
+}
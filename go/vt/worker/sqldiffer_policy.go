@@ -0,0 +1,69 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// This file contains the operational policies the SQLDiffWorker
+// enforces before running.
+
+var peakWindow = flag.String("sqldiff_peak_window", "", "daily window of peak traffic during which SQLDiffWorkers reading from tablets refuse to run, like 09:00-18:00 in local time, unless they set IgnorePeakWindow")
+
+// dailyWindow is a time of day window, which can span midnight.
+type dailyWindow struct {
+	start, end time.Duration
+}
+
+// parseDailyWindow parses a window like "09:00-18:00".
+func parseDailyWindow(window string) (dailyWindow, error) {
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return dailyWindow{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", window)
+	}
+	var result [2]time.Duration
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return dailyWindow{}, fmt.Errorf("invalid window %q: %v", window, err)
+		}
+		result[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return dailyWindow{start: result[0], end: result[1]}, nil
+}
+
+// contains returns true if the time of day of t is in the window.
+func (w dailyWindow) contains(t time.Time) bool {
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start <= w.end {
+		return tod >= w.start && tod < w.end
+	}
+	return tod >= w.start || tod < w.end
+}
+
+// checkPeakWindow returns an error if the worker reads from tablets,
+// through vtgate or directly, and now is in the -sqldiff_peak_window,
+// unless the IgnorePeakWindow option is set. External MySQL servers
+// and snapshots are not part of the cluster.
+func (worker *SQLDiffWorker) checkPeakWindow(now time.Time) error {
+	if *peakWindow == "" || worker.options.IgnorePeakWindow {
+		return nil
+	}
+	if (worker.superset.DSN != "" || worker.superset.Snapshot != "") && (worker.subset.DSN != "" || worker.subset.Snapshot != "") {
+		return nil
+	}
+	window, err := parseDailyWindow(*peakWindow)
+	if err != nil {
+		return fmt.Errorf("invalid -sqldiff_peak_window: %v", err)
+	}
+	if window.contains(now) {
+		return fmt.Errorf("diffs disabled during peak window (%v), set IgnorePeakWindow to override", *peakWindow)
+	}
+	return nil
+}
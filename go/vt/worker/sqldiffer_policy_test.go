@@ -0,0 +1,69 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestDailyWindow(t *testing.T) {
+	day := time.Date(2015, 6, 1, 0, 0, 0, 0, time.Local)
+	for _, c := range []struct {
+		window string
+		at     time.Duration
+		want   bool
+	}{
+		{"09:00-18:00", 9 * time.Hour, true},
+		{"09:00-18:00", 17*time.Hour + 59*time.Minute, true},
+		{"09:00-18:00", 18 * time.Hour, false},
+		{"09:00-18:00", 3 * time.Hour, false},
+		{"22:00-02:00", 23 * time.Hour, true},
+		{"22:00-02:00", time.Hour, true},
+		{"22:00-02:00", 12 * time.Hour, false},
+	} {
+		w, err := parseDailyWindow(c.window)
+		if err != nil {
+			t.Fatalf("parseDailyWindow(%v) failed: %v", c.window, err)
+		}
+		if got := w.contains(day.Add(c.at)); got != c.want {
+			t.Errorf("window %v contains %v = %v, want %v", c.window, c.at, got, c.want)
+		}
+	}
+	for _, window := range []string{"09:00", "9h-18h", "09:00-25:00"} {
+		if _, err := parseDailyWindow(window); err == nil {
+			t.Errorf("parseDailyWindow(%v) should have failed", window)
+		}
+	}
+}
+
+func TestSqlDifferPeakWindow(t *testing.T) {
+	*peakWindow = "09:00-18:00"
+	defer func() { *peakWindow = "" }()
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	noon := time.Date(2015, 6, 1, 12, 0, 0, 0, time.Local)
+
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "ks1", Shard: "0"}, SourceSpec{Keyspace: "ks2", Shard: "0"}, SQLDiffOptions{}).(*SQLDiffWorker)
+	if err := wrk.checkPeakWindow(noon); err == nil || !strings.Contains(err.Error(), "peak window (09:00-18:00)") {
+		t.Errorf("unexpected error during the peak window: %v", err)
+	}
+	if err := wrk.checkPeakWindow(noon.Add(8 * time.Hour)); err != nil {
+		t.Errorf("checkPeakWindow failed outside the peak window: %v", err)
+	}
+
+	// the override, and diffs not reading from tablets, can run
+	wrk.options.IgnorePeakWindow = true
+	if err := wrk.checkPeakWindow(noon); err != nil {
+		t.Errorf("checkPeakWindow failed with IgnorePeakWindow: %v", err)
+	}
+	external := NewSQLDiffWorker(wr, "", SourceSpec{DSN: "user@tcp(db1:3306)/app"}, SourceSpec{DSN: "user@tcp(db2:3306)/app"}, SQLDiffOptions{}).(*SQLDiffWorker)
+	if err := external.checkPeakWindow(noon); err != nil {
+		t.Errorf("checkPeakWindow failed without tablets: %v", err)
+	}
+}
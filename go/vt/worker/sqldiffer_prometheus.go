@@ -0,0 +1,98 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// This file renders the last SQLDiffWorker run of each check in the
+// Prometheus text exposition format.
+
+// sqlDiffMetrics are the gauges exported for the last run of each
+// check, with the function extracting their value from the run.
+var sqlDiffMetrics = []struct {
+	name  string
+	help  string
+	value func(result DiffResult) float64
+}{
+	{
+		name: "vitess_sqldiff_differences",
+		help: "Number of differences found by the last run of the check.",
+		value: func(result DiffResult) float64 {
+			return float64(result.MissingInSuperset + result.MissingInSubset + result.ValueMismatch)
+		},
+	},
+	{
+		name: "vitess_sqldiff_rows_processed",
+		help: "Number of rows processed by the last run of the check.",
+		value: func(result DiffResult) float64 {
+			return float64(result.ProcessedRows)
+		},
+	},
+	{
+		name: "vitess_sqldiff_bytes_read",
+		help: "Number of bytes read from both sides by the last run of the check.",
+		value: func(result DiffResult) float64 {
+			return float64(result.SupersetBytesRead + result.SubsetBytesRead)
+		},
+	},
+	{
+		name: "vitess_sqldiff_last_run_timestamp",
+		help: "Time the last run of the check finished, in seconds since the epoch.",
+		value: func(result DiffResult) float64 {
+			return float64(result.EndTime.Unix())
+		},
+	},
+}
+
+// lastResults returns the last result of each check in the history.
+func (r *sqlDiffRegistry) lastResults() map[string]DiffResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make(map[string]DiffResult, len(r.history))
+	for key, history := range r.history {
+		if len(history) > 0 {
+			result[key] = history[len(history)-1]
+		}
+	}
+	return result
+}
+
+// prometheusLabelValue escapes a label value for the Prometheus text
+// format.
+var prometheusLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the gauges of the last run of each check in
+// the Prometheus text format. The checks are labeled with their
+// history key as name, and the keyspace and shard of their subset.
+func WritePrometheus(w io.Writer) error {
+	results := sqlDiffWorkers.lastResults()
+	keys := make([]string, 0, len(results))
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, metric := range sqlDiffMetrics {
+		if _, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", metric.name, metric.help, metric.name); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			result := results[key]
+			if _, err := fmt.Fprintf(w, "%v{keyspace=\"%v\",shard=\"%v\",name=\"%v\"} %v\n", metric.name,
+				prometheusLabelValue.Replace(result.Config.Subset.Keyspace),
+				prometheusLabelValue.Replace(result.Config.Subset.Shard),
+				prometheusLabelValue.Replace(key),
+				metric.value(result)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	sqlDiffWorkers.record("TestWritePrometheus", DiffResult{
+		SQLDiffStatus: SQLDiffStatus{ProcessedRows: 20},
+		EndTime:       time.Unix(1000, 0),
+	})
+	sqlDiffWorkers.record("TestWritePrometheus", DiffResult{
+		SQLDiffStatus: SQLDiffStatus{MissingInSuperset: 2, ValueMismatch: 1, ProcessedRows: 30},
+		EndTime:       time.Unix(2000, 0),
+		Config: SQLDiffConfig{
+			Subset: SourceSpec{Keyspace: "lookup", Shard: "-80"},
+		},
+	})
+
+	buf := &bytes.Buffer{}
+	if err := WritePrometheus(buf); err != nil {
+		t.Fatalf("WritePrometheus failed: %v", err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"# TYPE vitess_sqldiff_differences gauge\n",
+		`vitess_sqldiff_differences{keyspace="lookup",shard="-80",name="TestWritePrometheus"} 3` + "\n",
+		`vitess_sqldiff_rows_processed{keyspace="lookup",shard="-80",name="TestWritePrometheus"} 30` + "\n",
+		`vitess_sqldiff_last_run_timestamp{keyspace="lookup",shard="-80",name="TestWritePrometheus"} 2000` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("WritePrometheus output doesn't contain %q:\n%v", want, got)
+		}
+	}
+}
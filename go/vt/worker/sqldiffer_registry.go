@@ -0,0 +1,144 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/sqltypes"
+)
+
+// This file contains the registry of the live SQLDiffWorkers, so
+// they can be acted upon as a group, and the history of their runs.
+
+// sqlDiffHistorySize is the number of runs kept in the history of
+// each check.
+const sqlDiffHistorySize = 10
+
+// DiffResult is the outcome of a SQLDiffWorker run, as kept in the
+// history.
+type DiffResult struct {
+	SQLDiffStatus
+
+	// EndTime is when the run finished.
+	EndTime time.Time
+
+	// Config is the configuration of the run, to reproduce it.
+	Config SQLDiffConfig
+}
+
+// JSON returns the result encoded in JSON.
+func (result DiffResult) JSON() (string, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// sqlDiffRegistry tracks the live SQLDiffWorkers. Workers are
+// registered when Run starts, and unregistered when it returns, so
+// the workers that are never run aren't kept. It also
+// keeps the results of the last runs of each check, and the
+// checkpoints of the checks using SQLDiffOptions.Delta.
+type sqlDiffRegistry struct {
+	mu          sync.Mutex
+	workers     map[*SQLDiffWorker]bool
+	history     map[string][]DiffResult
+	checkpoints map[string]deltaCheckpoint
+}
+
+var sqlDiffWorkers = &sqlDiffRegistry{
+	workers:     make(map[*SQLDiffWorker]bool),
+	history:     make(map[string][]DiffResult),
+	checkpoints: make(map[string]deltaCheckpoint),
+}
+
+// deltaCheckpoint is where the next delta run of a check starts.
+type deltaCheckpoint struct {
+	// highWaterKey is the last key of the last clean run.
+	highWaterKey sqltypes.Value
+
+	// deltaRuns counts the clean delta runs since the last clean
+	// full run.
+	deltaRuns int
+}
+
+// checkpoint returns the delta checkpoint of a check, if any.
+func (r *sqlDiffRegistry) checkpoint(key string) (deltaCheckpoint, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	checkpoint, ok := r.checkpoints[key]
+	return checkpoint, ok
+}
+
+// setCheckpoint records the delta checkpoint of a check.
+func (r *sqlDiffRegistry) setCheckpoint(key string, checkpoint deltaCheckpoint) {
+	r.mu.Lock()
+	r.checkpoints[key] = checkpoint
+	r.mu.Unlock()
+}
+
+// record adds a result to the history of a check, dropping the
+// oldest one if the history is full.
+func (r *sqlDiffRegistry) record(key string, result DiffResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	history := append(r.history[key], result)
+	if len(history) > sqlDiffHistorySize {
+		history = history[len(history)-sqlDiffHistorySize:]
+	}
+	r.history[key] = history
+}
+
+// History returns the results of the last runs of a check, oldest
+// first. See SQLDiffWorker.HistoryKey for the key.
+func History(key string) []DiffResult {
+	sqlDiffWorkers.mu.Lock()
+	defer sqlDiffWorkers.mu.Unlock()
+	history := sqlDiffWorkers.history[key]
+	result := make([]DiffResult, len(history))
+	copy(result, history)
+	return result
+}
+
+func (r *sqlDiffRegistry) register(worker *SQLDiffWorker) {
+	r.mu.Lock()
+	r.workers[worker] = true
+	r.mu.Unlock()
+}
+
+func (r *sqlDiffRegistry) unregister(worker *SQLDiffWorker) {
+	r.mu.Lock()
+	delete(r.workers, worker)
+	r.mu.Unlock()
+}
+
+// forKeyspace returns the registered workers that read from the
+// keyspace, on either side.
+func (r *sqlDiffRegistry) forKeyspace(keyspace string) []*SQLDiffWorker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []*SQLDiffWorker
+	for worker := range r.workers {
+		if worker.superset.Keyspace == keyspace || worker.subset.Keyspace == keyspace {
+			result = append(result, worker)
+		}
+	}
+	return result
+}
+
+// CancelAllForKeyspace cancels all the live SQLDiffWorkers that read
+// from the provided keyspace, on either side. It returns the number
+// of cancelled workers. Their cleanup actions will still run.
+func CancelAllForKeyspace(keyspace string) int {
+	workers := sqlDiffWorkers.forKeyspace(keyspace)
+	for _, worker := range workers {
+		worker.Cancel()
+	}
+	return len(workers)
+}
@@ -0,0 +1,68 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestCancelAllForKeyspace(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	w1 := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "main", Shard: "0"}, SourceSpec{Keyspace: "lookup", Shard: "0"}, SQLDiffOptions{}).(*SQLDiffWorker)
+	w2 := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "other", Shard: "0"}, SourceSpec{Keyspace: "other_lookup", Shard: "0"}, SQLDiffOptions{}).(*SQLDiffWorker)
+	// the workers are only registered while they run
+	if got := CancelAllForKeyspace("lookup"); got != 0 {
+		t.Errorf("CancelAllForKeyspace(lookup) before Run = %v, want 0", got)
+	}
+
+	// as if they were running
+	sqlDiffWorkers.register(w1)
+	sqlDiffWorkers.register(w2)
+	defer sqlDiffWorkers.unregister(w1)
+	defer sqlDiffWorkers.unregister(w2)
+
+	if got := CancelAllForKeyspace("lookup"); got != 1 {
+		t.Errorf("CancelAllForKeyspace(lookup) = %v, want 1", got)
+	}
+	if w1.ctx.Err() == nil {
+		t.Errorf("worker reading from lookup wasn't cancelled")
+	}
+	if w2.ctx.Err() != nil {
+		t.Errorf("worker reading from other was cancelled")
+	}
+
+	sqlDiffWorkers.unregister(w1)
+	if got := CancelAllForKeyspace("lookup"); got != 0 {
+		t.Errorf("CancelAllForKeyspace(lookup) after unregister = %v, want 0", got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	key := "TestHistory"
+	for i := 0; i < sqlDiffHistorySize+2; i++ {
+		sqlDiffWorkers.record(key, DiffResult{SQLDiffStatus: SQLDiffStatus{ProcessedRows: i}})
+	}
+	history := History(key)
+	if len(history) != sqlDiffHistorySize {
+		t.Fatalf("History returned %v results, want %v", len(history), sqlDiffHistorySize)
+	}
+	if history[0].ProcessedRows != 2 || history[sqlDiffHistorySize-1].ProcessedRows != sqlDiffHistorySize+1 {
+		t.Errorf("History didn't keep the last runs: %+v", history)
+	}
+
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "main", Shard: "0"}, SourceSpec{Keyspace: "lookup", Shard: "0"}, SQLDiffOptions{Name: "TestHistoryWorker"}).(*SQLDiffWorker)
+	wrk.Run()
+	if history := History("TestHistoryWorker"); len(history) != 1 || history[0].RunID != wrk.RunID() || history[0].EndTime.IsZero() {
+		t.Errorf("unexpected history after a run: %+v", history)
+	}
+	if history := History("TestHistoryWorker"); len(history) == 1 && history[0].Config.Options.Name != "TestHistoryWorker" {
+		t.Errorf("history didn't record the run config: %+v", history[0].Config)
+	}
+}
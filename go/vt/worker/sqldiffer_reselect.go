@@ -0,0 +1,266 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// This file contains the ReselectOnUnhealthy option of the
+// SQLDiffWorker, which replaces a tablet becoming unhealthy during the
+// diff, and resumes the diff on the new one.
+
+const (
+	// maxReselections is the number of tablets a run can replace.
+	maxReselections = 3
+
+	// reselectionDelay is the minimum time between two
+	// reselections, so a shard whose tablets keep going bad is not
+	// churned through.
+	reselectionDelay = 10 * time.Second
+)
+
+// checkReselect checks the ReselectOnUnhealthy option can be used:
+// the diff is resumed after the last key compared, so the options
+// needing the full results in a single pass are rejected.
+func (worker *SQLDiffWorker) checkReselect() error {
+	switch {
+	case worker.keyCount() != 1:
+		return fmt.Errorf("ReselectOnUnhealthy requires a single key column")
+	case worker.options.KeyFunc != nil:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with a KeyFunc")
+	case worker.options.RerunOnDifference:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with RerunOnDifference")
+	case worker.options.Delta:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with Delta, the high-water key would only cover the resumed diff")
+	case worker.options.ChecksumBlockSize > 0:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with ChecksumBlockSize")
+	case worker.options.MaterializeSuperset:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with MaterializeSuperset, the materialized table only exists on the superset tablet")
+	case worker.options.CountAssertion.Kind != "" || worker.options.VerifyChecksum:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with a CountAssertion or VerifyChecksum, they need all the rows in a single diff")
+	case worker.options.SameTablet:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with SameTablet")
+	case worker.superset.AllShards:
+		return fmt.Errorf("ReselectOnUnhealthy can't be used with AllShards")
+	case !worker.superset.hasTablet() && !worker.subset.hasTablet():
+		return fmt.Errorf("ReselectOnUnhealthy requires a side read from a tablet")
+	}
+	return nil
+}
+
+// diffContext returns the context the diff runs in.
+func (worker *SQLDiffWorker) diffContext() context.Context {
+	if worker.diffCtx != nil {
+		return worker.diffCtx
+	}
+	return worker.ctx
+}
+
+// diffInterrupted returns true if the diff alone was interrupted, to
+// be resumed, while the run goes on.
+func (worker *SQLDiffWorker) diffInterrupted() bool {
+	return worker.diffCtx != nil && worker.diffCtx.Err() != nil && worker.ctx.Err() == nil
+}
+
+// carryOver records the progress of an interrupted diff: its counts
+// are added to the ones of the resumed diff, which starts after its
+// last key compared. The rows the readers yielded past it were only
+// buffered.
+func (worker *SQLDiffWorker) carryOver(report DiffReport) {
+	worker.carried = worker.carried.add(newSQLDiffCounts(report, worker.options.Reverse))
+	worker.mu.Lock()
+	worker.processedRows += report.ProcessedRows()
+	worker.mu.Unlock()
+	for _, resumable := range worker.resumables {
+		resumable.Seek(report.resumeKey)
+	}
+}
+
+// newResumables sets up the ResumableReaders of both sides, which
+// open their readers on the current tablets of the sides.
+func (worker *SQLDiffWorker) newResumables() error {
+	worker.resumables = make(map[string]*ResumableReader)
+	for _, name := range []string{"superset", "subset"} {
+		name := name
+		spec := &worker.superset
+		if name == "subset" {
+			spec = &worker.subset
+		}
+		resumable, err := NewResumableReader(spec.SQL, func(ctx context.Context, sql string) (*QueryResultReader, context.CancelFunc, error) {
+			current := *spec
+			current.SQL = sql
+			return worker.openReader(ctx, name, current)
+		})
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		worker.resumables[name] = resumable
+	}
+	return nil
+}
+
+// diffWithReselection runs the diff, and with the ReselectOnUnhealthy
+// option watches the health of its tablets: when one becomes
+// unhealthy, the diff is stopped, the tablet replaced, and the diff
+// resumed.
+func (worker *SQLDiffWorker) diffWithReselection(keys map[string]bool) (map[string]bool, error) {
+	if !worker.options.ReselectOnUnhealthy {
+		return worker.diff(keys)
+	}
+	if err := worker.newResumables(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		worker.diffCtx = nil
+		worker.resumables = nil
+	}()
+	var lastReselection time.Time
+	for {
+		ctx, cancel := context.WithCancel(worker.ctx)
+		worker.diffCtx = ctx
+		stop := worker.watchHealth(ctx, cancel)
+		differentKeys, err := worker.diff(keys)
+		alias, reason := stop()
+		cancel()
+		if err == nil || alias.IsZero() || worker.ctx.Err() != nil {
+			return differentKeys, err
+		}
+		if err != topo.ErrInterrupted && errorCategory(err) != SQLDiffErrorRPC {
+			return differentKeys, err
+		}
+		if len(worker.reselections) == maxReselections {
+			return nil, categorize(SQLDiffErrorNoTarget, fmt.Errorf("tablet %v became unhealthy (%v), and %v tablets were already reselected", alias, reason, maxReselections))
+		}
+		if wait := reselectionDelay - time.Now().Sub(lastReselection); wait > 0 {
+			worker.wr.Logger().Infof("Waiting %v before reselecting tablet %v", wait, alias)
+			select {
+			case <-time.After(wait):
+			case <-worker.ctx.Done():
+				return nil, topo.ErrInterrupted
+			}
+		}
+		lastReselection = time.Now()
+		if err := worker.reselect(alias, reason); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// watchHealth streams the health of the tablets of the diff, and
+// cancels the diff when one reports an error. The returned function
+// stops watching, and returns the unhealthy tablet and its error, or a
+// zero alias if none was. The tablets whose health can't be streamed
+// are not watched.
+func (worker *SQLDiffWorker) watchHealth(ctx context.Context, cancelDiff context.CancelFunc) func() (topo.TabletAlias, string) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var unhealthy topo.TabletAlias
+	var reason string
+	for _, spec := range []SourceSpec{worker.superset, worker.subset} {
+		if !spec.hasTablet() {
+			continue
+		}
+		wg.Add(1)
+		go func(alias topo.TabletAlias) {
+			defer wg.Done()
+			tablet, err := worker.wr.TopoServer().GetTablet(alias)
+			if err != nil {
+				worker.wr.Logger().Warningf("Cannot watch the health of tablet %v: %v", alias, err)
+				return
+			}
+			stream, errFunc, err := worker.wr.TabletManagerClient().HealthStream(ctx, tablet)
+			if err != nil {
+				worker.wr.Logger().Warningf("Cannot watch the health of tablet %v: %v", alias, err)
+				return
+			}
+			for {
+				select {
+				case reply, ok := <-stream:
+					if !ok {
+						if err := errFunc(); err != nil && ctx.Err() == nil {
+							worker.wr.Logger().Warningf("Stopped watching the health of tablet %v: %v", alias, err)
+						}
+						return
+					}
+					if reply.HealthError == "" {
+						continue
+					}
+					mu.Lock()
+					if unhealthy.IsZero() {
+						unhealthy, reason = alias, reply.HealthError
+						worker.wr.Logger().Warningf("Tablet %v became unhealthy, stopping the diff: %v", alias, reply.HealthError)
+						cancelDiff()
+					}
+					mu.Unlock()
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(spec.alias)
+	}
+	return func() (topo.TabletAlias, string) {
+		cancel()
+		wg.Wait()
+		return unhealthy, reason
+	}
+}
+
+// reselect replaces the unhealthy tablet with a new one, and
+// synchronizes replication again. The ResumableReaders then resume
+// the diff after the last key compared.
+func (worker *SQLDiffWorker) reselect(alias topo.TabletAlias, reason string) error {
+	worker.setState(sqlDiffFindTargets, fmt.Sprintf("tablet %v unhealthy: %v, reselecting", alias, reason))
+	for _, a := range []topo.TabletAlias{worker.subset.alias, worker.superset.alias} {
+		if err := worker.restartReplication(a); err != nil {
+			return categorize(SQLDiffErrorRPC, err)
+		}
+	}
+
+	supersetAlias, subsetAlias := worker.superset.alias, worker.subset.alias
+	for _, side := range []struct {
+		spec  SourceSpec
+		alias *topo.TabletAlias
+	}{
+		{worker.superset, &supersetAlias},
+		{worker.subset, &subsetAlias},
+	} {
+		if *side.alias != alias {
+			continue
+		}
+		newAlias, err := worker.findChecker(worker.ctx, worker.cleaner, side.spec, side.spec.Shard, worker.targetSelector())
+		if err != nil {
+			return categorize(SQLDiffErrorNoTarget, fmt.Errorf("cannot replace unhealthy tablet %v: %v", alias, err))
+		}
+		*side.alias = newAlias
+	}
+	worker.setAliases(supersetAlias, subsetAlias)
+
+	resume := "from the start"
+	if resumeKey := worker.resumables["superset"].LastKey(); !resumeKey.IsNull() {
+		resume = fmt.Sprintf("after key %v", resumeKey)
+	}
+	reselection := fmt.Sprintf("%v (%v), replaced by superset %v, subset %v, resuming %v", alias, reason, supersetAlias, subsetAlias, resume)
+	worker.mu.Lock()
+	worker.reselections = append(worker.reselections, reselection)
+	worker.mu.Unlock()
+	worker.wr.Logger().Infof("Reselected unhealthy tablet %v", reselection)
+
+	if err := worker.runPhase("replication synchronization", true, worker.synchronizeReplicationPhase); err != nil {
+		return err
+	}
+	if worker.checkInterrupted() {
+		return topo.ErrInterrupted
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/tabletmanager/actionnode"
+	"github.com/youtube/vitess/go/vt/tabletmanager/faketmclient"
+	"github.com/youtube/vitess/go/vt/tabletmanager/tmclient"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+// unhealthyTabletManagerClient streams a health error for the
+// unhealthy tablet, and nothing for the others.
+type unhealthyTabletManagerClient struct {
+	tmclient.TabletManagerClient
+	unhealthy topo.TabletAlias
+}
+
+func (client *unhealthyTabletManagerClient) HealthStream(ctx context.Context, tablet *topo.TabletInfo) (<-chan *actionnode.HealthStreamReply, tmclient.ErrFunc, error) {
+	stream := make(chan *actionnode.HealthStreamReply, 1)
+	if tablet.Alias == client.unhealthy {
+		stream <- &actionnode.HealthStreamReply{HealthError: "disk full"}
+	}
+	return stream, func() error { return nil }, nil
+}
+
+func TestSqlDifferWatchHealth(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	supersetAlias := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	subsetAlias := topo.TabletAlias{Cell: "cell1", Uid: 2}
+	client := &unhealthyTabletManagerClient{TabletManagerClient: faketmclient.NewFakeTabletManagerClient(), unhealthy: subsetAlias}
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, client, time.Second)
+	for _, alias := range []topo.TabletAlias{supersetAlias, subsetAlias} {
+		if err := topo.CreateTablet(ts, &topo.Tablet{
+			Alias:    alias,
+			Hostname: "localhost",
+			Keyspace: "ks",
+			Shard:    "0",
+			Type:     topo.TYPE_CHECKER,
+		}); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+	}
+
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "ks", Shard: "0"}, SourceSpec{Keyspace: "ks", Shard: "0"}, SQLDiffOptions{ReselectOnUnhealthy: true}).(*SQLDiffWorker)
+	wrk.setAliases(supersetAlias, subsetAlias)
+
+	// the diff is cancelled as soon as the subset tablet is unhealthy
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := wrk.watchHealth(ctx, cancel)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the diff was not cancelled")
+	}
+	if alias, reason := stop(); alias != subsetAlias || reason != "disk full" {
+		t.Errorf("stop() = %v, %q, want %v, %q", alias, reason, subsetAlias, "disk full")
+	}
+
+	// healthy tablets let the diff run
+	client.unhealthy = topo.TabletAlias{}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	stop = wrk.watchHealth(ctx, cancel)
+	time.Sleep(50 * time.Millisecond)
+	if alias, _ := stop(); !alias.IsZero() || ctx.Err() != nil {
+		t.Errorf("stop() = %v with the diff context error %v, want no unhealthy tablet", alias, ctx.Err())
+	}
+}
+
+func TestCheckReselect(t *testing.T) {
+	superset := SourceSpec{Keyspace: "ks", Shard: "0", SQL: "select id, msg from t order by id"}
+	subset := SourceSpec{Keyspace: "ks", Shard: "1", SQL: "select id, msg from t order by id"}
+	if err := (SQLDiffConfig{Cell: "cell1", Superset: superset, Subset: subset, Options: SQLDiffOptions{ReselectOnUnhealthy: true}}).Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+	for _, options := range []SQLDiffOptions{
+		{ReselectOnUnhealthy: true, RerunOnDifference: true},
+		{ReselectOnUnhealthy: true, SameTablet: true},
+		{ReselectOnUnhealthy: true, VerifyChecksum: true},
+	} {
+		if err := (SQLDiffConfig{Cell: "cell1", Superset: superset, Subset: subset, Options: options}).Validate(); err == nil {
+			t.Errorf("Validate() with %+v should have failed", options)
+		}
+	}
+}
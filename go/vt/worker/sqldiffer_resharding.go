@@ -0,0 +1,218 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	blproto "github.com/youtube/vitess/go/vt/binlog/proto"
+	"github.com/youtube/vitess/go/vt/key"
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains the helpers to validate a resharding with a
+// SQLDiffWorker, by comparing the rows a source and a destination
+// shard have in common.
+
+// ReshardingOverlapConfig returns the configuration of a SQLDiffWorker
+// comparing a table on the source and destination shards of a
+// resharding of keyspace, before the cutover. Only the rows in the
+// overlap of both shards key ranges are read, as filtered on the
+// sharding column, and they are compared in Exact mode, with the
+// source as the superset. The columns are read primary key first,
+// ordered by the primary key, which is the diff key. The slaves are
+// stopped at the same point of the filtered replication from the
+// source shard, see FilteredReplication.
+func ReshardingOverlapConfig(cell, keyspace, sourceShard, destinationShard string, shardingColumnName string, shardingColumnType key.KeyspaceIdType, table *myproto.TableDefinition, options SQLDiffOptions) (SQLDiffConfig, error) {
+	overlap, err := shardsOverlap(sourceShard, destinationShard)
+	if err != nil {
+		return SQLDiffConfig{}, err
+	}
+	if len(table.PrimaryKeyColumns) == 0 {
+		return SQLDiffConfig{}, fmt.Errorf("table %v has no primary key to match its rows by", table.Name)
+	}
+	where, err := keyRangeWhere(shardingColumnName, overlap, shardingColumnType)
+	if err != nil {
+		return SQLDiffConfig{}, err
+	}
+	sql := fmt.Sprintf("SELECT %v FROM %v %vORDER BY %v", strings.Join(orderedColumns(table), ", "), table.Name, where, strings.Join(table.PrimaryKeyColumns, ", "))
+
+	options.Exact = true
+	options.Reverse = false
+	options.FilteredReplication = true
+	return SQLDiffConfig{
+		Cell: cell,
+		Superset: SourceSpec{
+			Keyspace:   keyspace,
+			Shard:      sourceShard,
+			SQL:        sql,
+			KeyColumns: table.PrimaryKeyColumns,
+		},
+		Subset: SourceSpec{
+			Keyspace:   keyspace,
+			Shard:      destinationShard,
+			SQL:        sql,
+			KeyColumns: table.PrimaryKeyColumns,
+		},
+		Options: options,
+	}, nil
+}
+
+// NewReshardingOverlapSQLDiffWorker returns a SQLDiffWorker running the
+// check of ReshardingOverlapConfig.
+func NewReshardingOverlapSQLDiffWorker(wr *wrangler.Wrangler, cell, keyspace, sourceShard, destinationShard string, shardingColumnName string, shardingColumnType key.KeyspaceIdType, table *myproto.TableDefinition, options SQLDiffOptions) (Worker, error) {
+	config, err := ReshardingOverlapConfig(cell, keyspace, sourceShard, destinationShard, shardingColumnName, shardingColumnType, table, options)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLDiffWorkerFromConfig(wr, config), nil
+}
+
+// shardsOverlap returns the overlap of the key ranges of two shards.
+func shardsOverlap(sourceShard, destinationShard string) (key.KeyRange, error) {
+	_, sourceRange, err := topo.ValidateShardName(sourceShard)
+	if err != nil {
+		return key.KeyRange{}, fmt.Errorf("invalid source shard %v: %v", sourceShard, err)
+	}
+	_, destinationRange, err := topo.ValidateShardName(destinationShard)
+	if err != nil {
+		return key.KeyRange{}, fmt.Errorf("invalid destination shard %v: %v", destinationShard, err)
+	}
+	overlap, err := key.KeyRangesOverlap(sourceRange, destinationRange)
+	if err != nil {
+		return key.KeyRange{}, fmt.Errorf("source shard %v and destination shard %v have no rows in common: %v", sourceShard, destinationShard, err)
+	}
+	return overlap, nil
+}
+
+// checkFilteredReplication checks the FilteredReplication option can
+// be used: both slaves are stopped, at positions it picks.
+func (worker *SQLDiffWorker) checkFilteredReplication() error {
+	switch {
+	case !worker.superset.stopsReplication() || !worker.subset.stopsReplication():
+		return fmt.Errorf("FilteredReplication requires both sides to stop replication on a tablet")
+	case worker.options.SameTablet:
+		return fmt.Errorf("FilteredReplication can't be used with SameTablet")
+	case !worker.options.StopPosition.IsZero():
+		return fmt.Errorf("FilteredReplication can't be used with a StopPosition")
+	}
+	return nil
+}
+
+// synchronizeFilteredReplication is the synchronizeReplication phase
+// of the FilteredReplication option, which stops both slaves at the
+// same point of the filtered replication from the superset shard to
+// the subset shard, like the SplitDiffWorker:
+// 1 - stop filtered replication on the subset master
+// 2 - stop the superset slave at or after the master position
+// 3 - run filtered replication on the master until the slave position
+// 4 - stop the subset slave at or after the new master position
+// 5 - restart filtered replication on the subset master
+func (worker *SQLDiffWorker) synchronizeFilteredReplication() error {
+	si, err := worker.wr.TopoServer().GetShard(worker.subset.Keyspace, worker.subset.Shard)
+	if err != nil {
+		return fmt.Errorf("cannot read subset shard %v/%v: %v", worker.subset.Keyspace, worker.subset.Shard, err)
+	}
+	var sourceShard *topo.SourceShard
+	for i, ss := range si.SourceShards {
+		if ss.Keyspace == worker.superset.Keyspace && ss.Shard == worker.superset.Shard {
+			sourceShard = &si.SourceShards[i]
+		}
+	}
+	if sourceShard == nil {
+		return fmt.Errorf("subset shard %v/%v doesn't replicate from superset shard %v/%v", worker.subset.Keyspace, worker.subset.Shard, worker.superset.Keyspace, worker.superset.Shard)
+	}
+	if si.MasterAlias.IsZero() {
+		return fmt.Errorf("subset shard %v/%v has no master", worker.subset.Keyspace, worker.subset.Shard)
+	}
+	masterInfo, err := worker.wr.TopoServer().GetTablet(si.MasterAlias)
+	if err != nil {
+		return fmt.Errorf("cannot get Tablet record for master %v: %v", si.MasterAlias, err)
+	}
+	waitTime := worker.options.StopPositionWaitTime
+	if waitTime == 0 {
+		waitTime = 30 * time.Second
+	}
+
+	// 1 - stop filtered replication on the subset master
+	worker.wr.Logger().Infof("Stopping filtered replication on master %v", si.MasterAlias)
+	release, err := worker.acquireRPC()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(worker.ctx, 60*time.Second)
+	blpPositions, err := worker.wr.TabletManagerClient().StopBlp(ctx, masterInfo)
+	cancel()
+	release()
+	if err != nil {
+		return fmt.Errorf("StopBlp for %v failed: %v", si.MasterAlias, err)
+	}
+	wrangler.RecordStartBlpAction(worker.cleaner, masterInfo)
+	blpPos, err := blpPositions.FindBlpPositionById(sourceShard.Uid)
+	if err != nil {
+		return fmt.Errorf("no filtered replication position on master %v for superset shard %v/%v", si.MasterAlias, worker.superset.Keyspace, worker.superset.Shard)
+	}
+
+	// 2 - stop the superset slave at or after the master position
+	supersetPos, err := worker.stopReplicationAt("superset", worker.superset.alias, blpPos.Position, false)
+	if err != nil {
+		return err
+	}
+	if worker.checkInterrupted() {
+		return topo.ErrInterrupted
+	}
+
+	// 3 - run filtered replication on the subset master until the
+	//     superset slave position, the other source shards, if any,
+	//     stay where they are
+	stopPositions := blproto.BlpPositionList{Entries: make([]blproto.BlpPosition, len(blpPositions.Entries))}
+	copy(stopPositions.Entries, blpPositions.Entries)
+	for i := range stopPositions.Entries {
+		if stopPositions.Entries[i].Uid == sourceShard.Uid {
+			stopPositions.Entries[i].Position = supersetPos
+		}
+	}
+	worker.wr.Logger().Infof("Running filtered replication on master %v until %v", si.MasterAlias, supersetPos)
+	release, err = worker.acquireRPC()
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithTimeout(worker.ctx, waitTime+30*time.Second)
+	masterPos, err := worker.wr.TabletManagerClient().RunBlpUntil(ctx, masterInfo, &stopPositions, waitTime)
+	cancel()
+	release()
+	if err != nil {
+		return fmt.Errorf("RunBlpUntil for %v until %v failed: %v", si.MasterAlias, supersetPos, err)
+	}
+
+	// 4 - stop the subset slave at the master position
+	if _, err := worker.stopReplicationAt("subset", worker.subset.alias, masterPos, false); err != nil {
+		return err
+	}
+
+	// 5 - restart filtered replication on the subset master
+	worker.wr.Logger().Infof("Restarting filtered replication on master %v", si.MasterAlias)
+	release, err = worker.acquireRPC()
+	if err != nil {
+		return err
+	}
+	ctx, cancel = context.WithTimeout(worker.ctx, 60*time.Second)
+	err = worker.wr.TabletManagerClient().StartBlp(ctx, masterInfo)
+	cancel()
+	release()
+	if err != nil {
+		return fmt.Errorf("StartBlp failed for %v: %v", si.MasterAlias, err)
+	}
+	if err := worker.cleaner.RemoveActionByName(wrangler.StartBlpActionName, si.MasterAlias.String()); err != nil {
+		worker.wr.Logger().Warningf("Cannot find cleaning action %v/%v: %v", wrangler.StartBlpActionName, si.MasterAlias.String(), err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	blproto "github.com/youtube/vitess/go/vt/binlog/proto"
+	"github.com/youtube/vitess/go/vt/key"
+	"github.com/youtube/vitess/go/vt/logutil"
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+	"github.com/youtube/vitess/go/vt/tabletmanager/faketmclient"
+	"github.com/youtube/vitess/go/vt/tabletmanager/tmclient"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+	"github.com/youtube/vitess/go/vt/zktopo"
+	"golang.org/x/net/context"
+)
+
+func TestReshardingOverlapConfig(t *testing.T) {
+	table := &myproto.TableDefinition{
+		Name:              "user",
+		Columns:           []string{"name", "id", "keyspace_id"},
+		PrimaryKeyColumns: []string{"id"},
+	}
+	config, err := ReshardingOverlapConfig("cell1", "ks", "40-c0", "80-", "keyspace_id", key.KIT_UINT64, table, SQLDiffOptions{Reverse: true})
+	if err != nil {
+		t.Fatalf("ReshardingOverlapConfig failed: %v", err)
+	}
+	want := "SELECT id, name, keyspace_id FROM user WHERE keyspace_id >= 0x8000000000000000 AND keyspace_id < 0xc000000000000000 ORDER BY id"
+	if config.Superset.SQL != want || config.Subset.SQL != want {
+		t.Errorf("unexpected queries:\n%v\n%v\nwant:\n%v", config.Superset.SQL, config.Subset.SQL, want)
+	}
+	if config.Superset.Shard != "40-c0" || config.Subset.Shard != "80-" || !config.Options.Exact || config.Options.Reverse || !config.Options.FilteredReplication {
+		t.Errorf("unexpected config: %+v", config)
+	}
+
+	if _, err := ReshardingOverlapConfig("cell1", "ks", "-40", "80-", "keyspace_id", key.KIT_UINT64, table, SQLDiffOptions{}); err == nil {
+		t.Errorf("ReshardingOverlapConfig should have failed for shards that don't overlap")
+	}
+}
+
+// filteredTabletManagerClient fakes filtered replication on a master
+// and replication on running slaves. The slaves are at the provided
+// positions, and stop at their minimum position if they are behind.
+// The master filtered replication positions are in blp, and the calls
+// are recorded.
+type filteredTabletManagerClient struct {
+	tmclient.TabletManagerClient
+	positions map[topo.TabletAlias]myproto.ReplicationPosition
+	blp       blproto.BlpPositionList
+	calls     []string
+}
+
+func (client *filteredTabletManagerClient) SlaveStatus(ctx context.Context, tablet *topo.TabletInfo) (*myproto.ReplicationStatus, error) {
+	return &myproto.ReplicationStatus{
+		Position:        client.positions[tablet.Alias],
+		SlaveIORunning:  true,
+		SlaveSQLRunning: true,
+	}, nil
+}
+
+func (client *filteredTabletManagerClient) StopSlaveMinimum(ctx context.Context, tablet *topo.TabletInfo, minPos myproto.ReplicationPosition, waitTime time.Duration) (*myproto.ReplicationStatus, error) {
+	client.calls = append(client.calls, fmt.Sprintf("StopSlaveMinimum %v %v", tablet.Alias, minPos))
+	if !client.positions[tablet.Alias].AtLeast(minPos) {
+		client.positions[tablet.Alias] = minPos
+	}
+	return &myproto.ReplicationStatus{Position: client.positions[tablet.Alias]}, nil
+}
+
+func (client *filteredTabletManagerClient) StopBlp(ctx context.Context, tablet *topo.TabletInfo) (*blproto.BlpPositionList, error) {
+	client.calls = append(client.calls, fmt.Sprintf("StopBlp %v", tablet.Alias))
+	return &client.blp, nil
+}
+
+func (client *filteredTabletManagerClient) RunBlpUntil(ctx context.Context, tablet *topo.TabletInfo, bpl *blproto.BlpPositionList, waitTime time.Duration) (myproto.ReplicationPosition, error) {
+	client.calls = append(client.calls, fmt.Sprintf("RunBlpUntil %v %v", tablet.Alias, bpl.Entries))
+	return client.positions[tablet.Alias], nil
+}
+
+func (client *filteredTabletManagerClient) StartBlp(ctx context.Context, tablet *topo.TabletInfo) error {
+	client.calls = append(client.calls, fmt.Sprintf("StartBlp %v", tablet.Alias))
+	return nil
+}
+
+func TestSqlDifferFilteredReplication(t *testing.T) {
+	ctx := context.Background()
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	sourceAlias := topo.TabletAlias{Cell: "cell1", Uid: 1}
+	destinationAlias := topo.TabletAlias{Cell: "cell1", Uid: 2}
+	masterAlias := topo.TabletAlias{Cell: "cell1", Uid: 3}
+	for _, tablet := range []*topo.Tablet{
+		{Alias: sourceAlias, Hostname: "localhost", Keyspace: "ks", Shard: "40-c0", Type: topo.TYPE_CHECKER},
+		{Alias: destinationAlias, Hostname: "localhost", Keyspace: "ks", Shard: "80-", Type: topo.TYPE_CHECKER},
+		{Alias: masterAlias, Hostname: "localhost", Keyspace: "ks", Shard: "80-", Type: topo.TYPE_MASTER},
+	} {
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+	}
+	if err := topo.CreateShard(ts, "ks", "80-"); err != nil {
+		t.Fatalf("CreateShard failed: %v", err)
+	}
+	if _, err := topo.UpdateShardFields(ctx, ts, "ks", "80-", func(shard *topo.Shard) error {
+		shard.MasterAlias = masterAlias
+		shard.SourceShards = []topo.SourceShard{
+			{Uid: 0, Keyspace: "ks", Shard: "40-c0"},
+			{Uid: 1, Keyspace: "ks", Shard: "c0-"},
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("UpdateShardFields failed: %v", err)
+	}
+	position := func(group uint64) myproto.ReplicationPosition {
+		return myproto.ReplicationPosition{GTIDSet: myproto.GoogleGTID{ServerID: 1, GroupID: group}}
+	}
+	tmc := &filteredTabletManagerClient{
+		TabletManagerClient: faketmclient.NewFakeTabletManagerClient(),
+		positions: map[topo.TabletAlias]myproto.ReplicationPosition{
+			sourceAlias:      position(20),
+			destinationAlias: position(5),
+			masterAlias:      position(7),
+		},
+		blp: blproto.BlpPositionList{Entries: []blproto.BlpPosition{
+			{Uid: 0, Position: position(10)},
+			{Uid: 1, Position: position(30)},
+		}},
+	}
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, tmc, time.Second)
+
+	table := &myproto.TableDefinition{
+		Name:              "user",
+		Columns:           []string{"id", "keyspace_id"},
+		PrimaryKeyColumns: []string{"id"},
+	}
+	config, err := ReshardingOverlapConfig("cell1", "ks", "40-c0", "80-", "keyspace_id", key.KIT_UINT64, table, SQLDiffOptions{})
+	if err != nil {
+		t.Fatalf("ReshardingOverlapConfig failed: %v", err)
+	}
+	wrk := NewSQLDiffWorkerFromConfig(wr, config).(*SQLDiffWorker)
+	wrk.setAliases(sourceAlias, destinationAlias)
+	for _, alias := range []topo.TabletAlias{sourceAlias, destinationAlias} {
+		wrangler.RecordChangeSlaveTypeAction(wrk.cleaner, alias, topo.TYPE_RDONLY)
+	}
+
+	if err := wrk.synchronizeReplication(); err != nil {
+		t.Fatalf("synchronizeReplication failed: %v", err)
+	}
+	// the source slave is past the master position and stops right
+	// away, the master then catches up with it, the other source
+	// shard staying where it is, and the destination slave with the
+	// master
+	want := []string{
+		fmt.Sprintf("StopBlp %v", masterAlias),
+		fmt.Sprintf("StopSlaveMinimum %v %v", sourceAlias, position(10)),
+		fmt.Sprintf("RunBlpUntil %v %v", masterAlias, []blproto.BlpPosition{{Uid: 0, Position: position(20)}, {Uid: 1, Position: position(30)}}),
+		fmt.Sprintf("StopSlaveMinimum %v %v", destinationAlias, position(7)),
+		fmt.Sprintf("StartBlp %v", masterAlias),
+	}
+	if !reflect.DeepEqual(tmc.calls, want) {
+		t.Errorf("unexpected calls:\n%v\nwant:\n%v", strings.Join(tmc.calls, "\n"), strings.Join(want, "\n"))
+	}
+	if _, err := wrk.cleaner.GetActionByName(wrangler.StartBlpActionName, masterAlias.String()); err == nil {
+		t.Errorf("StartBlp action left for the cleanup after restarting filtered replication")
+	}
+	for _, alias := range []topo.TabletAlias{sourceAlias, destinationAlias} {
+		if _, err := wrk.cleaner.GetActionByName(wrangler.StartSlaveActionName, alias.String()); err != nil {
+			t.Errorf("StartSlave action wasn't recorded for %v: %v", alias, err)
+		}
+	}
+
+	// a destination shard not replicating from the source shard
+	wrk = NewSQLDiffWorkerFromConfig(wr, SQLDiffConfig{Cell: "cell1", Superset: SourceSpec{Keyspace: "ks", Shard: "-80"}, Subset: config.Subset, Options: config.Options}).(*SQLDiffWorker)
+	wrk.setAliases(sourceAlias, destinationAlias)
+	if err := wrk.synchronizeReplication(); err == nil || !strings.Contains(err.Error(), "doesn't replicate from superset shard") {
+		t.Errorf("synchronizeReplication from a shard not replicated = %v, want an error", err)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains the RPCLimiter integration of the SQLDiffWorker,
+// which bounds the RPCs in flight across the workers sharing it.
+
+// acquireRPC waits for a slot of the RPCLimiter option, if set, before
+// the worker sends an RPC, or a short sequence of RPCs. The returned
+// function releases the slot, it must be called once they are done.
+// It fails if the limiter timeout expires first.
+func (worker *SQLDiffWorker) acquireRPC() (func(), error) {
+	limiter := worker.options.RPCLimiter
+	if limiter == nil {
+		return func() {}, nil
+	}
+	start := time.Now()
+	if !limiter.Acquire() {
+		return nil, categorize(SQLDiffErrorRPC, fmt.Errorf("no RPC slot available after %v, too many RPCs in flight", time.Now().Sub(start)))
+	}
+	return limiter.Release, nil
+}
+
+// findChecker finds a tablet in the provided shard of the spec
+// keyspace, and marks it as 'checker', holding an RPC slot while it
+// runs.
+func (worker *SQLDiffWorker) findChecker(ctx context.Context, cleaner *wrangler.Cleaner, spec SourceSpec, shard string, selector TargetSelector) (topo.TabletAlias, error) {
+	release, err := worker.acquireRPC()
+	if err != nil {
+		return topo.TabletAlias{}, err
+	}
+	defer release()
+	return findCheckerWithSelector(ctx, worker.wr, cleaner, worker.sourceCell(spec), spec.Keyspace, shard, selector)
+}
@@ -0,0 +1,67 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/sync2"
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestSqlDifferRPCLimiter(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	sql := "select id, msg from t order by id"
+
+	// the reader opens record how many of them are in flight
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"})), nil
+	}
+
+	limiter := sync2.NewSemaphore(2, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		superset := SourceSpec{Keyspace: "ks1", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 1}}
+		subset := SourceSpec{Keyspace: "ks2", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 2}}
+		wrk := NewSQLDiffWorker(wr, "cell1", superset, subset, SQLDiffOptions{NewQueryResultReader: factory, RPCLimiter: limiter}).(*SQLDiffWorker)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := wrk.diff(nil); err != nil {
+				t.Errorf("diff failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 2 {
+		t.Errorf("%v reader opens were in flight at once, want the limit of 2", maxInFlight)
+	}
+
+	// a worker gives up when no slot frees up in time
+	limiter = sync2.NewSemaphore(1, 10*time.Millisecond)
+	limiter.Acquire()
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{SQL: sql}, SourceSpec{SQL: sql}, SQLDiffOptions{RPCLimiter: limiter}).(*SQLDiffWorker)
+	if _, err := wrk.acquireRPC(); err == nil || errorCategory(err) != SQLDiffErrorRPC {
+		t.Errorf("acquireRPC() = %v, want an RPC error", err)
+	}
+}
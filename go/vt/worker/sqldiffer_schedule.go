@@ -0,0 +1,305 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// This file contains ScheduledSQLDiff, which runs a SQLDiffWorker
+// periodically, on a cron schedule.
+
+// cronSchedule is a parsed cron expression, with the usual five
+// fields: minute, hour, day of month, month and day of week. Each
+// field can be '*', a value, a range 'a-b', a step '*/n' or 'a-b/n',
+// or a comma separated list of those. Sunday is either 0 or 7.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays map[int]bool
+
+	// daysRestricted and weekdaysRestricted are set if the fields
+	// don't start with '*': if both are, a time matches either of
+	// them, as in cron.
+	daysRestricted, weekdaysRestricted bool
+}
+
+// cronFields are the names and bounds of the cron fields.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronSchedule parses a cron expression.
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q: expected %v fields, got %v", expr, len(cronFields), len(fields))
+	}
+	values := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		v, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v field: %v", expr, cronFields[i].name, err)
+		}
+		values[i] = v
+	}
+	// 7 is Sunday too
+	if values[4][7] {
+		values[4][0] = true
+		delete(values[4], 7)
+	}
+	return &cronSchedule{
+		minutes:            values[0],
+		hours:              values[1],
+		days:               values[2],
+		months:             values[3],
+		weekdays:           values[4],
+		daysRestricted:     !strings.HasPrefix(fields[2], "*"),
+		weekdaysRestricted: !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField returns the values matched by a cron field.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	result := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			}
+			if low < min || high > max || low > high {
+				return nil, fmt.Errorf("%q is out of the [%v, %v] range", part, min, max)
+			}
+		}
+		for v := low; v <= high; v += step {
+			result[v] = true
+		}
+	}
+	return result, nil
+}
+
+// matchesDay returns true if the schedule runs on the day of t.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	day := s.days[t.Day()]
+	weekday := s.weekdays[int(t.Weekday())]
+	if s.daysRestricted && s.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// next returns the first time the schedule runs, strictly after t,
+// or the zero time if it doesn't run in the next four years (for
+// instance on February 30th). It skips the months, days and hours
+// that don't match at once, instead of checking every minute.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(4, 0, 0); t.Before(end); {
+		switch {
+		case !s.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hours[t.Hour()]:
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			if !next.After(t) {
+				// the hour is repeated when the clock goes back
+				next = t.Add(time.Minute)
+			}
+			t = next
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ScheduledSQLDiff runs a SQLDiffWorker on a cron schedule. A run is
+// skipped if the previous one is still in progress, and the results of
+// the last runs are kept.
+type ScheduledSQLDiff struct {
+	wr       *wrangler.Wrangler
+	expr     string
+	schedule *cronSchedule
+	config   SQLDiffConfig
+
+	// all subsequent fields are protected by the mutex
+	mu sync.Mutex
+
+	// stop is closed by Stop, it is nil when not started.
+	stop    chan struct{}
+	nextRun time.Time
+
+	// running is the check in progress, if any.
+	running *SQLDiffWorker
+	skipped int
+	history []DiffResult
+}
+
+// ScheduledSQLDiffStatus is the status of a ScheduledSQLDiff.
+type ScheduledSQLDiffStatus struct {
+	Schedule string
+	Started  bool
+
+	// NextRun is when the next check is due, if started.
+	NextRun time.Time
+
+	// Running is the status of the check in progress, if any.
+	Running *SQLDiffStatus
+
+	// Skipped counts the runs skipped as the previous one was
+	// still in progress.
+	Skipped int
+
+	// History has the results of the last runs, oldest first.
+	History []DiffResult
+}
+
+// NewScheduledSQLDiff returns a ScheduledSQLDiff running the check of
+// config on the schedule of the cron expression cronExpr, like
+// "30 2 * * *" for every day at 2:30, in local time. Start needs to be
+// called for it to run.
+func NewScheduledSQLDiff(wr *wrangler.Wrangler, cronExpr string, config SQLDiffConfig) (*ScheduledSQLDiff, error) {
+	schedule, err := parseCronSchedule(cronExpr)
+	if err != nil {
+		return nil, err
+	}
+	return &ScheduledSQLDiff{
+		wr:       wr,
+		expr:     cronExpr,
+		schedule: schedule,
+		config:   config,
+	}, nil
+}
+
+// Start starts running the check on schedule. It does nothing if the
+// schedule is already started.
+func (s *ScheduledSQLDiff) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	go s.loop(s.stop)
+}
+
+// Stop stops the schedule, and cancels the check in progress, if any.
+// It can be started again.
+func (s *ScheduledSQLDiff) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.stop = nil
+	s.nextRun = time.Time{}
+	if s.running != nil {
+		s.running.Cancel()
+	}
+}
+
+// Status returns the status of the schedule.
+func (s *ScheduledSQLDiff) Status() ScheduledSQLDiffStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := ScheduledSQLDiffStatus{
+		Schedule: s.expr,
+		Started:  s.stop != nil,
+		NextRun:  s.nextRun,
+		Skipped:  s.skipped,
+		History:  make([]DiffResult, len(s.history)),
+	}
+	copy(status.History, s.history)
+	if s.running != nil {
+		running := s.running.GetStatus()
+		status.Running = &running
+	}
+	return status
+}
+
+// loop runs the check on schedule, until stop is closed.
+func (s *ScheduledSQLDiff) loop(stop chan struct{}) {
+	for {
+		next := s.schedule.next(time.Now())
+		if next.IsZero() {
+			s.wr.Logger().Errorf("Schedule %q never runs, stopping it", s.expr)
+			return
+		}
+		s.mu.Lock()
+		if s.stop == stop {
+			s.nextRun = next
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-time.After(next.Sub(time.Now())):
+			s.run()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// run starts the check in the background, unless the previous one is
+// still in progress.
+func (s *ScheduledSQLDiff) run() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != nil {
+		s.skipped++
+		s.wr.Logger().Warningf("Skipping scheduled check %v, its previous run %v is still in progress", s.running.HistoryKey(), s.running.runID)
+		return
+	}
+	wrk := NewSQLDiffWorkerFromConfig(s.wr, s.config).(*SQLDiffWorker)
+	s.running = wrk
+	go func() {
+		wrk.Run()
+		status := wrk.GetStatus()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.running = nil
+		s.history = append(s.history, DiffResult{
+			SQLDiffStatus: status,
+			EndTime:       time.Now(),
+			Config:        wrk.Config(),
+		})
+		if len(s.history) > sqlDiffHistorySize {
+			s.history = s.history[len(s.history)-sqlDiffHistorySize:]
+		}
+	}()
+}
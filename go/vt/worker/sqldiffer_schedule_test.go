@@ -0,0 +1,91 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// 2015-06-01 is a Monday
+	now := time.Date(2015, 6, 1, 10, 17, 42, 0, time.UTC)
+	table := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2015, 6, 1, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, 6, 1, 10, 30, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2015, 6, 2, 2, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * 1-5", time.Date(2015, 6, 1, 13, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0,6", time.Date(2015, 6, 6, 0, 0, 0, 0, time.UTC)},
+		// day of month and day of week both restricted: either matches
+		{"0 0 15 * 3", time.Date(2015, 6, 3, 0, 0, 0, 0, time.UTC)},
+		// a day of month step is not a restriction: both match
+		{"0 0 */2 * 1", time.Date(2015, 6, 15, 0, 0, 0, 0, time.UTC)},
+		// 7 is Sunday
+		{"0 0 * * 7", time.Date(2015, 6, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 5-7", time.Date(2015, 6, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2016, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tc := range table {
+		schedule, err := parseCronSchedule(tc.expr)
+		if err != nil {
+			t.Errorf("parseCronSchedule(%q) failed: %v", tc.expr, err)
+			continue
+		}
+		if got := schedule.next(now); !got.Equal(tc.want) {
+			t.Errorf("next(%q) = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "0 0 * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCronSchedule(expr); err == nil {
+			t.Errorf("parseCronSchedule(%q) should have failed", expr)
+		}
+	}
+}
+
+func TestScheduledSQLDiffSkipsOverlappingRuns(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	s, err := NewScheduledSQLDiff(wr, "0 3 * * *", SQLDiffConfig{
+		Cell:     "cell1",
+		Superset: SourceSpec{Keyspace: "main", Shard: "0", SQL: "SELECT * FROM t"},
+		Subset:   SourceSpec{Keyspace: "lookup", Shard: "0", SQL: "SELECT * FROM t"},
+		Options:  SQLDiffOptions{TargetSelector: blockingTargetSelector{}},
+	})
+	if err != nil {
+		t.Fatalf("NewScheduledSQLDiff failed: %v", err)
+	}
+	s.Start()
+	for s.Status().NextRun.IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the first run blocks until cancelled, the second is skipped
+	s.run()
+	s.run()
+	status := s.Status()
+	if !status.Started || status.Running == nil || status.Skipped != 1 {
+		t.Errorf("the second run should have been skipped while the first one is running: %+v", status)
+	}
+
+	s.Stop()
+	for len(s.Status().History) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status = s.Status()
+	if status.Started || !status.NextRun.IsZero() || status.Running != nil {
+		t.Errorf("unexpected status after Stop: %+v", status)
+	}
+	if len(status.History) != 1 || status.History[0].ErrorCategory != SQLDiffErrorInterrupted {
+		t.Errorf("Stop should have cancelled the running check: %+v", status.History)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// SQLDiffShardsWorker runs a SQLDiffWorker for each of a list of
+// configurations in turn, typically one per shard of a keyspace, and
+// rolls up their results in a DiffBatchReport.
+type SQLDiffShardsWorker struct {
+	wr              *wrangler.Wrangler
+	configs         []SQLDiffConfig
+	interShardDelay time.Duration
+	ctx             context.Context
+	ctxCancel       context.CancelFunc
+
+	// all subsequent fields are protected by the mutex
+	mu sync.Mutex
+
+	// current is the running check, and index its position
+	// in configs.
+	current *SQLDiffWorker
+	index   int
+
+	// nextStart is set while waiting between two checks.
+	nextStart time.Time
+
+	report DiffBatchReport
+	done   bool
+}
+
+// NewSQLDiffShardsWorker returns a new SQLDiffShardsWorker running the
+// provided configurations. It waits interShardDelay between two
+// checks, to spread the load of a full keyspace audit.
+func NewSQLDiffShardsWorker(wr *wrangler.Wrangler, configs []SQLDiffConfig, interShardDelay time.Duration) Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SQLDiffShardsWorker{
+		wr:              wr,
+		configs:         configs,
+		interShardDelay: interShardDelay,
+		ctx:             ctx,
+		ctxCancel:       cancel,
+	}
+}
+
+// Report returns the rollup of the checks run so far.
+func (worker *SQLDiffShardsWorker) Report() DiffBatchReport {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.report
+}
+
+// statusLines returns the status of the worker, one line per entry.
+func (worker *SQLDiffShardsWorker) statusLines() []string {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	var lines []string
+	switch {
+	case worker.done:
+		lines = append(lines, fmt.Sprintf("Done, ran %v of %v checks", worker.report.Checks, len(worker.configs)))
+	case !worker.nextStart.IsZero():
+		wait := worker.nextStart.Sub(time.Now())
+		if wait < 0 {
+			wait = 0
+		}
+		lines = append(lines, fmt.Sprintf("Next shard starts in %v (inter-shard delay %v)", wait/time.Second*time.Second, worker.interShardDelay))
+	case worker.current != nil:
+		lines = append(lines, fmt.Sprintf("Running check %v of %v: %v", worker.index+1, len(worker.configs), worker.current.direction()))
+	default:
+		lines = append(lines, "Not started")
+	}
+	lines = append(lines, "Results: "+worker.report.String())
+	return lines
+}
+
+// StatusAsHTML is part of the Worker interface
+func (worker *SQLDiffShardsWorker) StatusAsHTML() template.HTML {
+	lines := worker.statusLines()
+	for i, line := range lines {
+		lines[i] = template.HTMLEscapeString(line)
+	}
+	return template.HTML(strings.Join(lines, "</br>\n") + "</br>\n")
+}
+
+// StatusAsText is part of the Worker interface
+func (worker *SQLDiffShardsWorker) StatusAsText() string {
+	return strings.Join(worker.statusLines(), "\n") + "\n"
+}
+
+// Cancel is part of the Worker interface
+func (worker *SQLDiffShardsWorker) Cancel() {
+	worker.ctxCancel()
+	worker.mu.Lock()
+	current := worker.current
+	worker.mu.Unlock()
+	if current != nil {
+		current.Cancel()
+	}
+}
+
+// Run is mostly a wrapper to run the checks in turn, and mark the
+// worker done at the end.
+func (worker *SQLDiffShardsWorker) Run() {
+	defer func() {
+		worker.mu.Lock()
+		worker.done = true
+		worker.current = nil
+		worker.nextStart = time.Time{}
+		worker.mu.Unlock()
+	}()
+
+	for i, config := range worker.configs {
+		if i > 0 && worker.interShardDelay > 0 {
+			worker.mu.Lock()
+			worker.nextStart = time.Now().Add(worker.interShardDelay)
+			worker.mu.Unlock()
+			worker.wr.Logger().Infof("Waiting %v before the next check", worker.interShardDelay)
+			select {
+			case <-time.After(worker.interShardDelay):
+			case <-worker.ctx.Done():
+			}
+		}
+		if worker.ctx.Err() != nil {
+			return
+		}
+
+		wrk := NewSQLDiffWorkerFromConfig(worker.wr, config).(*SQLDiffWorker)
+		worker.mu.Lock()
+		worker.current = wrk
+		worker.index = i
+		worker.nextStart = time.Time{}
+		worker.mu.Unlock()
+
+		// Cancel may have missed the new check
+		if worker.ctx.Err() != nil {
+			wrk.Cancel()
+		}
+		wrk.Run()
+
+		worker.mu.Lock()
+		worker.report.Add(wrk.GetStatus())
+		worker.mu.Unlock()
+	}
+}
+
+// Error is part of the Worker interface. It returns
+// topo.ErrInterrupted if the worker was cancelled, and an error if
+// any check found differences or failed.
+func (worker *SQLDiffShardsWorker) Error() error {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	if worker.ctx.Err() != nil {
+		return topo.ErrInterrupted
+	}
+	if worker.report.Differences > 0 || worker.report.Errors > 0 {
+		return fmt.Errorf("%v checks found differences and %v failed: %v", worker.report.Differences, worker.report.Errors, worker.report.String())
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestSQLDiffShardsWorkerInterShardDelay(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	var configs []SQLDiffConfig
+	for _, shard := range []string{"-80", "80-"} {
+		configs = append(configs, SQLDiffConfig{
+			Cell:     "cell1",
+			Superset: SourceSpec{Keyspace: "main", Shard: shard, SQL: "SELECT * FROM t"},
+			Subset:   SourceSpec{Keyspace: "lookup", Shard: shard, SQL: "SELECT * FROM t"},
+			Options:  SQLDiffOptions{TargetSelector: failingTargetSelector{}},
+		})
+	}
+	wrk := NewSQLDiffShardsWorker(wr, configs, time.Hour).(*SQLDiffShardsWorker)
+
+	done := make(chan struct{})
+	go func() {
+		wrk.Run()
+		close(done)
+	}()
+
+	// the first check fails right away, then the worker waits
+	for !strings.Contains(wrk.StatusAsText(), "Next shard starts in") {
+		select {
+		case <-done:
+			t.Fatalf("worker didn't wait between shards: %v", wrk.StatusAsText())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	wrk.Cancel()
+	<-done
+
+	if report := wrk.Report(); report.Checks != 1 || report.Errors != 1 {
+		t.Errorf("unexpected report after cancelling during the delay: %v", report.String())
+	}
+	if err := wrk.Error(); err != topo.ErrInterrupted {
+		t.Errorf("Error() = %v, want %v", err, topo.ErrInterrupted)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// This file contains the DifferenceSink integration of the
+// SQLDiffWorker, to feed the differences it finds to an external
+// system, like a message queue driving automated repairs.
+
+// DifferenceSink receives the differences found by a SQLDiffWorker, as
+// they are found. Publish and Flush are called from a single
+// goroutine, so implementations don't need to be thread safe.
+type DifferenceSink interface {
+	// Publish sends a difference. It can buffer it, until Flush.
+	Publish(record DifferenceRecord) error
+
+	// Flush makes sure all the published differences are sent. It
+	// is called once, at the end of each diff.
+	Flush() error
+}
+
+// defaultDifferenceSinkBuffer is the number of differences buffered
+// for a slow DifferenceSink, when SQLDiffOptions.DifferenceSinkBuffer
+// is not set.
+const defaultDifferenceSinkBuffer = 1000
+
+// bufferedDifferenceSink publishes the differences to a DifferenceSink
+// from its own goroutine, through a bounded buffer: the diff only
+// blocks when the buffer is full, which slows it down to the pace of
+// the sink instead of using unbounded memory.
+type bufferedDifferenceSink struct {
+	ctx     context.Context
+	sink    DifferenceSink
+	records chan DifferenceRecord
+	done    chan struct{}
+
+	// all subsequent fields are protected by the mutex
+	mu        sync.Mutex
+	err       error
+	published int
+}
+
+// newBufferedDifferenceSink returns a bufferedDifferenceSink for sink,
+// buffering up to size differences. Sends blocked on a full buffer
+// give up when ctx is done.
+func newBufferedDifferenceSink(ctx context.Context, sink DifferenceSink, size int) *bufferedDifferenceSink {
+	if size <= 0 {
+		size = defaultDifferenceSinkBuffer
+	}
+	bds := &bufferedDifferenceSink{
+		ctx:     ctx,
+		sink:    sink,
+		records: make(chan DifferenceRecord, size),
+		done:    make(chan struct{}),
+	}
+	go bds.loop()
+	return bds
+}
+
+// loop publishes the buffered differences, until the buffer is closed.
+// After the first error, the remaining differences are dropped.
+func (bds *bufferedDifferenceSink) loop() {
+	defer close(bds.done)
+	for record := range bds.records {
+		if bds.failed() {
+			continue
+		}
+		err := bds.sink.Publish(record)
+		bds.mu.Lock()
+		if err != nil {
+			bds.err = fmt.Errorf("cannot publish the difference for key %q: %v", record.Key, err)
+		} else {
+			bds.published++
+		}
+		bds.mu.Unlock()
+	}
+}
+
+// failed returns true if publishing already failed.
+func (bds *bufferedDifferenceSink) failed() bool {
+	bds.mu.Lock()
+	defer bds.mu.Unlock()
+	return bds.err != nil
+}
+
+// publish buffers a difference, waiting for room in the buffer if
+// needed. It is meant to be used as a RowSubsetDiffer SetOnDifference
+// callback. It does nothing once publishing failed, or the context is
+// done.
+func (bds *bufferedDifferenceSink) publish(record DifferenceRecord) {
+	if bds.failed() {
+		return
+	}
+	select {
+	case bds.records <- record:
+	case <-bds.ctx.Done():
+	}
+}
+
+// close publishes the buffered differences, flushes the sink, and
+// returns the first error encountered, if any. It returns the number
+// of differences published.
+func (bds *bufferedDifferenceSink) close() (int, error) {
+	close(bds.records)
+	<-bds.done
+	bds.mu.Lock()
+	defer bds.mu.Unlock()
+	if bds.err != nil {
+		return bds.published, bds.err
+	}
+	if err := bds.sink.Flush(); err != nil {
+		return bds.published, fmt.Errorf("cannot flush the difference sink: %v", err)
+	}
+	return bds.published, nil
+}
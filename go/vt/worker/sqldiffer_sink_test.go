@@ -0,0 +1,77 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeDifferenceSink records the published differences. Publish
+// waits on release, if set, and fails on the failAt-th call.
+type fakeDifferenceSink struct {
+	release chan struct{}
+	failAt  int
+	keys    []string
+	flushed bool
+}
+
+func (f *fakeDifferenceSink) Publish(record DifferenceRecord) error {
+	if f.release != nil {
+		<-f.release
+	}
+	if f.failAt > 0 && len(f.keys)+1 == f.failAt {
+		return fmt.Errorf("queue unavailable")
+	}
+	f.keys = append(f.keys, record.Key)
+	return nil
+}
+
+func (f *fakeDifferenceSink) Flush() error {
+	f.flushed = true
+	return nil
+}
+
+func TestBufferedDifferenceSink(t *testing.T) {
+	// the sink is stuck, publish blocks once the buffer is full
+	sink := &fakeDifferenceSink{release: make(chan struct{})}
+	bds := newBufferedDifferenceSink(context.Background(), sink, 1)
+	bds.publish(DifferenceRecord{Key: "1"}) // taken by the loop
+	bds.publish(DifferenceRecord{Key: "2"}) // buffered
+	published := make(chan struct{})
+	go func() {
+		bds.publish(DifferenceRecord{Key: "3"})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatalf("publish didn't block on a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(sink.release)
+	<-published
+	if n, err := bds.close(); err != nil || n != 3 {
+		t.Errorf("close() = %v, %v, want 3, nil", n, err)
+	}
+	if fmt.Sprint(sink.keys) != "[1 2 3]" || !sink.flushed {
+		t.Errorf("unexpected sink state: keys %v flushed %v", sink.keys, sink.flushed)
+	}
+
+	// the differences after an error are dropped, and not flushed
+	sink = &fakeDifferenceSink{failAt: 2}
+	bds = newBufferedDifferenceSink(context.Background(), sink, 10)
+	for _, key := range []string{"1", "2", "3"} {
+		bds.publish(DifferenceRecord{Key: key})
+	}
+	if n, err := bds.close(); err == nil || n != 1 {
+		t.Errorf("close() = %v, %v, want 1 and an error", n, err)
+	}
+	if fmt.Sprint(sink.keys) != "[1]" || sink.flushed {
+		t.Errorf("unexpected sink state after an error: keys %v flushed %v", sink.keys, sink.flushed)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import "fmt"
+
+// This file contains the checks of the SQLDiffWorker sides reading a
+// snapshot, see SourceSpec.Snapshot.
+
+// checkSnapshots checks no option rewriting or complementing the
+// queries is used with a Snapshot side, as the query of that side is
+// not run: its rows are read as exported.
+func (worker *SQLDiffWorker) checkSnapshots() error {
+	if worker.superset.Snapshot == "" && worker.subset.Snapshot == "" {
+		return nil
+	}
+	options := worker.options
+	for _, o := range []struct {
+		name string
+		set  bool
+	}{
+		{"Aggregate", options.Aggregate},
+		{"Filter", options.Filter.Predicate != ""},
+		{"Delta", options.Delta},
+		{"KeysOnly", options.KeysOnly},
+		{"ForceBinaryKeySort", options.ForceBinaryKeySort},
+		{"CheckKeyCollation", options.CheckKeyCollation},
+		{"ChecksumBlockSize", options.ChecksumBlockSize > 0},
+		{"HashColumns", len(options.HashColumns) > 0},
+	} {
+		if o.set {
+			return fmt.Errorf("%v cannot be used with a Snapshot source, whose query is not run", o.name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// writeTestSnapshot writes a gzipped snapshot of the rows, and returns
+// its URL.
+func writeTestSnapshot(t *testing.T, dir string, rows ...[]string) string {
+	file, err := os.Create(path.Join(dir, "t.json.gz"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	gz := gzip.NewWriter(file)
+	if _, err := WriteSnapshot(gz, newFakeQueryResultReader(allShardsFields, makeRows(rows...))); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	gz.Close()
+	file.Close()
+	return "file://" + file.Name()
+}
+
+func TestSnapshotReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := writeTestSnapshot(t, dir, []string{"1", "a"}, []string{"2", ""})
+
+	qrr, err := NewQueryResultReaderForSnapshot(context.Background(), snapshot)
+	if err != nil {
+		t.Fatalf("NewQueryResultReaderForSnapshot failed: %v", err)
+	}
+	if SchemaFingerprint(qrr.Fields) != SchemaFingerprint(allShardsFields) {
+		t.Errorf("unexpected fields: %v", qrr.Fields)
+	}
+	rr := NewRowReader(qrr)
+	var got []string
+	for {
+		row, err := rr.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if row == nil {
+			break
+		}
+		got = append(got, row[0].String()+":"+row[1].String())
+	}
+	if len(got) != 2 || got[0] != "1:a" || got[1] != "2:" {
+		t.Errorf("unexpected rows: %v", got)
+	}
+	if err := qrr.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	if _, err := NewQueryResultReaderForSnapshot(context.Background(), "unknown://bucket/t.json"); err == nil {
+		t.Errorf("a snapshot with an unknown scheme should have failed")
+	}
+}
+
+func TestSnapshotReaderTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	if _, err := WriteSnapshot(&buf, newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"}, []string{"2", "b"}))); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	lines := strings.SplitAfter(buf.String(), "\n")
+	for _, c := range []struct {
+		name, content string
+	}{
+		// the export stopped between two rows, without error
+		{"no_trailer.json", strings.Join(lines[:3], "")},
+		{"wrong_count.json", strings.Join(lines[:2], "") + lines[3]},
+	} {
+		file := path.Join(dir, c.name)
+		if err := ioutil.WriteFile(file, []byte(c.content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		qrr, err := NewQueryResultReaderForSnapshot(context.Background(), "file://"+file)
+		if err != nil {
+			t.Fatalf("NewQueryResultReaderForSnapshot failed: %v", err)
+		}
+		rr := NewRowReader(qrr)
+		for {
+			row, err := rr.Next()
+			if err != nil {
+				if !strings.Contains(err.Error(), "truncated") {
+					t.Errorf("%v: Next() returned %v, want a truncated error", c.name, err)
+				}
+				break
+			}
+			if row == nil {
+				t.Errorf("%v: the truncated snapshot was read without error", c.name)
+				break
+			}
+		}
+		qrr.Close()
+	}
+}
+
+func TestSqlDifferSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := writeTestSnapshot(t, dir, []string{"1", "a"}, []string{"2", "b"})
+
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+		return newFakeQueryResultReader(allShardsFields, makeRows([]string{"1", "a"}, []string{"2", "c"})), nil
+	}
+	sql := "select id, msg from t order by id"
+	wrk := NewSQLDiffWorker(wr, "cell1",
+		SourceSpec{Keyspace: "ks", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 1}},
+		SourceSpec{SQL: sql, Snapshot: snapshot},
+		SQLDiffOptions{NewQueryResultReader: factory}).(*SQLDiffWorker)
+	if err := wrk.Config().Subset.validate(); err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+	if _, err := wrk.diff(nil); errorCategory(err) != SQLDiffErrorDifferences || wrk.GetStatus().ValueMismatch != 1 {
+		t.Errorf("diff against the snapshot = %v, status %+v", err, wrk.GetStatus())
+	}
+
+	wrk.options.Delta = true
+	if err := wrk.checkSnapshots(); err == nil {
+		t.Errorf("checkSnapshots should have failed with Delta")
+	}
+}
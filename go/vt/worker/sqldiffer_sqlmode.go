@@ -0,0 +1,103 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// This file contains the SQLMode option of the SQLDiffWorker, so both
+// sides render their values with the same sql_mode.
+
+// sqlModeRegexp matches a single sql_mode.
+var sqlModeRegexp = regexp.MustCompile(`^[A-Z_]+$`)
+
+// normalizeSQLMode returns the sorted modes of a sql_mode, upper cased
+// and without spaces, so the modes set in different orders compare
+// equal. It fails on values that are not a list of modes.
+func normalizeSQLMode(sqlMode string) (string, error) {
+	var modes []string
+	for _, mode := range strings.Split(sqlMode, ",") {
+		mode = strings.ToUpper(strings.TrimSpace(mode))
+		if mode == "" {
+			continue
+		}
+		if !sqlModeRegexp.MatchString(mode) {
+			return "", fmt.Errorf("invalid mode %q in sql_mode %q", mode, sqlMode)
+		}
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	return strings.Join(modes, ","), nil
+}
+
+// checkSQLModes reads the sql_mode of the sessions of both sides, and
+// checks it is the one of the SQLMode option. The sessions of the
+// external MySQL servers are set to it, but the ones of the tablets
+// and vtgates can't be, their servers need to be configured with it.
+// The snapshots are not checked, they were read before.
+func (worker *SQLDiffWorker) checkSQLModes() error {
+	want, err := normalizeSQLMode(worker.options.SQLMode)
+	if err != nil {
+		return err
+	}
+	for _, side := range []struct {
+		name string
+		spec SourceSpec
+	}{
+		{"superset", worker.superset},
+		{"subset", worker.subset},
+	} {
+		if side.spec.Snapshot != "" {
+			worker.wr.Logger().Warningf("The sql_mode of the %v snapshot %v can't be checked", side.name, side.spec.Snapshot)
+			continue
+		}
+		got, err := worker.sessionSQLMode(side.name, side.spec)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("the %v sessions on %v run with sql_mode %q, not %q: the sql_mode of the tablet and vtgate sessions can't be changed by the worker, their MySQL servers need to be configured with it", side.name, side.spec.name(), got, want)
+		}
+	}
+	worker.wr.Logger().Infof("Both sides are read with sql_mode %q", want)
+	worker.mu.Lock()
+	worker.sqlMode = want
+	worker.mu.Unlock()
+	return nil
+}
+
+// sqlModeProbeSQL reads the sql_mode of a session. The tablets only
+// stream queries their parser accepts as a select, which requires a
+// FROM clause.
+const sqlModeProbeSQL = "select @@session.sql_mode from dual"
+
+// sessionSQLMode returns the normalized sql_mode of the sessions the
+// spec query is read with.
+func (worker *SQLDiffWorker) sessionSQLMode(name string, spec SourceSpec) (string, error) {
+	spec.SQL = sqlModeProbeSQL
+	if spec.AllShards {
+		// the shards are served by the same kind of tablets
+		spec.AllShards = false
+		spec.Shard = spec.shards[0]
+	}
+	reader, cancel, err := worker.openReader(worker.ctx, name, spec)
+	if err != nil {
+		return "", err
+	}
+	row, err := NewRowReader(reader).Next()
+	reader.Close()
+	cancel()
+	if err != nil {
+		return "", categorize(SQLDiffErrorRPC, fmt.Errorf("cannot read the sql_mode of the %v sessions: %v", name, err))
+	}
+	if row == nil {
+		return "", fmt.Errorf("no sql_mode returned for the %v sessions", name)
+	}
+	return normalizeSQLMode(row[0].String())
+}
@@ -0,0 +1,67 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/schema"
+	"github.com/youtube/vitess/go/vt/tabletserver/planbuilder"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestNormalizeSQLMode(t *testing.T) {
+	if got, err := normalizeSQLMode(" no_zero_date, PAD_CHAR_TO_FULL_LENGTH,"); err != nil || got != "NO_ZERO_DATE,PAD_CHAR_TO_FULL_LENGTH" {
+		t.Errorf("normalizeSQLMode() = %q, %v", got, err)
+	}
+	if _, err := normalizeSQLMode("NO_ZERO_DATE'; DROP TABLE t; --"); err == nil {
+		t.Errorf("normalizeSQLMode() of an invalid mode should have failed")
+	}
+}
+
+func TestSQLModeProbeSQL(t *testing.T) {
+	// the probe must be accepted by the tablets, which stream it
+	_, err := planbuilder.GetStreamExecPlan(sqlModeProbeSQL, func(string) (*schema.Table, bool) {
+		return nil, false
+	})
+	if err != nil {
+		t.Errorf("GetStreamExecPlan(%q) failed: %v", sqlModeProbeSQL, err)
+	}
+}
+
+func TestSqlDifferCheckSQLModes(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	subsetMode := "PAD_CHAR_TO_FULL_LENGTH,NO_ZERO_DATE"
+	factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+		mode := "NO_ZERO_DATE,PAD_CHAR_TO_FULL_LENGTH"
+		if tabletAlias.Uid == 2 {
+			mode = subsetMode
+		}
+		return newFakeQueryResultReader([]mproto.Field{{Name: "@@session.sql_mode", Type: mproto.VT_VARCHAR}}, makeRows([]string{mode})), nil
+	}
+	wrk := NewSQLDiffWorker(wr, "cell1",
+		SourceSpec{Keyspace: "ks", Shard: "0", SQL: "select id, msg from t order by id", alias: topo.TabletAlias{Cell: "cell1", Uid: 1}},
+		SourceSpec{Keyspace: "ks", Shard: "1", SQL: "select id, msg from t order by id", alias: topo.TabletAlias{Cell: "cell1", Uid: 2}},
+		SQLDiffOptions{SQLMode: "pad_char_to_full_length,no_zero_date", NewQueryResultReader: factory}).(*SQLDiffWorker)
+	if err := wrk.checkSQLModes(); err != nil {
+		t.Fatalf("checkSQLModes() = %v", err)
+	}
+	if got := wrk.GetStatus().SQLMode; got != "NO_ZERO_DATE,PAD_CHAR_TO_FULL_LENGTH" {
+		t.Errorf("SQLMode = %q", got)
+	}
+
+	// the subset tablet runs with another sql_mode
+	subsetMode = "NO_ZERO_DATE"
+	if err := wrk.checkSQLModes(); err == nil || !strings.Contains(err.Error(), "subset sessions") {
+		t.Errorf("checkSQLModes() = %v, want a subset sql_mode mismatch", err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"time"
+)
+
+// This file contains the persistence of the SQLDiffWorker status, so
+// the last known status of a check can be shown after the worker
+// process restarted, or by another process.
+
+// defaultStatusSaveInterval is the minimum time between two saves of
+// the status of a running check, when
+// SQLDiffOptions.StatusSaveInterval is not set.
+const defaultStatusSaveInterval = 30 * time.Second
+
+// StatusSnapshot is the status of a check, as saved in a StatusStore.
+type StatusSnapshot struct {
+	SQLDiffStatus
+
+	// Check is the HistoryKey of the check.
+	Check string
+
+	// SavedAt is when the status was saved.
+	SavedAt time.Time
+}
+
+// StatusAsHTML renders the snapshot for a status page.
+func (snapshot StatusSnapshot) StatusAsHTML() template.HTML {
+	result := "<b>Last known status of:</b> " + template.HTMLEscapeString(snapshot.Check) + "</br>\n"
+	result += "<b>Saved at:</b> " + snapshot.SavedAt.Format(time.RFC3339) + "</br>\n"
+	result += "<b>Run ID:</b> " + snapshot.RunID + "</br>\n"
+	result += "<b>State:</b> " + snapshot.State + "</br>\n"
+	if snapshot.Error != "" {
+		result += "<b>Error</b>: " + template.HTMLEscapeString(snapshot.Error) + "</br>\n"
+	}
+	result += fmt.Sprintf("<b>Differences</b>: %v missing in superset, %v missing in subset, %v value mismatches</br>\n", snapshot.MissingInSuperset, snapshot.MissingInSubset, snapshot.ValueMismatch)
+	result += fmt.Sprintf("<b>Processed rows:</b> %v in %v</br>\n", snapshot.ProcessedRows, snapshot.Duration)
+	return template.HTML(result)
+}
+
+// StatusStore keeps the last status of each check.
+type StatusStore interface {
+	// SaveStatus replaces the saved status of the check.
+	SaveStatus(snapshot StatusSnapshot) error
+
+	// LoadStatus returns the saved status of the check with the
+	// provided HistoryKey.
+	LoadStatus(check string) (StatusSnapshot, error)
+}
+
+// FileStatusStore is a StatusStore keeping each status as a JSON file
+// in a local directory.
+type FileStatusStore struct {
+	dir string
+}
+
+// NewFileStatusStore returns a FileStatusStore saving the statuses in
+// dir, which needs to exist.
+func NewFileStatusStore(dir string) *FileStatusStore {
+	return &FileStatusStore{dir: dir}
+}
+
+// filename returns the file of a check.
+func (fss *FileStatusStore) filename(check string) string {
+	return path.Join(fss.dir, url.QueryEscape(check)+".json")
+}
+
+// SaveStatus is part of the StatusStore interface. The file is
+// replaced atomically, so a reader never sees a partial status.
+func (fss *FileStatusStore) SaveStatus(snapshot StatusSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	filename := fss.filename(snapshot.Check)
+	if err := ioutil.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// LoadStatus is part of the StatusStore interface.
+func (fss *FileStatusStore) LoadStatus(check string) (StatusSnapshot, error) {
+	var snapshot StatusSnapshot
+	data, err := ioutil.ReadFile(fss.filename(check))
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("invalid status for check %v: %v", check, err)
+	}
+	return snapshot, nil
+}
+
+// saveStatus saves the current status to the StatusStore. A failure
+// is only logged, it doesn't fail the check.
+func (worker *SQLDiffWorker) saveStatus() {
+	snapshot := StatusSnapshot{
+		SQLDiffStatus: worker.GetStatus(),
+		Check:         worker.HistoryKey(),
+		SavedAt:       time.Now(),
+	}
+	if err := worker.options.StatusStore.SaveStatus(snapshot); err != nil {
+		worker.wr.Logger().Warningf("Cannot save the status of check %v: %v", snapshot.Check, err)
+	}
+}
+
+// saveStatusLoop saves the status every StatusSaveInterval, until done
+// is closed.
+func (worker *SQLDiffWorker) saveStatusLoop(done chan struct{}) {
+	interval := worker.options.StatusSaveInterval
+	if interval <= 0 {
+		interval = defaultStatusSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			worker.saveStatus()
+		case <-done:
+			return
+		}
+	}
+}
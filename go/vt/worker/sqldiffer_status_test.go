@@ -0,0 +1,45 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestFileStatusStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqldiff_status")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStatusStore(dir)
+
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "ks1", Shard: "0", SQL: "SELECT * FROM t"}, SourceSpec{Keyspace: "ks2", Shard: "0", SQL: "SELECT * FROM t"}, SQLDiffOptions{Name: "main/t", TargetSelector: failingTargetSelector{}, StatusStore: store}).(*SQLDiffWorker)
+	wrk.Run()
+
+	// a new process can read the final status
+	snapshot, err := NewFileStatusStore(dir).LoadStatus("main/t")
+	if err != nil {
+		t.Fatalf("LoadStatus failed: %v", err)
+	}
+	if snapshot.RunID != wrk.RunID() || snapshot.State != sqlDiffError.String() || snapshot.ErrorCategory != SQLDiffErrorNoTarget || snapshot.Duration == 0 {
+		t.Errorf("unexpected saved status: %+v", snapshot)
+	}
+	if html := string(snapshot.StatusAsHTML()); !strings.Contains(html, "main/t") || !strings.Contains(html, wrk.RunID()) {
+		t.Errorf("unexpected status page: %v", html)
+	}
+
+	if _, err := store.LoadStatus("other"); err == nil {
+		t.Errorf("LoadStatus should have failed for an unknown check")
+	}
+}
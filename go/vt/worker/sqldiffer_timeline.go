@@ -0,0 +1,73 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"time"
+)
+
+// This file contains the state timeline of the SQLDiffWorker, which
+// keeps every state a run went through, for post-mortems.
+
+// StateTransition is an entry of the state timeline of a
+// SQLDiffWorker.
+type StateTransition struct {
+	// State is the state entered, and Start when it was entered.
+	State string
+	Start time.Time
+
+	// Duration is how long the state lasted. For the current
+	// state, it is how long it has lasted so far, and it is zero
+	// for a final state.
+	Duration time.Duration
+
+	// Trigger is what caused the transition, like "targets found",
+	// or the error the run ended with.
+	Trigger string
+}
+
+// transition moves the worker to a new state, and appends it to the
+// timeline. Moving to the current state again doesn't add an entry.
+// The mutex needs to be held.
+func (worker *SQLDiffWorker) transition(state sqlDiffWorkerState, trigger string) {
+	if state == worker.state && len(worker.timeline) > 0 {
+		return
+	}
+	now := time.Now()
+	if n := len(worker.timeline); n > 0 {
+		worker.timeline[n-1].Duration = now.Sub(worker.timeline[n-1].Start)
+	}
+	worker.state = state
+	worker.timeline = append(worker.timeline, StateTransition{
+		State:   state.String(),
+		Start:   now,
+		Trigger: trigger,
+	})
+}
+
+// StateTimeline returns the states the worker went through so far,
+// oldest first. It is safe to call while the worker is running.
+func (worker *SQLDiffWorker) StateTimeline() []StateTransition {
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	return worker.stateTimeline()
+}
+
+// stateTimeline returns a copy of the timeline, with the duration of
+// the current state so far. The mutex needs to be held.
+func (worker *SQLDiffWorker) stateTimeline() []StateTransition {
+	if len(worker.timeline) == 0 {
+		return nil
+	}
+	timeline := make([]StateTransition, len(worker.timeline))
+	copy(timeline, worker.timeline)
+	switch worker.state {
+	case sqlDiffDone, sqlDiffError, sqlDiffCancelled:
+	default:
+		last := &timeline[len(timeline)-1]
+		last.Duration = time.Now().Sub(last.Start)
+	}
+	return timeline
+}
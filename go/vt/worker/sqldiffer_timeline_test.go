@@ -0,0 +1,58 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestSqlDifferStateTimeline(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{Keyspace: "ks1", Shard: "0"}, SourceSpec{Keyspace: "ks2", Shard: "0"}, SQLDiffOptions{}).(*SQLDiffWorker)
+	if timeline := wrk.StateTimeline(); timeline != nil {
+		t.Errorf("timeline of a worker not started: %v", timeline)
+	}
+
+	wrk.setState(sqlDiffFindTargets, "run started")
+	wrk.setState(sqlDiffSynchronizeReplication, "targets found")
+	time.Sleep(10 * time.Millisecond)
+	wrk.setState(sqlDiffRunning, "replication synchronized")
+	wrk.setState(sqlDiffRunning, "replication synchronized")
+	if timeline := wrk.StateTimeline(); len(timeline) != 3 || timeline[2].Duration <= 0 {
+		t.Errorf("the running state should have a duration so far: %+v", timeline)
+	}
+	wrk.recordError(fmt.Errorf("stream error"))
+	wrk.recordError(topo.ErrInterrupted)
+
+	timeline := wrk.StateTimeline()
+	var got []string
+	for _, transition := range timeline {
+		got = append(got, transition.State+": "+transition.Trigger)
+	}
+	want := "[finding target instances: run started synchronizing replication: targets found running the diff: replication synchronized error: stream error cancelled: interrupted]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("timeline = %v, want %v", got, want)
+	}
+	if timeline[1].Duration < 10*time.Millisecond || timeline[4].Duration != 0 {
+		t.Errorf("unexpected durations: %+v", timeline)
+	}
+
+	// the timeline is part of the JSON status
+	data, err := json.Marshal(wrk.GetStatus())
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	var status SQLDiffStatus
+	if err := json.Unmarshal(data, &status); err != nil || len(status.Timeline) != 5 || status.Timeline[1].Trigger != "targets found" {
+		t.Errorf("unexpected timeline in the JSON status: %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/youtube/vitess/go/vt/sqlparser"
+)
+
+// This file contains the VerifyKeyUniqueness precheck of the
+// SQLDiffWorker, which makes sure no key is returned twice by a query
+// before diffing it.
+
+// duplicateKeysLimit is the maximum number of duplicate keys reported
+// by the precheck, for each side.
+const duplicateKeysLimit = 10
+
+// checkKeyUniqueness checks the VerifyKeyUniqueness option can be
+// used with the other options, and that the probe queries can be
+// built.
+func (worker *SQLDiffWorker) checkKeyUniqueness() error {
+	if worker.options.Aggregate {
+		return fmt.Errorf("VerifyKeyUniqueness cannot be used with Aggregate, the groups are unique already")
+	}
+	for _, spec := range []SourceSpec{worker.superset, worker.subset} {
+		if spec.Snapshot != "" {
+			return fmt.Errorf("VerifyKeyUniqueness cannot be used with a Snapshot source, it can't be queried")
+		}
+		if spec.AllShards {
+			return fmt.Errorf("VerifyKeyUniqueness cannot be used with AllShards, the keys duplicated across shards wouldn't be found")
+		}
+		if _, err := duplicateKeysSQL(spec.SQL, worker.keyCount()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// duplicateKeysSQL rewrites the query to return the values of its
+// keyCount first ORDER BY columns that are returned more than once,
+// with their number of rows, up to duplicateKeysLimit of them.
+func duplicateKeysSQL(sql string, keyCount int) (string, error) {
+	statement, err := sqlparser.Parse(sql)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse query '%v': %v", sql, err)
+	}
+	sel, ok := statement.(*sqlparser.Select)
+	if !ok || len(sel.GroupBy) > 0 || sel.Distinct != "" {
+		return "", fmt.Errorf("query '%v' is not a simple SELECT, its keys can't be verified", sql)
+	}
+	if len(sel.OrderBy) < keyCount {
+		return "", fmt.Errorf("query '%v' must be ordered by its %v key columns first", sql, keyCount)
+	}
+	count := &sqlparser.FuncExpr{Name: []byte("count"), Exprs: sqlparser.SelectExprs{&sqlparser.StarExpr{}}}
+	exprs := make(sqlparser.SelectExprs, 0, keyCount+1)
+	groupBy := make(sqlparser.GroupBy, 0, keyCount)
+	for _, order := range sel.OrderBy[:keyCount] {
+		col := orderByColumn(order)
+		if col == nil {
+			return "", fmt.Errorf("query '%v' must be ordered by its %v key columns first", sql, keyCount)
+		}
+		exprs = append(exprs, &sqlparser.NonStarExpr{Expr: order.Expr})
+		groupBy = append(groupBy, order.Expr)
+	}
+	sel.SelectExprs = append(exprs, &sqlparser.NonStarExpr{Expr: count})
+	sel.GroupBy = groupBy
+	sel.Having = sqlparser.NewWhere(sqlparser.AST_HAVING, &sqlparser.ComparisonExpr{
+		Operator: sqlparser.AST_GT,
+		Left:     count,
+		Right:    sqlparser.NumVal("1"),
+	})
+	sel.OrderBy = sel.OrderBy[:keyCount]
+	sel.Limit = &sqlparser.Limit{Rowcount: sqlparser.NumVal(fmt.Sprint(duplicateKeysLimit))}
+	sel.Lock = ""
+	return sqlparser.String(sel), nil
+}
+
+// verifyKeyUniqueness runs the duplicate keys probe of both queries,
+// and fails with the duplicate keys found, if any: the diff would
+// otherwise match the rows of a duplicate key arbitrarily, and report
+// wrong differences.
+func (worker *SQLDiffWorker) verifyKeyUniqueness() error {
+	var found []string
+	for _, side := range []struct {
+		name string
+		spec SourceSpec
+	}{
+		{"superset", worker.superset},
+		{"subset", worker.subset},
+	} {
+		sql, err := duplicateKeysSQL(side.spec.SQL, worker.keyCount())
+		if err != nil {
+			return err
+		}
+		probe := side.spec
+		probe.SQL = sql
+		keys, err := worker.duplicateKeys(side.name, probe)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			worker.wr.Logger().Errorf("Found duplicate keys in %v: %v", side.spec.name(), strings.Join(keys, ", "))
+			found = append(found, fmt.Sprintf("%v: %v", side.name, strings.Join(keys, ", ")))
+		}
+	}
+	if len(found) > 0 {
+		return categorize(SQLDiffErrorDuplicateKeys, fmt.Errorf("diff not run, the key columns are not unique (first %v duplicate keys of each side, with their number of rows): %v", duplicateKeysLimit, strings.Join(found, "; ")))
+	}
+	worker.wr.Logger().Infof("Verified the keys of both queries are unique")
+	return nil
+}
+
+// duplicateKeys runs the duplicate keys probe of a side, and returns
+// the keys it found, formatted with their number of rows.
+func (worker *SQLDiffWorker) duplicateKeys(name string, probe SourceSpec) ([]string, error) {
+	reader, cancel, err := worker.openReader(worker.ctx, name, probe)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer reader.Close()
+
+	var keys []string
+	rr := NewRowReader(reader)
+	for {
+		row, err := rr.Next()
+		if err != nil {
+			return nil, categorize(SQLDiffErrorRPC, fmt.Errorf("reading the duplicate keys of %v failed: %v", probe.name(), err))
+		}
+		if row == nil {
+			return keys, nil
+		}
+		values := make([]string, len(row)-1)
+		for i, value := range row[:len(row)-1] {
+			values[i] = value.String()
+		}
+		keys = append(keys, fmt.Sprintf("(%v) x%v", strings.Join(values, ", "), row[len(row)-1].String()))
+	}
+}
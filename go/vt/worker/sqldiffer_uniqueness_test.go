@@ -0,0 +1,92 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	mproto "github.com/youtube/vitess/go/mysql/proto"
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+func TestDuplicateKeysSQL(t *testing.T) {
+	for _, c := range []struct {
+		sql      string
+		keyCount int
+		want     string
+	}{
+		{"select id, msg from t where id > 10 order by id", 1, "select id, count(*) from t where id > 10 group by id having count(*) > 1 order by id asc limit 10"},
+		{"select a.id, b.k, b.v from a join b on a.id = b.a_id order by a.id, b.k", 2, "select a.id, b.k, count(*) from a join b on a.id = b.a_id group by a.id, b.k having count(*) > 1 order by a.id asc, b.k asc limit 10"},
+	} {
+		got, err := duplicateKeysSQL(c.sql, c.keyCount)
+		if err != nil || got != c.want {
+			t.Errorf("duplicateKeysSQL(%q) = %q, %v, want %q", c.sql, got, err, c.want)
+		}
+	}
+	for _, sql := range []string{
+		"select id, count(*) from t group by id order by id",
+		"select msg from t",
+		"delete from t",
+	} {
+		if _, err := duplicateKeysSQL(sql, 1); err == nil {
+			t.Errorf("duplicateKeysSQL(%q) should have failed", sql)
+		}
+	}
+}
+
+func TestSqlDifferVerifyKeyUniqueness(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	sql := "select id, msg from t order by id"
+	fields := []mproto.Field{
+		{Name: "id", Type: mproto.VT_LONGLONG},
+		{Name: "count(*)", Type: mproto.VT_LONGLONG},
+	}
+	for _, c := range []struct {
+		duplicates [][]string
+		wantErr    string
+	}{
+		{nil, ""},
+		{[][]string{{"3", "2"}, {"7", "4"}}, "subset: (3) x2, (7) x4"},
+	} {
+		// only the subset tablet has duplicate keys
+		factory := func(ctx context.Context, ts topo.Server, tabletAlias topo.TabletAlias, sql string, lowPriority bool) (*QueryResultReader, error) {
+			if !strings.Contains(sql, "having count(*) > 1") {
+				t.Errorf("unexpected query %q", sql)
+			}
+			if tabletAlias.Uid == 2 {
+				return newFakeQueryResultReader(fields, makeRows(c.duplicates...)), nil
+			}
+			return newFakeQueryResultReader(fields, nil), nil
+		}
+		superset := SourceSpec{Keyspace: "ks1", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 1}}
+		subset := SourceSpec{Keyspace: "ks2", Shard: "0", SQL: sql, alias: topo.TabletAlias{Cell: "cell1", Uid: 2}}
+		wrk := NewSQLDiffWorker(wr, "cell1", superset, subset, SQLDiffOptions{VerifyKeyUniqueness: true, NewQueryResultReader: factory}).(*SQLDiffWorker)
+		if err := wrk.checkKeyUniqueness(); err != nil {
+			t.Fatalf("checkKeyUniqueness failed: %v", err)
+		}
+		err := wrk.verifyKeyUniqueness()
+		if c.wantErr == "" {
+			if err != nil {
+				t.Errorf("verifyKeyUniqueness failed: %v", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) || errorCategory(err) != SQLDiffErrorDuplicateKeys {
+			t.Errorf("verifyKeyUniqueness() = %v, want a duplicate_keys error with %q", err, c.wantErr)
+		}
+	}
+
+	// aggregates are unique by construction
+	wrk := NewSQLDiffWorker(wr, "cell1", SourceSpec{SQL: sql}, SourceSpec{SQL: sql}, SQLDiffOptions{VerifyKeyUniqueness: true, Aggregate: true}).(*SQLDiffWorker)
+	if err := wrk.checkKeyUniqueness(); err == nil {
+		t.Errorf("checkKeyUniqueness with Aggregate should have failed")
+	}
+}
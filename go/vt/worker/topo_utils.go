@@ -8,6 +8,8 @@ import (
 	"flag"
 	"fmt"
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/youtube/vitess/go/vt/servenv"
@@ -17,13 +19,149 @@ import (
 )
 
 var (
-	minHealthyEndPoints = flag.Int("min_healthy_rdonly_endpoints", 2, "minimum number of healthy rdonly endpoints required for checker")
+	minHealthyEndPoints  = flag.Int("min_healthy_rdonly_endpoints", 2, "minimum number of healthy rdonly endpoints required for checker")
+	maxCheckersPerTablet = flag.Int("max_checkers_per_tablet", 1, "maximum number of workers of this process using the same tablet as checker")
+	checkerAllowedCells  = flag.String("checker_allowed_cells", "", "comma separated list of the cells whose tablets can be used as checkers, all cells if empty")
+	checkerDeniedCells   = flag.String("checker_denied_cells", "", "comma separated list of the cells whose tablets can never be used as checkers, like serving-only cells")
 )
 
+// checkCheckerCell returns an error if the tablets of the cell can't
+// be used as checkers, as per -checker_allowed_cells and
+// -checker_denied_cells.
+func checkCheckerCell(cell string) error {
+	if cellInList(cell, *checkerDeniedCells) {
+		return fmt.Errorf("cell %v can't be used for checkers, it is in -checker_denied_cells=%v", cell, *checkerDeniedCells)
+	}
+	if *checkerAllowedCells != "" && !cellInList(cell, *checkerAllowedCells) {
+		return fmt.Errorf("cell %v can't be used for checkers, it is not in -checker_allowed_cells=%v", cell, *checkerAllowedCells)
+	}
+	return nil
+}
+
+// cellInList returns true if the cell is in the comma separated list.
+func cellInList(cell, list string) bool {
+	for _, c := range strings.Split(list, ",") {
+		if strings.TrimSpace(c) == cell {
+			return true
+		}
+	}
+	return false
+}
+
+// checkerCounts counts the workers of this process using each tablet
+// as checker, to enforce maxCheckersPerTablet.
+var checkerCounts = &checkerRegistry{
+	counts: make(map[topo.TabletAlias]int),
+}
+
+type checkerRegistry struct {
+	mu     sync.Mutex
+	counts map[topo.TabletAlias]int
+}
+
+// full returns true if the tablet is already used by
+// maxCheckersPerTablet workers.
+func (r *checkerRegistry) full(alias topo.TabletAlias) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[alias] >= *maxCheckersPerTablet
+}
+
+// acquire counts one more worker using the tablet, or fails if it is
+// already used by maxCheckersPerTablet workers.
+func (r *checkerRegistry) acquire(alias topo.TabletAlias) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counts[alias] >= *maxCheckersPerTablet {
+		return fmt.Errorf("tablet %v is already used as checker by %v workers, the limit is %v (see -max_checkers_per_tablet)", alias, r.counts[alias], *maxCheckersPerTablet)
+	}
+	r.counts[alias]++
+	return nil
+}
+
+func (r *checkerRegistry) release(alias topo.TabletAlias) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counts[alias] <= 1 {
+		delete(r.counts, alias)
+		return
+	}
+	r.counts[alias]--
+}
+
+// releaseCheckerActionName is the name of the action releasing a
+// tablet acquired in checkerCounts.
+const releaseCheckerActionName = "ReleaseCheckerAction"
+
+// releaseCheckerAction is a CleanerAction releasing a tablet acquired
+// in checkerCounts.
+type releaseCheckerAction struct {
+	alias topo.TabletAlias
+}
+
+// CleanUp is part of CleanerAction interface.
+func (rca releaseCheckerAction) CleanUp(ctx context.Context, wr *wrangler.Wrangler) error {
+	checkerCounts.release(rca.alias)
+	return nil
+}
+
+// checkerOptions tunes how randomTargetSelector picks a rdonly
+// instance. The zero value is the default findChecker behavior.
+type checkerOptions struct {
+	// jitter is the maximum random delay to wait before picking
+	// an instance, so workers started at the same time spread out.
+	jitter time.Duration
+
+	// avoidCheckers skips instances that are already tagged by
+	// another worker, unless they are the only candidates.
+	avoidCheckers bool
+
+	// tags, if set, restricts the instances to the ones with all
+	// these tags, like the ones designated for batch work.
+	tags map[string]string
+
+	// rng, if set, is the source of the random jitter and choice,
+	// so tests can seed it. It is not safe for concurrent use, so
+	// the global source is used otherwise.
+	rng *rand.Rand
+}
+
+// intn returns a random number in [0, n) from the options source.
+func (options checkerOptions) intn(n int) int {
+	if options.rng != nil {
+		return options.rng.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+// int63n returns a random number in [0, n) from the options source.
+func (options checkerOptions) int63n(n int64) int64 {
+	if options.rng != nil {
+		return options.rng.Int63n(n)
+	}
+	return rand.Int63n(n)
+}
+
+// hasTags returns true if the tablet has all the provided tags.
+func hasTags(tablet *topo.TabletInfo, tags map[string]string) bool {
+	for name, value := range tags {
+		if tablet.Tags[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
 // findHealthyRdonlyEndPoint returns a random healthy endpoint.
 // Since we don't want to use them all, we require at least
 // minHealthyEndPoints servers to be healthy.
 func findHealthyRdonlyEndPoint(wr *wrangler.Wrangler, cell, keyspace, shard string) (topo.TabletAlias, error) {
+	return findHealthyRdonlyEndPointWithOptions(wr, cell, keyspace, shard, checkerOptions{})
+}
+
+// findHealthyRdonlyEndPointWithOptions is findHealthyRdonlyEndPoint
+// with the candidate filtering described by options.
+func findHealthyRdonlyEndPointWithOptions(wr *wrangler.Wrangler, cell, keyspace, shard string, options checkerOptions) (topo.TabletAlias, error) {
 	endPoints, err := wr.TopoServer().GetEndPoints(cell, keyspace, shard, topo.TYPE_RDONLY)
 	if err != nil {
 		return topo.TabletAlias{}, fmt.Errorf("GetEndPoints(%v,%v,%v,rdonly) failed: %v", cell, keyspace, shard, err)
@@ -38,23 +176,144 @@ func findHealthyRdonlyEndPoint(wr *wrangler.Wrangler, cell, keyspace, shard stri
 		return topo.TabletAlias{}, fmt.Errorf("Not enough endpoints to chose from in (%v,%v/%v), have %v healthy ones, need at least %v", cell, keyspace, shard, len(healthyEndpoints), *minHealthyEndPoints)
 	}
 
+	// skip the tablets other workers of this process are about to use
+	available := make([]topo.EndPoint, 0, len(healthyEndpoints))
+	for _, entry := range healthyEndpoints {
+		if !checkerCounts.full(topo.TabletAlias{Cell: cell, Uid: entry.Uid}) {
+			available = append(available, entry)
+		}
+	}
+	if len(available) == 0 {
+		return topo.TabletAlias{}, fmt.Errorf("All %v healthy endpoints in (%v,%v/%v) are already used by %v workers of this process", len(healthyEndpoints), cell, keyspace, shard, *maxCheckersPerTablet)
+	}
+	healthyEndpoints = available
+
+	if len(options.tags) > 0 {
+		available := make([]topo.EndPoint, 0, len(healthyEndpoints))
+		for _, entry := range healthyEndpoints {
+			tablet, err := wr.TopoServer().GetTablet(topo.TabletAlias{Cell: cell, Uid: entry.Uid})
+			if err != nil {
+				return topo.TabletAlias{}, err
+			}
+			if hasTags(tablet, options.tags) {
+				available = append(available, entry)
+			}
+		}
+		if len(available) == 0 {
+			return topo.TabletAlias{}, fmt.Errorf("None of the %v healthy endpoints in (%v,%v/%v) has the tags %v", len(healthyEndpoints), cell, keyspace, shard, options.tags)
+		}
+		healthyEndpoints = available
+	}
+
+	if options.avoidCheckers {
+		available := make([]topo.EndPoint, 0, len(healthyEndpoints))
+		for _, entry := range healthyEndpoints {
+			tablet, err := wr.TopoServer().GetTablet(topo.TabletAlias{Cell: cell, Uid: entry.Uid})
+			if err != nil {
+				return topo.TabletAlias{}, err
+			}
+			if tablet.Tags["worker"] != "" {
+				wr.Logger().Infof("Skipping tablet %v, already used by worker %v", tablet.Alias, tablet.Tags["worker"])
+				continue
+			}
+			available = append(available, entry)
+		}
+		if len(available) == 0 {
+			wr.Logger().Warningf("All %v healthy endpoints in (%v,%v/%v) are already used by other workers, picking one of them anyway", len(healthyEndpoints), cell, keyspace, shard)
+		} else {
+			healthyEndpoints = available
+		}
+	}
+
 	// random server in the list is what we want
-	index := rand.Intn(len(healthyEndpoints))
+	index := options.intn(len(healthyEndpoints))
 	return topo.TabletAlias{
 		Cell: cell,
 		Uid:  healthyEndpoints[index].Uid,
 	}, nil
 }
 
+// TargetSelector picks the tablet a worker will use as a checker in
+// a keyspace / shard. The worker then takes care of marking it as
+// checker, and of restoring it at the end.
+type TargetSelector interface {
+	SelectChecker(ctx context.Context, wr *wrangler.Wrangler, cell, keyspace, shard string) (topo.TabletAlias, error)
+}
+
+// randomTargetSelector is the default TargetSelector: it picks a
+// random healthy rdonly instance, as tuned by its options.
+type randomTargetSelector struct {
+	options checkerOptions
+}
+
+// SelectChecker is part of the TargetSelector interface.
+func (rts *randomTargetSelector) SelectChecker(ctx context.Context, wr *wrangler.Wrangler, cell, keyspace, shard string) (topo.TabletAlias, error) {
+	if rts.options.jitter > 0 {
+		delay := time.Duration(rts.options.int63n(int64(rts.options.jitter)))
+		wr.Logger().Infof("Waiting %v before picking a rdonly in %v/%v", delay, keyspace, shard)
+		select {
+		case <-ctx.Done():
+			return topo.TabletAlias{}, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return findHealthyRdonlyEndPointWithOptions(wr, cell, keyspace, shard, rts.options)
+}
+
+// aliasTargetSelector is the TargetSelector of a tablet picked by the
+// caller: it only checks the tablet is a rdonly in the keyspace /
+// shard.
+type aliasTargetSelector struct {
+	alias topo.TabletAlias
+}
+
+// SelectChecker is part of the TargetSelector interface.
+func (ats *aliasTargetSelector) SelectChecker(ctx context.Context, wr *wrangler.Wrangler, cell, keyspace, shard string) (topo.TabletAlias, error) {
+	tablet, err := wr.TopoServer().GetTablet(ats.alias)
+	if err != nil {
+		return topo.TabletAlias{}, fmt.Errorf("cannot read tablet %v: %v", ats.alias, err)
+	}
+	if tablet.Keyspace != keyspace || tablet.Shard != shard {
+		return topo.TabletAlias{}, fmt.Errorf("tablet %v is in %v/%v, not in %v/%v", ats.alias, tablet.Keyspace, tablet.Shard, keyspace, shard)
+	}
+	if tablet.Type != topo.TYPE_RDONLY {
+		return topo.TabletAlias{}, fmt.Errorf("tablet %v is a %v tablet, not a rdonly", ats.alias, tablet.Type)
+	}
+	return ats.alias, nil
+}
+
 // findChecker:
 // - find a rdonly instance in the keyspace / shard
+// - make sure it isn't used by too many workers of this process
 // - mark it as checker
 // - tag it with our worker process
 func findChecker(ctx context.Context, wr *wrangler.Wrangler, cleaner *wrangler.Cleaner, cell, keyspace, shard string) (topo.TabletAlias, error) {
-	tabletAlias, err := findHealthyRdonlyEndPoint(wr, cell, keyspace, shard)
+	return findCheckerWithSelector(ctx, wr, cleaner, cell, keyspace, shard, &randomTargetSelector{})
+}
+
+// findCheckerWithSelector is findChecker with the instance picked by
+// the provided TargetSelector.
+// The cell policy of -checker_allowed_cells and -checker_denied_cells
+// is enforced both on the requested cell and on the picked tablet.
+func findCheckerWithSelector(ctx context.Context, wr *wrangler.Wrangler, cleaner *wrangler.Cleaner, cell, keyspace, shard string, selector TargetSelector) (topo.TabletAlias, error) {
+	if err := checkCheckerCell(cell); err != nil {
+		return topo.TabletAlias{}, fmt.Errorf("no eligible checker in %v/%v: %v", keyspace, shard, err)
+	}
+	tabletAlias, err := selector.SelectChecker(ctx, wr, cell, keyspace, shard)
 	if err != nil {
 		return topo.TabletAlias{}, err
 	}
+	if err := checkCheckerCell(tabletAlias.Cell); err != nil {
+		return topo.TabletAlias{}, fmt.Errorf("cannot use tablet %v as checker: %v", tabletAlias, err)
+	}
+
+	// The tablet is released last, once it is back to rdonly. If
+	// restoring it fails, it stays counted, so other workers keep
+	// away from it.
+	if err := checkerCounts.acquire(tabletAlias); err != nil {
+		return topo.TabletAlias{}, err
+	}
+	cleaner.Record(releaseCheckerActionName, tabletAlias.String(), releaseCheckerAction{alias: tabletAlias})
 
 	// We add the tag before calling ChangeSlaveType, so the destination
 	// vttablet reloads the worker URL when it reloads the tablet.
@@ -0,0 +1,257 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/wrangler"
+	"github.com/youtube/vitess/go/vt/zktopo"
+)
+
+func TestCheckerRegistry(t *testing.T) {
+	r := &checkerRegistry{counts: make(map[topo.TabletAlias]int)}
+	alias := topo.TabletAlias{Cell: "cell1", Uid: 1}
+
+	if err := r.acquire(alias); err != nil {
+		t.Fatalf("first acquire failed: %v", err)
+	}
+	if !r.full(alias) {
+		t.Errorf("tablet used by one worker isn't full with the default limit")
+	}
+	if err := r.acquire(alias); err == nil {
+		t.Errorf("second acquire should have failed with the default limit")
+	}
+	r.release(alias)
+	if r.full(alias) || len(r.counts) != 0 {
+		t.Errorf("release didn't free the tablet: %v", r.counts)
+	}
+
+	*maxCheckersPerTablet = 2
+	defer func() { *maxCheckersPerTablet = 1 }()
+	for i := 0; i < 2; i++ {
+		if err := r.acquire(alias); err != nil {
+			t.Fatalf("acquire %v failed with a limit of 2: %v", i, err)
+		}
+	}
+	if err := r.acquire(alias); err == nil {
+		t.Errorf("third acquire should have failed with a limit of 2")
+	}
+}
+
+// fixedTargetSelector always picks the same tablet.
+type fixedTargetSelector struct {
+	alias topo.TabletAlias
+}
+
+func (fts fixedTargetSelector) SelectChecker(ctx context.Context, wr *wrangler.Wrangler, cell, keyspace, shard string) (topo.TabletAlias, error) {
+	return fts.alias, nil
+}
+
+func TestFindCheckerCellPolicy(t *testing.T) {
+	wr := wrangler.New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	cleaner := &wrangler.Cleaner{}
+	defer func() {
+		*checkerAllowedCells = ""
+		*checkerDeniedCells = ""
+	}()
+
+	*checkerDeniedCells = "serving1, serving2"
+	_, err := findCheckerWithSelector(context.Background(), wr, cleaner, "serving2", "ks", "0", failingTargetSelector{})
+	if err == nil || !strings.Contains(err.Error(), "-checker_denied_cells") {
+		t.Errorf("denied cell wasn't rejected: %v", err)
+	}
+
+	// a selector picking a tablet from another cell is caught too
+	*checkerDeniedCells = ""
+	*checkerAllowedCells = "batch"
+	alias := topo.TabletAlias{Cell: "serving1", Uid: 1}
+	_, err = findCheckerWithSelector(context.Background(), wr, cleaner, "batch", "ks", "0", fixedTargetSelector{alias})
+	if err == nil || !strings.Contains(err.Error(), "-checker_allowed_cells") {
+		t.Errorf("tablet outside the allowed cells wasn't rejected: %v", err)
+	}
+	if checkerCounts.full(alias) {
+		t.Errorf("rejected tablet was counted as checker")
+	}
+
+	if err := checkCheckerCell("batch"); err != nil {
+		t.Errorf("allowed cell was rejected: %v", err)
+	}
+}
+
+func TestFindHealthyRdonlyEndPointTags(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, nil, time.Second)
+	endPoints := topo.NewEndPoints()
+	for uid, purpose := range []string{"serving", "analytics", "analytics"} {
+		if err := topo.CreateTablet(ts, &topo.Tablet{
+			Alias:    topo.TabletAlias{Cell: "cell1", Uid: uint32(uid)},
+			Hostname: "localhost",
+			Keyspace: "ks",
+			Shard:    "0",
+			Type:     topo.TYPE_RDONLY,
+			Tags:     map[string]string{"purpose": purpose},
+		}); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+		endPoints.Entries = append(endPoints.Entries, *topo.NewEndPoint(uint32(uid), "localhost"))
+	}
+	if err := topo.UpdateEndPoints(context.Background(), ts, "cell1", "ks", "0", topo.TYPE_RDONLY, endPoints); err != nil {
+		t.Fatalf("UpdateEndPoints failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		alias, err := findHealthyRdonlyEndPointWithOptions(wr, "cell1", "ks", "0", checkerOptions{tags: map[string]string{"purpose": "analytics"}})
+		if err != nil {
+			t.Fatalf("findHealthyRdonlyEndPointWithOptions failed: %v", err)
+		}
+		if alias.Uid == 0 {
+			t.Fatalf("picked tablet %v, which doesn't have the tags", alias)
+		}
+	}
+
+	_, err := findHealthyRdonlyEndPointWithOptions(wr, "cell1", "ks", "0", checkerOptions{tags: map[string]string{"purpose": "batch"}})
+	if err == nil || !strings.Contains(err.Error(), "has the tags") {
+		t.Errorf("unexpected error without any tagged tablet: %v", err)
+	}
+}
+
+// createRdonlyTablets creates rdonly tablets with the provided uids in
+// cell1, ks/0, and their serving graph. The tablets whose uid is in
+// checkers are tagged as used by another worker.
+func createRdonlyTablets(t *testing.T, ts topo.Server, uids []uint32, checkers map[uint32]bool) {
+	endPoints := topo.NewEndPoints()
+	for _, uid := range uids {
+		tablet := &topo.Tablet{
+			Alias:    topo.TabletAlias{Cell: "cell1", Uid: uid},
+			Hostname: "localhost",
+			Keyspace: "ks",
+			Shard:    "0",
+			Type:     topo.TYPE_RDONLY,
+		}
+		if checkers[uid] {
+			tablet.Tags = map[string]string{"worker": "http://other-worker:8080"}
+		}
+		if err := topo.CreateTablet(ts, tablet); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+		endPoints.Entries = append(endPoints.Entries, *topo.NewEndPoint(uid, "localhost"))
+	}
+	if err := topo.UpdateEndPoints(context.Background(), ts, "cell1", "ks", "0", topo.TYPE_RDONLY, endPoints); err != nil {
+		t.Fatalf("UpdateEndPoints failed: %v", err)
+	}
+}
+
+func TestRandomTargetSelectorJitter(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, nil, time.Second)
+	createRdonlyTablets(t, ts, []uint32{1, 2, 3, 4}, nil)
+
+	selector := &randomTargetSelector{options: checkerOptions{
+		jitter: time.Millisecond,
+		rng:    rand.New(rand.NewSource(1)),
+	}}
+	picked := make(map[uint32]int)
+	for i := 0; i < 40; i++ {
+		alias, err := selector.SelectChecker(context.Background(), wr, "cell1", "ks", "0")
+		if err != nil {
+			t.Fatalf("SelectChecker failed: %v", err)
+		}
+		picked[alias.Uid]++
+	}
+	if len(picked) != 4 {
+		t.Errorf("40 selections picked tablets %v, want them spread over the 4 rdonly tablets", picked)
+	}
+
+	// a done context interrupts the jitter
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	selector.options.jitter = time.Hour
+	if _, err := selector.SelectChecker(ctx, wr, "cell1", "ks", "0"); err != context.Canceled {
+		t.Errorf("SelectChecker with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRandomTargetSelectorAvoidCheckers(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, nil, time.Second)
+	createRdonlyTablets(t, ts, []uint32{1, 2, 3}, map[uint32]bool{1: true, 3: true})
+
+	selector := &randomTargetSelector{options: checkerOptions{
+		avoidCheckers: true,
+		rng:           rand.New(rand.NewSource(1)),
+	}}
+	for i := 0; i < 20; i++ {
+		alias, err := selector.SelectChecker(context.Background(), wr, "cell1", "ks", "0")
+		if err != nil {
+			t.Fatalf("SelectChecker failed: %v", err)
+		}
+		if alias.Uid != 2 {
+			t.Fatalf("picked tablet %v, which is already used by another worker", alias)
+		}
+	}
+}
+
+func TestRandomTargetSelectorOnlyCheckers(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, nil, time.Second)
+	createRdonlyTablets(t, ts, []uint32{1, 2}, map[uint32]bool{1: true, 2: true})
+
+	selector := &randomTargetSelector{options: checkerOptions{
+		avoidCheckers: true,
+		rng:           rand.New(rand.NewSource(1)),
+	}}
+	alias, err := selector.SelectChecker(context.Background(), wr, "cell1", "ks", "0")
+	if err != nil {
+		t.Fatalf("SelectChecker with only checker tablets failed: %v", err)
+	}
+	if alias.Uid != 1 && alias.Uid != 2 {
+		t.Errorf("picked tablet %v, want one of the checker tablets", alias)
+	}
+}
+
+func TestAliasTargetSelector(t *testing.T) {
+	ts := zktopo.NewTestServer(t, []string{"cell1"})
+	wr := wrangler.New(logutil.NewConsoleLogger(), ts, nil, time.Second)
+	for uid, tabletType := range []topo.TabletType{topo.TYPE_RDONLY, topo.TYPE_REPLICA} {
+		if err := topo.CreateTablet(ts, &topo.Tablet{
+			Alias:    topo.TabletAlias{Cell: "cell1", Uid: uint32(uid)},
+			Hostname: "localhost",
+			Keyspace: "ks",
+			Shard:    "0",
+			Type:     tabletType,
+		}); err != nil {
+			t.Fatalf("CreateTablet failed: %v", err)
+		}
+	}
+
+	table := []struct {
+		uid     uint32
+		shard   string
+		wantErr string
+	}{
+		{0, "0", ""},
+		{0, "80-", "not in ks/80-"},
+		{1, "0", "not a rdonly"},
+		{2, "0", "cannot read tablet"},
+	}
+	for _, test := range table {
+		alias := topo.TabletAlias{Cell: "cell1", Uid: test.uid}
+		got, err := (&aliasTargetSelector{alias: alias}).SelectChecker(context.Background(), wr, "cell1", "ks", test.shard)
+		switch {
+		case test.wantErr == "" && (err != nil || got != alias):
+			t.Errorf("SelectChecker(%v) in ks/%v = (%v, %v), want %v", alias, test.shard, got, err, alias)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("SelectChecker(%v) in ks/%v = %v, want an error containing %q", alias, test.shard, err, test.wantErr)
+		}
+	}
+}
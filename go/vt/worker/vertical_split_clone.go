@@ -483,7 +483,7 @@ func (vscw *VerticalSplitCloneWorker) copy() error {
 
 				// build the query, and start the streaming
 				selectSQL := buildSQLFromChunks(vscw.wr, td, chunks, chunkIndex, vscw.sourceAlias.String())
-				qrr, err := NewQueryResultReaderForTablet(vscw.ctx, vscw.wr.TopoServer(), vscw.sourceAlias, selectSQL)
+				qrr, err := NewQueryResultReaderForTablet(vscw.ctx, vscw.wr.TopoServer(), vscw.sourceAlias, selectSQL, false)
 				if err != nil {
 					processError("NewQueryResultReaderForTablet failed: %v", err)
 					return
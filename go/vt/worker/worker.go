@@ -37,6 +37,41 @@ type Worker interface {
 	Error() error
 }
 
+// DifferenceFinder is implemented by the workers comparing data, that
+// can tell differences found apart from other errors.
+type DifferenceFinder interface {
+	// FoundDifferences returns true if the job failed because it
+	// found differences. It will only be called after Run() has
+	// completed.
+	FoundDifferences() bool
+}
+
+// Exit codes of a command running a worker, see ExitCode.
+const (
+	// ExitCodeSuccess is returned when the job succeeded.
+	ExitCodeSuccess = 0
+
+	// ExitCodeError is returned when the job failed.
+	ExitCodeError = 1
+
+	// ExitCodeDifferences is returned when a DifferenceFinder
+	// found differences.
+	ExitCodeDifferences = 2
+)
+
+// ExitCode returns the exit code of a command that ran wrk, so scripts
+// and CI pipelines can tell a clean run, differences found, and
+// failures apart.
+func ExitCode(wrk Worker) int {
+	if wrk.Error() == nil {
+		return ExitCodeSuccess
+	}
+	if df, ok := wrk.(DifferenceFinder); ok && df.FoundDifferences() {
+		return ExitCodeDifferences
+	}
+	return ExitCodeError
+}
+
 // Resolver is an interface that should be implemented by any workers that need to
 // resolve the topology.
 type Resolver interface {
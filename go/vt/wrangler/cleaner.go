@@ -21,6 +21,14 @@ type Cleaner struct {
 	// following members protected by lock
 	mu      sync.Mutex
 	actions []cleanerActionReference
+
+	// failedTargets is populated by CleanUp with the targets on
+	// which an action failed.
+	failedTargets []string
+
+	// abandonedTargets is populated by CleanUpWithDeadline with the
+	// targets whose actions were abandoned at the deadline.
+	abandonedTargets []string
 }
 
 // cleanerActionReference is the node used by Cleaner
@@ -58,11 +66,26 @@ type cleanUpHelper struct {
 // TODO(alainjobart) Actions should run concurrently on a per target
 // basis. They are then serialized on each target.
 func (cleaner *Cleaner) CleanUp(wr *Wrangler) error {
+	return cleaner.cleanUp(wr, 5*time.Minute, false)
+}
+
+// CleanUpWithDeadline is like CleanUp, but its context times out after
+// deadline, and it doesn't wait for an action still running then: that
+// action and all the remaining ones are abandoned, and their targets
+// are returned by AbandonedTargets. This guarantees CleanUp returns
+// even if an action hangs, for instance on an unreachable tablet.
+func (cleaner *Cleaner) CleanUpWithDeadline(wr *Wrangler, deadline time.Duration) error {
+	return cleaner.cleanUp(wr, deadline, true)
+}
+
+func (cleaner *Cleaner) cleanUp(wr *Wrangler, timeout time.Duration, abandon bool) error {
 	// we use a background context so we're not dependent on the original context timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	actionMap := make(map[string]*cleanUpHelper)
 	rec := concurrency.AllErrorRecorder{}
 	cleaner.mu.Lock()
+	cleaner.failedTargets = nil
+	cleaner.abandonedTargets = nil
 	for i := len(cleaner.actions) - 1; i >= 0; i-- {
 		actionReference := cleaner.actions[i]
 		helper, ok := actionMap[actionReference.target]
@@ -76,9 +99,28 @@ func (cleaner *Cleaner) CleanUp(wr *Wrangler) error {
 			wr.Logger().Warningf("previous action failed on target %v, no running %v", actionReference.target, actionReference.name)
 			continue
 		}
-		err := actionReference.action.CleanUp(ctx, wr)
+		var err error
+		if abandon {
+			done := make(chan error, 1)
+			go func() {
+				done <- actionReference.action.CleanUp(ctx, wr)
+			}()
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				cleaner.abandonedTargets = cleaner.remainingTargets(i, actionMap)
+				wr.Logger().Errorf("action %v still running on %v after %v, abandoning it and the remaining actions on %v", actionReference.name, actionReference.target, timeout, cleaner.abandonedTargets)
+				rec.RecordError(fmt.Errorf("clean up abandoned after %v, actions left on %v", timeout, cleaner.abandonedTargets))
+				cleaner.mu.Unlock()
+				cancel()
+				return rec.Error()
+			}
+		} else {
+			err = actionReference.action.CleanUp(ctx, wr)
+		}
 		if err != nil {
 			helper.err = err
+			cleaner.failedTargets = append(cleaner.failedTargets, actionReference.target)
 			rec.RecordError(err)
 			wr.Logger().Errorf("action %v failed on %v: %v", actionReference.name, actionReference.target, err)
 		} else {
@@ -90,6 +132,67 @@ func (cleaner *Cleaner) CleanUp(wr *Wrangler) error {
 	return rec.Error()
 }
 
+// remainingTargets returns the targets of the actions up to index i,
+// the ones still to run, skipping the targets on which an action
+// failed. It needs to be called with the lock held.
+func (cleaner *Cleaner) remainingTargets(i int, actionMap map[string]*cleanUpHelper) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for ; i >= 0; i-- {
+		target := cleaner.actions[i].target
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		if helper, ok := actionMap[target]; ok && helper.err != nil {
+			continue
+		}
+		result = append(result, target)
+	}
+	return result
+}
+
+// IsEmpty returns true if no action was recorded.
+func (cleaner *Cleaner) IsEmpty() bool {
+	cleaner.mu.Lock()
+	defer cleaner.mu.Unlock()
+	return len(cleaner.actions) == 0
+}
+
+// FailedTargets returns the targets on which an action failed during
+// the last CleanUp, in the order they failed.
+func (cleaner *Cleaner) FailedTargets() []string {
+	cleaner.mu.Lock()
+	defer cleaner.mu.Unlock()
+	result := make([]string, len(cleaner.failedTargets))
+	copy(result, cleaner.failedTargets)
+	return result
+}
+
+// AbandonedTargets returns the targets whose actions were abandoned
+// by the last CleanUpWithDeadline.
+func (cleaner *Cleaner) AbandonedTargets() []string {
+	cleaner.mu.Lock()
+	defer cleaner.mu.Unlock()
+	result := make([]string, len(cleaner.abandonedTargets))
+	copy(result, cleaner.abandonedTargets)
+	return result
+}
+
+// GetTargetsByName returns the targets of all the actions in the list
+// with the given name.
+func (cleaner *Cleaner) GetTargetsByName(name string) []string {
+	cleaner.mu.Lock()
+	defer cleaner.mu.Unlock()
+	var result []string
+	for _, action := range cleaner.actions {
+		if action.name == name {
+			result = append(result, action.target)
+		}
+	}
+	return result
+}
+
 // GetActionByName returns the first action in the list with the given
 // name and target
 func (cleaner *Cleaner) GetActionByName(name, target string) (CleanerAction, error) {
@@ -224,9 +327,20 @@ func RecordStartSlaveAction(cleaner *Cleaner, tabletInfo *topo.TabletInfo) {
 	})
 }
 
-// CleanUp is part of CleanerAction interface.
+// CleanUp is part of CleanerAction interface. If StartSlave fails but
+// the slave is replicating, for instance because it was restarted by
+// someone else in the meantime, the action succeeds.
 func (sba StartSlaveAction) CleanUp(ctx context.Context, wr *Wrangler) error {
-	return wr.TabletManagerClient().StartSlave(ctx, sba.TabletInfo)
+	err := wr.TabletManagerClient().StartSlave(ctx, sba.TabletInfo)
+	if err == nil {
+		return nil
+	}
+	status, serr := wr.TabletManagerClient().SlaveStatus(ctx, sba.TabletInfo)
+	if serr != nil || !status.SlaveRunning() {
+		return err
+	}
+	wr.Logger().Warningf("StartSlave on %v failed, but it is already replicating: %v", sba.TabletInfo.Alias, err)
+	return nil
 }
 
 //
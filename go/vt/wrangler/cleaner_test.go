@@ -0,0 +1,86 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wrangler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/youtube/vitess/go/vt/logutil"
+	myproto "github.com/youtube/vitess/go/vt/mysqlctl/proto"
+	"github.com/youtube/vitess/go/vt/tabletmanager/tmclient"
+	"github.com/youtube/vitess/go/vt/topo"
+)
+
+// startSlaveFailingTabletManagerClient fails StartSlave, and reports
+// the slave as replicating if running is set. Its other methods are
+// not implemented.
+type startSlaveFailingTabletManagerClient struct {
+	tmclient.TabletManagerClient
+	running bool
+}
+
+func (client *startSlaveFailingTabletManagerClient) StartSlave(ctx context.Context, tablet *topo.TabletInfo) error {
+	return fmt.Errorf("slave already running")
+}
+
+func (client *startSlaveFailingTabletManagerClient) SlaveStatus(ctx context.Context, tablet *topo.TabletInfo) (*myproto.ReplicationStatus, error) {
+	return &myproto.ReplicationStatus{SlaveIORunning: client.running, SlaveSQLRunning: client.running}, nil
+}
+
+func TestStartSlaveActionAlreadyReplicating(t *testing.T) {
+	tablet := topo.NewTabletInfo(&topo.Tablet{Alias: topo.TabletAlias{Cell: "cell1", Uid: 1}}, 0)
+	for _, running := range []bool{true, false} {
+		tmc := &startSlaveFailingTabletManagerClient{running: running}
+		wr := New(logutil.NewConsoleLogger(), nil, tmc, time.Second)
+		cleaner := &Cleaner{}
+		RecordStartSlaveAction(cleaner, tablet)
+		err := cleaner.CleanUp(wr)
+		if running && err != nil {
+			t.Errorf("CleanUp failed on an already replicating slave: %v", err)
+		}
+		if !running && err == nil {
+			t.Errorf("CleanUp should have failed on a slave that can't be started")
+		}
+	}
+}
+
+// flakyCleanerAction fails its first CleanUp only.
+type flakyCleanerAction struct {
+	calls *int
+}
+
+func (fca flakyCleanerAction) CleanUp(ctx context.Context, wr *Wrangler) error {
+	*fca.calls++
+	if *fca.calls == 1 {
+		return fmt.Errorf("first attempt failed")
+	}
+	return nil
+}
+
+func TestCleanUpFailedTargets(t *testing.T) {
+	wr := New(logutil.NewConsoleLogger(), nil, nil, time.Second)
+	cleaner := &Cleaner{}
+	var calls int
+	cleaner.Record("FlakyAction", "target1", flakyCleanerAction{calls: &calls})
+
+	if err := cleaner.CleanUp(wr); err == nil {
+		t.Fatalf("first CleanUp should have failed")
+	}
+	if got := cleaner.FailedTargets(); len(got) != 1 || got[0] != "target1" {
+		t.Errorf("FailedTargets after a failure = %v, want [target1]", got)
+	}
+
+	// a retry only reports its own failures
+	if err := cleaner.CleanUp(wr); err != nil {
+		t.Fatalf("second CleanUp failed: %v", err)
+	}
+	if got := cleaner.FailedTargets(); len(got) != 0 {
+		t.Errorf("FailedTargets after a successful retry = %v, want none", got)
+	}
+}
@@ -71,6 +71,11 @@ func (wr *Wrangler) SetLogger(logger logutil.Logger) {
 	wr.logger = logger
 }
 
+// LockTimeout returns the lock timeout used by this wrangler.
+func (wr *Wrangler) LockTimeout() time.Duration {
+	return wr.lockTimeout
+}
+
 // Logger returns the logger associated with this wrangler.
 func (wr *Wrangler) Logger() logutil.Logger {
 	return wr.logger